@@ -3,6 +3,7 @@ package apiserver
 import (
 	"fmt"
 	"net/http"
+	"path"
 	"time"
 
 	"github.com/BronOS/segdb/internal/pkg/segdb"
@@ -23,12 +24,24 @@ type APIServer struct {
 func New(config *Config) *APIServer {
 	return &APIServer{
 		config: config,
-		segdb:  segdb.New(segdb.NewMultiFileStorage(config.StoragePath)),
+		segdb:  segdb.New(newStorage(config)),
 		logger: logrus.New(),
 		router: mux.NewRouter(),
 	}
 }
 
+// newStorage creates storage configured by storage type
+func newStorage(config *Config) segdb.StorageInterface {
+	switch config.StorageType {
+	case "wal":
+		return segdb.NewWALStorage(config.StoragePath)
+	case "snapshot":
+		return segdb.NewSnapshotStorage(path.Join(config.StoragePath, "segments.snapshot"))
+	default:
+		return segdb.NewMultiFileStorage(config.StoragePath)
+	}
+}
+
 // Start ...
 func (s *APIServer) Start() error {
 	s.startedAt = time.Now()
@@ -37,11 +50,19 @@ func (s *APIServer) Start() error {
 		return err
 	}
 
+	if err := s.configureSegdb(); err != nil {
+		return err
+	}
+
 	s.logger.Info("Init DB...")
 	if err := s.segdb.Load(); err != nil {
 		return err
 	}
 
+	if err := s.configureSweeper(); err != nil {
+		return err
+	}
+
 	s.configureRouter()
 
 	s.logger.Info(fmt.Sprintf("Listening on addr: %s", s.config.BindAddr))
@@ -61,16 +82,81 @@ func (s *APIServer) configureLogger() error {
 	return nil
 }
 
+// Configure Segdb ...
+func (s *APIServer) configureSegdb() error {
+	if s.config.ErrorPolicy != "" {
+		policy, err := segdb.ParseErrorPolicy(s.config.ErrorPolicy)
+		if err != nil {
+			return err
+		}
+
+		s.segdb.SetErrorPolicy(policy)
+	}
+
+	s.segdb.SetQueryWorkers(s.config.QueryWorkers)
+	s.segdb.SetHistorySize(s.config.HistorySize)
+	s.segdb.SetAuditSize(s.config.AuditSize)
+
+	return nil
+}
+
+// Configure Sweeper ...
+func (s *APIServer) configureSweeper() error {
+	if s.config.SweepInterval == "" {
+		return nil
+	}
+
+	interval, err := time.ParseDuration(s.config.SweepInterval)
+	if err != nil {
+		return err
+	}
+
+	if interval <= 0 {
+		return nil
+	}
+
+	s.segdb.StartSweeper(interval, func(entries []segdb.AuditEntry, err error) {
+		if err != nil {
+			s.logger.Error(err)
+		}
+		for _, entry := range entries {
+			s.logger.Info(fmt.Sprintf("Segment %s expired at %s has been deleted", entry.ID, entry.ActiveUntil.Format(time.RFC3339)))
+		}
+	})
+
+	return nil
+}
+
 // Configure Router ...
 func (s *APIServer) configureRouter() {
 	s.router.HandleFunc("/ping", handlePing(s)).Methods(http.MethodGet)
 	s.router.HandleFunc("/info", handleInfo(s)).Methods(http.MethodGet)
 	s.router.HandleFunc("/reload", handleReload(s)).Methods(http.MethodGet)
 	s.router.HandleFunc("/add", handleAdd(s)).Methods(http.MethodPost)
+	s.router.HandleFunc("/patch", handlePatch(s)).Methods(http.MethodPatch)
 	s.router.HandleFunc("/publish", handlePublish(s)).Methods(http.MethodPost)
+	s.router.HandleFunc("/batch", handleBatch(s)).Methods(http.MethodPost)
+	s.router.HandleFunc("/import", handleImport(s)).Methods(http.MethodPost)
+	s.router.HandleFunc("/export", handleExport(s)).Methods(http.MethodGet)
+	s.router.HandleFunc("/status", handleStatus(s)).Methods(http.MethodPost)
+	s.router.HandleFunc("/audit", handleAudit(s)).Methods(http.MethodGet)
+	s.router.HandleFunc("/sweep", handleSweep(s)).Methods(http.MethodPost)
 	s.router.HandleFunc("/get", handleGet(s)).Methods(http.MethodGet)
 	s.router.HandleFunc("/getall", handleGetAll(s)).Methods(http.MethodGet)
 	s.router.HandleFunc("/list", handleList(s)).Methods(http.MethodGet)
 	s.router.HandleFunc("/query", handleQuery(s)).Methods(http.MethodGet)
+	s.router.HandleFunc("/query", handleQueryJSON(s)).Methods(http.MethodPost)
+	s.router.HandleFunc("/query/batch", handleQueryBatch(s)).Methods(http.MethodPost)
+	s.router.HandleFunc("/explain", handleExplain(s)).Methods(http.MethodGet)
+	s.router.HandleFunc("/schema", handleGetSchema(s)).Methods(http.MethodGet)
+	s.router.HandleFunc("/schema", handleSetSchema(s)).Methods(http.MethodPut)
+	s.router.HandleFunc("/fragments", handleGetFragments(s)).Methods(http.MethodGet)
+	s.router.HandleFunc("/fragment", handleGetFragment(s)).Methods(http.MethodGet)
+	s.router.HandleFunc("/fragment", handleSetFragment(s)).Methods(http.MethodPut)
+	s.router.HandleFunc("/fragment", handleDeleteFragment(s)).Methods(http.MethodDelete)
+	s.router.HandleFunc("/functions", handleFunctions(s)).Methods(http.MethodGet)
 	s.router.HandleFunc("/delete", handleDelete(s)).Methods(http.MethodDelete)
+	s.router.HandleFunc("/versions", handleVersions(s)).Methods(http.MethodGet)
+	s.router.HandleFunc("/diff", handleDiff(s)).Methods(http.MethodGet)
+	s.router.HandleFunc("/rollback", handleRollback(s)).Methods(http.MethodPost)
 }
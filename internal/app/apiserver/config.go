@@ -1,17 +1,36 @@
 package apiserver
 
+import "github.com/BronOS/segdb/internal/pkg/segdb"
+
 // Config ...
 type Config struct {
 	LogLevel    string `toml:"log_level"`
 	StoragePath string `toml:"storage_path"`
-	BindAddr    string
+	StorageType string `toml:"storage_type"`
+	ErrorPolicy string `toml:"error_policy"`
+	// QueryWorkers number of workers evaluating filters of one query
+	QueryWorkers int `toml:"query_workers"`
+	// BatchWorkers number of contexts of batch query evaluated in parallel
+	BatchWorkers int `toml:"batch_workers"`
+	// HistorySize number of prior versions of every segment kept in storage
+	HistorySize int `toml:"history_size"`
+	// AuditSize number of the latest audit entries kept in storage
+	AuditSize int `toml:"audit_size"`
+	// SweepInterval how often expired segments are deleted, e.g. "1m"
+	SweepInterval string `toml:"sweep_interval"`
+	BindAddr      string
 }
 
 // NewConfig ...
 func NewConfig(bindAddr string) *Config {
 	return &Config{
-		LogLevel:    "debug",
-		StoragePath: "var/lib/segdb",
-		BindAddr:    bindAddr,
+		LogLevel:      "debug",
+		StoragePath:   "var/lib/segdb",
+		StorageType:   "files",
+		ErrorPolicy:   "count",
+		HistorySize:   10,
+		AuditSize:     segdb.DefaultAuditSize,
+		SweepInterval: "1m",
+		BindAddr:      bindAddr,
 	}
 }
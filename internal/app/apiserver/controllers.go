@@ -1,20 +1,112 @@
 package apiserver
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/BronOS/segdb/internal/pkg/segdb"
+	"io"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
+type queryRequest struct {
+	Context json.RawMessage `json:"context"`
+	Where   json.RawMessage `json:"where"`
+	Limit   int             `json:"limit"`
+	Offset  int             `json:"offset"`
+	Sort    string          `json:"sort"`
+	// Unordered lets parallel evaluation stop as soon as enough segments are found
+	Unordered bool   `json:"unordered"`
+	Cursor    string `json:"cursor"`
+}
+
+type batchQueryRequest struct {
+	Contexts []json.RawMessage `json:"contexts"`
+	Where    json.RawMessage   `json:"where"`
+	Limit    int               `json:"limit"`
+	Offset   int               `json:"offset"`
+	Sort     string            `json:"sort"`
+}
+
+// cursorHeader carries cursor of the next page of /list and /query
+const cursorHeader = "X-Next-Cursor"
+
 type appendRequest struct {
-	ID      string                 `json:"id"`
-	Data    string                 `json:"data,omitempty"`
-	Filters string                 `json:"filters"`
-	Indexes map[string]interface{} `json:"indexes,omitempty"`
+	ID          string        `json:"id"`
+	Data        string        `json:"data,omitempty"`
+	Filters     string        `json:"filters"`
+	Indexes     segdb.Indexes `json:"indexes,omitempty"`
+	Priority    int           `json:"priority,omitempty"`
+	ActiveFrom  *time.Time    `json:"active_from,omitempty"`
+	ActiveUntil *time.Time    `json:"active_until,omitempty"`
+	Status      string        `json:"status,omitempty"`
+}
+
+// segment ...
+func (req *appendRequest) segment() *segdb.Segment {
+	segment := &segdb.Segment{
+		ID:       req.ID,
+		Data:     req.Data,
+		Filters:  req.Filters,
+		Indexes:  req.Indexes,
+		Priority: req.Priority,
+		Status:   req.Status,
+	}
+
+	if req.ActiveFrom != nil {
+		segment.ActiveFrom = *req.ActiveFrom
+	}
+	if req.ActiveUntil != nil {
+		segment.ActiveUntil = *req.ActiveUntil
+	}
+
+	return segment
+}
+
+type applyRequest struct {
+	Upserts []appendRequest `json:"upserts"`
+	Deletes []string        `json:"deletes"`
+}
+
+type patchRequest struct {
+	ID            string        `json:"id"`
+	Data          *string       `json:"data"`
+	Filters       *string       `json:"filters"`
+	Priority      *int          `json:"priority"`
+	ActiveFrom    nullableTime  `json:"active_from"`
+	ActiveUntil   nullableTime  `json:"active_until"`
+	Status        *string       `json:"status"`
+	SetIndexes    segdb.Indexes `json:"set_indexes"`
+	RemoveIndexes []string      `json:"remove_indexes"`
+}
+
+// nullableTime tells null, which clears time, from a missing field
+type nullableTime struct {
+	Set  bool
+	Time time.Time
+}
+
+// UnmarshalJSON ...
+func (t *nullableTime) UnmarshalJSON(data []byte) error {
+	t.Set = true
+	if string(data) == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+	return json.Unmarshal(data, &t.Time)
+}
+
+// ptr is nil unless time is set
+func (t *nullableTime) ptr() *time.Time {
+	if t.Set == false {
+		return nil
+	}
+	return &t.Time
 }
 
 // handlePing...
@@ -39,6 +131,7 @@ func handleInfo(s *APIServer) http.HandlerFunc {
 			"uptime":         int64(d.Seconds()),
 			"index_size":     s.segdb.GetIndexSize(),
 			"segments_count": s.segdb.GetSegmentsCount(),
+			"filter_errors":  s.segdb.FilterErrors(),
 		})
 	}
 }
@@ -61,12 +154,8 @@ func handleGet(s *APIServer) http.HandlerFunc {
 			return
 		}
 
-		writeJSON(w, &map[string]interface{}{
-			"id":      segment.ID,
-			"data":    segment.Data,
-			"filters": segment.Filters,
-			"indexes": segment.Indexes,
-		})
+		w.Header().Set("ETag", etag(segment.Version))
+		writeJSON(w, segmentJSON(segment))
 	}
 }
 
@@ -81,7 +170,25 @@ func handleDelete(s *APIServer) http.HandlerFunc {
 			return
 		}
 
-		if err := s.segdb.Delete(ids[0]); err != nil {
+		version, conditional, err := parsePrecondition(r)
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if conditional {
+			err = s.segdb.DeleteIf(ids[0], version)
+		} else {
+			err = s.segdb.Delete(ids[0])
+		}
+
+		if errors.Is(err, segdb.ErrConflict) {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusPreconditionFailed)
+			return
+		}
+		if err != nil {
 			s.logger.Error(err)
 			writeERRORCode(w, fmt.Errorf("Not found"), http.StatusNotFound)
 			return
@@ -93,6 +200,79 @@ func handleDelete(s *APIServer) http.HandlerFunc {
 	}
 }
 
+// handleVersions...
+func handleVersions(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			s.logger.Error(errors.New("Bad Request. ID not found"))
+			writeERRORCode(w, fmt.Errorf("ID not found"), http.StatusBadRequest)
+			return
+		}
+
+		versions, err := s.segdb.History(id)
+		if err != nil {
+			s.logger.Error(err)
+			if errors.Is(err, segdb.ErrNotFound) {
+				writeERRORCode(w, fmt.Errorf("Not found"), http.StatusNotFound)
+				return
+			}
+			writeERROR(w, err)
+			return
+		}
+
+		m := []*map[string]interface{}{}
+		for _, segment := range versions {
+			m = append(m, segmentJSON(segment))
+		}
+
+		writeJSON(w, m)
+	}
+}
+
+// handleDiff...
+func handleDiff(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, versions, err := parseVersionParams(r.URL.Query(), "from", "to")
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		changes, err := s.segdb.Diff(id, versions[0], versions[1])
+		if err != nil {
+			s.logger.Error(err)
+			writeVersionError(w, err)
+			return
+		}
+
+		writeJSON(w, changes)
+	}
+}
+
+// handleRollback...
+func handleRollback(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, versions, err := parseVersionParams(r.URL.Query(), "version")
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		segment, err := s.segdb.Rollback(id, versions[0])
+		if err != nil {
+			s.logger.Error(err)
+			writeVersionError(w, err)
+			return
+		}
+
+		w.Header().Set("ETag", etag(segment.Version))
+		writeJSON(w, segmentJSON(segment))
+	}
+}
+
 // handleGetAll...
 func handleGetAll(s *APIServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -108,12 +288,7 @@ func handleGetAll(s *APIServer) http.HandlerFunc {
 		m := make([]*map[string]interface{}, len(segments))
 
 		for _, segment := range segments {
-			m = append(m, &map[string]interface{}{
-				"id":      segment.ID,
-				"data":    segment.Data,
-				"filters": segment.Filters,
-				"indexes": segment.Indexes,
-			})
+			m = append(m, segmentJSON(segment))
 		}
 
 		writeJSON(w, m)
@@ -126,7 +301,11 @@ func handleList(s *APIServer) http.HandlerFunc {
 		params := r.URL.Query()
 		limit := -1
 		offset := -1
-		indexes := map[string]interface{}{}
+		order := ""
+		cursor := ""
+		inactive := false
+		statuses := []string{}
+		where := []segdb.IndexQuery{}
 
 		for k, v := range params {
 			if k == "limit" && len(v) > 0 {
@@ -151,47 +330,73 @@ func handleList(s *APIServer) http.HandlerFunc {
 				continue
 			}
 
-			// try to convert to FLOAT32
-			f32v, err := strconv.ParseFloat(v[0], 32)
-			if err == nil {
-				indexes[k] = f32v
+			if k == "sort" && len(v) > 0 {
+				order = v[0]
 				continue
 			}
 
-			// try to convert to FLOAT64
-			f64v, err := strconv.ParseFloat(v[0], 64)
-			if err == nil {
-				indexes[k] = f64v
+			if k == "cursor" && len(v) > 0 {
+				cursor = v[0]
 				continue
 			}
 
-			// try to convert to INT
-			iv, err := strconv.Atoi(v[0])
-			if err == nil {
-				indexes[k] = iv
+			if k == "inactive" && len(v) > 0 {
+				b, err := strconv.ParseBool(v[0])
+				if err != nil {
+					s.logger.Error(err)
+					writeERRORCode(w, fmt.Errorf("Inactive must be BOOL"), http.StatusBadRequest)
+					return
+				}
+				inactive = b
 				continue
 			}
 
-			// try to convert to BOOL
-			bv, err := strconv.ParseBool(v[0])
-			if err == nil {
-				indexes[k] = bv
+			// repeated or comma separated
+			if k == "status" {
+				for _, value := range v {
+					statuses = append(statuses, strings.Split(value, ",")...)
+				}
 				continue
 			}
 
-			indexes[k] = v[0]
+			q, err := parseIndexParam(k, v)
+			if err != nil {
+				s.logger.Error(err)
+				writeERRORCode(w, err, http.StatusBadRequest)
+				return
+			}
+			where = append(where, q)
+		}
+
+		page, err := s.segdb.ListPage(&segdb.ListOptions{
+			Where:    segdb.And(where...),
+			Limit:    limit,
+			Offset:   offset,
+			Sort:     order,
+			Cursor:   cursor,
+			Inactive: inactive,
+			Status:   statuses,
+		})
+		if errors.Is(err, segdb.ErrCursorExpired) {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusGone)
+			return
+		}
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		segments := page.Segments
+		if page.Next != "" {
+			w.Header().Set(cursorHeader, page.Next)
 		}
 
-		segments := s.segdb.List(indexes, limit, offset)
 		m := []*map[string]interface{}{}
 
 		for _, segment := range segments {
-			m = append(m, &map[string]interface{}{
-				"id":      segment.ID,
-				"data":    segment.Data,
-				"filters": segment.Filters,
-				"indexes": segment.Indexes,
-			})
+			m = append(m, segmentJSON(segment))
 		}
 
 		writeJSON(w, m)
@@ -201,66 +406,259 @@ func handleList(s *APIServer) http.HandlerFunc {
 // handleQuery...
 func handleQuery(s *APIServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		params := r.URL.Query()
-		limit := -1
-		p := map[string]interface{}{}
+		q, err := parseQueryParams(r.URL.Query(), s.segdb.Schema())
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
 
-		for k, v := range params {
-			if k == "limit" && len(v) > 0 {
-				lim, err := strconv.Atoi(v[0])
-				if err != nil {
-					s.logger.Error(err)
-					writeERRORCode(w, fmt.Errorf("Limit must be INT"), http.StatusBadRequest)
-					return
-				}
-				limit = lim
-				continue
-			}
+		writeQueryResult(s, w, q)
+	}
+}
 
-			// try to convert to FLOAT32
-			f32v, err := strconv.ParseFloat(v[0], 32)
-			if err == nil {
-				p[k] = f32v
-				continue
-			}
+// handleQueryJSON...
+func handleQueryJSON(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseQueryRequest(r)
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
 
-			// try to convert to FLOAT64
-			f64v, err := strconv.ParseFloat(v[0], 64)
-			if err == nil {
-				p[k] = f64v
-				continue
-			}
+		writeQueryResult(s, w, q)
+	}
+}
 
-			// try to convert to INT
-			iv, err := strconv.Atoi(v[0])
-			if err == nil {
-				p[k] = iv
-				continue
+// handleQueryBatch...
+func handleQueryBatch(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseBatchQueryRequest(r)
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+		q.Workers = s.config.BatchWorkers
+
+		results, err := s.segdb.FindBatch(q)
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		m := make([]map[string]interface{}, 0, len(results))
+
+		for _, result := range results {
+			ids := []string{}
+			for _, segment := range result.Segments {
+				ids = append(ids, segment.ID)
 			}
 
-			// try to convert to BOOL
-			bv, err := strconv.ParseBool(v[0])
-			if err == nil {
-				p[k] = bv
-				continue
+			item := map[string]interface{}{"ids": ids}
+			if result.Err != nil {
+				item["error"] = result.Err.Error()
 			}
 
-			p[k] = v[0]
+			m = append(m, item)
 		}
 
-		segments := s.segdb.Query(p, limit)
-		m := []*map[string]interface{}{}
+		writeJSON(w, m)
+	}
+}
 
-		for _, segment := range segments {
-			m = append(m, &map[string]interface{}{
-				"id":      segment.ID,
-				"data":    segment.Data,
-				"filters": segment.Filters,
-				"indexes": segment.Indexes,
-			})
+// writeQueryResult runs query and writes found segments
+func writeQueryResult(s *APIServer, w http.ResponseWriter, q *segdb.QueryOptions) {
+	var page *segdb.Page
+	var err error
+
+	// unordered results can not be continued
+	if q.Unordered {
+		page = &segdb.Page{}
+		page.Segments, err = s.segdb.Find(q)
+	} else {
+		page, err = s.segdb.FindPage(q)
+	}
+
+	if err != nil {
+		s.logger.Error(err)
+		fe := &segdb.FieldError{}
+		if errors.As(err, &fe) || errors.Is(err, segdb.ErrSortOrder) || errors.Is(err, segdb.ErrCursor) {
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
 		}
+		if errors.Is(err, segdb.ErrCursorExpired) {
+			writeERRORCode(w, err, http.StatusGone)
+			return
+		}
+		writeERROR(w, err)
+		return
+	}
 
-		writeJSON(w, m)
+	segments := page.Segments
+	if page.Next != "" {
+		w.Header().Set(cursorHeader, page.Next)
+	}
+
+	m := []*map[string]interface{}{}
+
+	for _, segment := range segments {
+		m = append(m, segmentJSON(segment))
+	}
+
+	writeJSON(w, m)
+}
+
+// handleExplain...
+func handleExplain(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseQueryParams(r.URL.Query(), s.segdb.Schema())
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, s.segdb.ExplainWhere(q.Where, q.Context, q.Limit))
+	}
+}
+
+// handleGetSchema...
+func handleGetSchema(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		schema := s.segdb.Schema()
+		if schema == nil {
+			schema = segdb.Schema{}
+		}
+
+		writeJSON(w, schema)
+	}
+}
+
+// handleSetSchema...
+func handleSetSchema(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		schema := segdb.Schema{}
+		if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, fmt.Errorf("Bad Request"), http.StatusBadRequest)
+			return
+		}
+
+		// empty schema removes it
+		if len(schema) == 0 {
+			schema = nil
+		}
+
+		if err := s.segdb.SetSchema(schema); err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+		}
+	}
+}
+
+// handleFunctions...
+func handleFunctions(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.segdb.Functions())
+	}
+}
+
+// handleGetFragments...
+func handleGetFragments(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.segdb.Fragments())
+	}
+}
+
+// handleGetFragment...
+func handleGetFragment(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fragment, err := s.segdb.Fragment(r.URL.Query().Get("name"))
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, fmt.Errorf("Not found"), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("ETag", etag(fragment.Version))
+		writeJSON(w, fragment)
+	}
+}
+
+// fragmentRequest ...
+type fragmentRequest struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+// handleSetFragment...
+func handleSetFragment(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &fragmentRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, fmt.Errorf("Bad Request"), http.StatusBadRequest)
+			return
+		}
+
+		version, conditional, err := parsePrecondition(r)
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		var fragment *segdb.Fragment
+		if conditional {
+			fragment, err = s.segdb.SetFragmentIf(req.Name, req.Expr, version)
+		} else {
+			fragment, err = s.segdb.SetFragment(req.Name, req.Expr)
+		}
+
+		if errors.Is(err, segdb.ErrConflict) {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusPreconditionFailed)
+			return
+		}
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("ETag", etag(fragment.Version))
+		writeJSON(w, fragment)
+	}
+}
+
+// handleDeleteFragment...
+func handleDeleteFragment(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+
+		err := s.segdb.DeleteFragment(name)
+		if errors.Is(err, segdb.ErrFragmentInUse) {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusConflict)
+			return
+		}
+		if errors.Is(err, segdb.ErrNotFound) {
+			s.logger.Error(err)
+			writeERRORCode(w, fmt.Errorf("Not found"), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.logger.Error(err)
+			writeERROR(w, err)
+			return
+		}
+
+		writeJSON(w, &map[string]interface{}{
+			"name": name,
+		})
 	}
 }
 
@@ -284,51 +682,592 @@ func handleAdd(s *APIServer) http.HandlerFunc {
 			return
 		}
 
-		if err := s.segdb.Add(&segdb.Segment{
-			ID:      req.ID,
-			Data:    req.Data,
-			Filters: req.Filters,
-			Indexes: req.Indexes,
-		}); err != nil {
+		version, conditional, err := parsePrecondition(r)
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		segment := req.segment()
+
+		if conditional {
+			err = s.segdb.AddIf(segment, version)
+		} else {
+			err = s.segdb.Add(segment)
+		}
+
+		if err != nil {
 			s.logger.Error(err)
+			if invalidSegment(err) {
+				writeERRORCode(w, err, http.StatusBadRequest)
+				return
+			}
+			if errors.Is(err, segdb.ErrConflict) {
+				writeERRORCode(w, err, http.StatusPreconditionFailed)
+				return
+			}
+			if errors.Is(err, segdb.ErrTransition) {
+				writeERRORCode(w, err, http.StatusConflict)
+				return
+			}
 			writeERROR(w, err)
+			return
+		}
+
+		w.Header().Set("ETag", etag(segment.Version))
+	}
+}
+
+// handlePatch...
+func handlePatch(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &patchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, fmt.Errorf("Bad Request"), http.StatusBadRequest)
+			return
+		}
+
+		version, conditional, err := parsePrecondition(r)
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		patch := &segdb.Patch{
+			Data:          req.Data,
+			Filters:       req.Filters,
+			Priority:      req.Priority,
+			ActiveFrom:    req.ActiveFrom.ptr(),
+			ActiveUntil:   req.ActiveUntil.ptr(),
+			Status:        req.Status,
+			SetIndexes:    req.SetIndexes,
+			RemoveIndexes: req.RemoveIndexes,
+		}
+
+		var segment *segdb.Segment
+		if conditional {
+			segment, err = s.segdb.PatchIf(req.ID, patch, version)
+		} else {
+			segment, err = s.segdb.Patch(req.ID, patch)
 		}
+
+		if err != nil {
+			s.logger.Error(err)
+			writePatchError(w, err)
+			return
+		}
+
+		w.Header().Set("ETag", etag(segment.Version))
+		writeJSON(w, segmentJSON(segment))
+	}
+}
+
+// statusRequest ...
+type statusRequest struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// handleStatus...
+func handleStatus(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &statusRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, fmt.Errorf("Bad Request"), http.StatusBadRequest)
+			return
+		}
+
+		version, conditional, err := parsePrecondition(r)
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+			return
+		}
+
+		var segment *segdb.Segment
+		if conditional {
+			segment, err = s.segdb.SetStatusIf(req.ID, req.Status, version)
+		} else {
+			segment, err = s.segdb.SetStatus(req.ID, req.Status)
+		}
+
+		if err != nil {
+			s.logger.Error(err)
+			writePatchError(w, err)
+			return
+		}
+
+		w.Header().Set("ETag", etag(segment.Version))
+		writeJSON(w, segmentJSON(segment))
+	}
+}
+
+// invalidSegment tells whether err is caused by segment given by client
+func invalidSegment(err error) bool {
+	for _, target := range []error{
+		segdb.ErrEmptyID,
+		segdb.ErrInvalidStatus,
+		segdb.ErrIndexValue,
+		segdb.ErrReservedIndex,
+		segdb.ErrFilters,
+		segdb.ErrStrict,
+		segdb.ErrFragmentName,
+		segdb.ErrUnknownFragment,
+		segdb.ErrUnknownFunction,
+		segdb.ErrFunctionArgs,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writePatchError ...
+func writePatchError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, segdb.ErrNotFound):
+		writeERRORCode(w, fmt.Errorf("Not found"), http.StatusNotFound)
+	case errors.Is(err, segdb.ErrConflict):
+		writeERRORCode(w, err, http.StatusPreconditionFailed)
+	case errors.Is(err, segdb.ErrTransition):
+		writeERRORCode(w, err, http.StatusConflict)
+	default:
+		writeERRORCode(w, err, http.StatusBadRequest)
 	}
 }
 
 // handlePublish...
 func handlePublish(s *APIServer) http.HandlerFunc {
-	type request []struct {
-		appendRequest
+	return func(w http.ResponseWriter, r *http.Request) {
+		dec := json.NewDecoder(r.Body)
+
+		// segments are decoded and staged one by one instead of the whole body at once
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			s.logger.Error(errors.New("Bad Request. Array of segments expected"))
+			writeERRORCode(w, fmt.Errorf("Bad Request"), http.StatusBadRequest)
+			return
+		}
+
+		// decoding errors are told apart from rejected segments
+		var decodeErr error
+		err := s.segdb.PublishFrom(func() (*segdb.Segment, error) {
+			if dec.More() == false {
+				return nil, nil
+			}
+
+			req := &appendRequest{}
+			if decodeErr = dec.Decode(req); decodeErr != nil {
+				return nil, decodeErr
+			}
+
+			return req.segment(), nil
+		})
+
+		if decodeErr != nil {
+			s.logger.Error(decodeErr)
+			writeERRORCode(w, fmt.Errorf("Bad Request"), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			s.logger.Error(err)
+			writeERRORCode(w, err, http.StatusBadRequest)
+		}
+	}
+}
+
+// handleImport...
+func handleImport(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		replace := false
+		if v := r.URL.Query().Get("replace"); v != "" {
+			var err error
+			if replace, err = strconv.ParseBool(v); err != nil {
+				s.logger.Error(err)
+				writeERRORCode(w, fmt.Errorf("Replace must be BOOL"), http.StatusBadRequest)
+				return
+			}
+		}
+
+		n, err := s.segdb.Import(r.Body, replace)
+		if err != nil {
+			s.logger.Error(err)
+			// batches imported before the failed one are kept
+			writeJSONCode(w, map[string]interface{}{
+				"status":   "ERR",
+				"error":    err.Error(),
+				"imported": n,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, &map[string]interface{}{
+			"status":   "OK",
+			"imported": n,
+		})
+	}
+}
+
+// handleExport...
+func handleExport(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+
+		out := io.Writer(w)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			defer zw.Close()
+			out = zw
+		}
+
+		// status is sent already, the client gets a truncated stream
+		if _, err := s.segdb.Export(out); err != nil {
+			s.logger.Error(err)
+		}
+	}
+}
+
+// handleAudit...
+func handleAudit(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := s.segdb.Audit()
+		if err != nil {
+			s.logger.Error(err)
+			writeERROR(w, err)
+			return
+		}
+
+		writeJSON(w, entries)
+	}
+}
+
+// handleSweep...
+func handleSweep(s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := s.segdb.Sweep()
+		if err != nil {
+			s.logger.Error(err)
+			writeERROR(w, err)
+			return
+		}
+
+		writeJSON(w, entries)
 	}
+}
 
+// handleBatch...
+func handleBatch(s *APIServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		reqSlice := &request{}
-		if err := json.NewDecoder(r.Body).Decode(reqSlice); err != nil {
+		req := &applyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 			s.logger.Error(err)
 			writeERRORCode(w, fmt.Errorf("Bad Request"), http.StatusBadRequest)
 			return
 		}
 
-		segments := []*segdb.Segment{}
-		for _, req := range *reqSlice {
-			segments = append(segments, &segdb.Segment{
-				ID:      req.ID,
-				Data:    req.Data,
-				Filters: req.Filters,
-				Indexes: req.Indexes,
-			})
+		segments := make([]*segdb.Segment, 0, len(req.Upserts))
+		for i := range req.Upserts {
+			segments = append(segments, req.Upserts[i].segment())
 		}
 
-		if err := s.segdb.Publish(segments); err != nil {
+		results, err := s.segdb.Apply(segments, req.Deletes)
+
+		if err != nil && errors.Is(err, segdb.ErrBatchRejected) == false {
 			s.logger.Error(err)
-			writeERRORCode(w, err, http.StatusBadRequest)
+			writeERROR(w, err)
+			return
+		}
+
+		items := make([]map[string]interface{}, 0, len(results))
+		for _, result := range results {
+			item := map[string]interface{}{"id": result.ID}
+			if result.Err != nil {
+				item["error"] = result.Err.Error()
+			} else if result.Status != "" {
+				item["status"] = result.Status
+				item["version"] = result.Version
+			}
+			items = append(items, item)
 		}
+
+		if err != nil {
+			s.logger.Error(err)
+			writeJSONCode(w, map[string]interface{}{
+				"status":  "ERR",
+				"error":   err.Error(),
+				"results": items,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"status":  "OK",
+			"results": items,
+		})
 	}
 }
 
 ///////////////////////////////////////////////////////////////////////
 
+// segmentJSON ...
+func segmentJSON(segment *segdb.Segment) *map[string]interface{} {
+	return &map[string]interface{}{
+		"id":         segment.ID,
+		"data":       segment.Data,
+		"filters":    segment.Filters,
+		"indexes":    segment.Indexes,
+		"priority":   segment.Priority,
+		"version":    segment.Version,
+		"created_at": segment.CreatedAt,
+		"updated_at": segment.UpdatedAt,
+		// unbounded time window is null
+		"active_from":  timeOrNil(segment.ActiveFrom),
+		"active_until": timeOrNil(segment.ActiveUntil),
+		"status":       segment.Status,
+	}
+}
+
+// timeOrNil ...
+func timeOrNil(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// parseQueryRequest parses JSON body of POST /query
+func parseQueryRequest(r *http.Request) (*segdb.QueryOptions, error) {
+	req := &queryRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, fmt.Errorf("Bad Request")
+	}
+
+	q := &segdb.QueryOptions{
+		Limit:     req.Limit,
+		Offset:    req.Offset,
+		Sort:      req.Sort,
+		Unordered: req.Unordered,
+		Cursor:    req.Cursor,
+	}
+
+	if len(req.Context) > 0 {
+		m, err := segdb.UnmarshalContext(req.Context)
+		if err != nil {
+			return nil, fmt.Errorf("Bad context: %w", err)
+		}
+		q.Context = m
+	}
+
+	if len(req.Where) > 0 {
+		where, err := segdb.UnmarshalIndexQuery(req.Where)
+		if err != nil {
+			return nil, err
+		}
+		q.Where = where
+	}
+
+	return q, nil
+}
+
+// parseBatchQueryRequest parses JSON body of POST /query/batch
+func parseBatchQueryRequest(r *http.Request) (*segdb.BatchOptions, error) {
+	req := &batchQueryRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, fmt.Errorf("Bad Request")
+	}
+
+	q := &segdb.BatchOptions{
+		Contexts: make([]map[string]interface{}, 0, len(req.Contexts)),
+		Limit:    req.Limit,
+		Offset:   req.Offset,
+		Sort:     req.Sort,
+	}
+
+	for i, raw := range req.Contexts {
+		m, err := segdb.UnmarshalContext(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Bad context %d: %w", i, err)
+		}
+		q.Contexts = append(q.Contexts, m)
+	}
+
+	if len(req.Where) > 0 {
+		where, err := segdb.UnmarshalIndexQuery(req.Where)
+		if err != nil {
+			return nil, err
+		}
+		q.Where = where
+	}
+
+	return q, nil
+}
+
+// parseQueryParams parses query string of /query: index constraints,
+// filter params typed by schema, limit and sort
+func parseQueryParams(params url.Values, schema segdb.Schema) (*segdb.QueryOptions, error) {
+	q := &segdb.QueryOptions{Limit: -1, Context: map[string]interface{}{}}
+	where := []segdb.IndexQuery{}
+
+	for k, v := range params {
+		if k == "limit" && len(v) > 0 {
+			lim, err := strconv.Atoi(v[0])
+			if err != nil {
+				return nil, fmt.Errorf("Limit must be INT")
+			}
+			q.Limit = lim
+			continue
+		}
+
+		if k == "sort" && len(v) > 0 {
+			q.Sort = v[0]
+			continue
+		}
+
+		if k == "cursor" && len(v) > 0 {
+			q.Cursor = v[0]
+			continue
+		}
+
+		// operators and repeated values are index constraints only
+		if len(v) > 1 || strings.HasSuffix(k, "]") {
+			iq, err := parseIndexParam(k, v)
+			if err != nil {
+				return nil, err
+			}
+			where = append(where, iq)
+			continue
+		}
+
+		value, err := schema.ParseValue(k, v[0])
+		if err != nil {
+			return nil, err
+		}
+		q.Context[k] = value
+	}
+
+	q.Where = segdb.And(where...)
+
+	return q, nil
+}
+
+// etag of segment version
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// parsePrecondition parses expected segment version of write request:
+// If-Match with ETag of the version, or If-None-Match: * when segment
+// must not exist yet
+func parsePrecondition(r *http.Request) (uint64, bool, error) {
+	if r.Header.Get("If-None-Match") == "*" {
+		return 0, true, nil
+	}
+
+	tag := r.Header.Get("If-Match")
+	if tag == "" {
+		return 0, false, nil
+	}
+
+	tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+	version, err := strconv.ParseUint(tag, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("If-Match must be ETag of segment version")
+	}
+
+	return version, true, nil
+}
+
+// parseVersionParams parses segment id and version numbers named by keys
+func parseVersionParams(params url.Values, keys ...string) (string, []uint64, error) {
+	id := params.Get("id")
+	if id == "" {
+		return "", nil, fmt.Errorf("ID not found")
+	}
+
+	versions := make([]uint64, 0, len(keys))
+	for _, key := range keys {
+		v, err := strconv.ParseUint(params.Get(key), 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s must be a version number", strings.Title(key))
+		}
+		versions = append(versions, v)
+	}
+
+	return id, versions, nil
+}
+
+// parseIndexParam parses query string parameter into index query:
+//
+//	name=v                index equals v
+//	name=v1&name=v2       index equals any of values
+//	name[in]=v1,v2        index equals any of values
+//	name[not]=v           index does not equal any of values
+//	name[gt]=v, [gte], [lt], [lte]  index value is in range
+func parseIndexParam(key string, values []string) (segdb.IndexQuery, error) {
+	name, op := key, ""
+	if i := strings.Index(key, "["); i > 0 && strings.HasSuffix(key, "]") {
+		name, op = key[:i], key[i+1:len(key)-1]
+	}
+
+	if op == "in" {
+		list := []string{}
+		for _, v := range values {
+			list = append(list, strings.Split(v, ",")...)
+		}
+		values, op = list, ""
+	}
+
+	terms := make([]segdb.IndexQuery, 0, len(values))
+	for _, v := range values {
+		value := segdb.ParseIndexValue(v)
+
+		switch op {
+		case "", "not":
+			terms = append(terms, segdb.Eq(name, value))
+		case "gt":
+			terms = append(terms, segdb.Gt(name, value))
+		case "gte":
+			terms = append(terms, segdb.Gte(name, value))
+		case "lt":
+			terms = append(terms, segdb.Lt(name, value))
+		case "lte":
+			terms = append(terms, segdb.Lte(name, value))
+		default:
+			return nil, fmt.Errorf("Unknown operator %s", op)
+		}
+	}
+
+	switch op {
+	case "":
+		return segdb.Or(terms...), nil
+	case "not":
+		return segdb.Not(segdb.Or(terms...)), nil
+	}
+
+	return segdb.And(terms...), nil
+}
+
+// writeVersionError responds with 404 to unknown segment or version
+func writeVersionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, segdb.ErrNotFound) || errors.Is(err, segdb.ErrVersionNotFound) {
+		writeERRORCode(w, err, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, segdb.ErrStrict) {
+		writeERRORCode(w, err, http.StatusBadRequest)
+		return
+	}
+
+	writeERROR(w, err)
+}
+
 // writeJSONCode ...
 func writeJSONCode(w http.ResponseWriter, data interface{}, code int) {
 	w.Header().Set("Content-Type", "application/json")
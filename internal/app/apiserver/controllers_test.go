@@ -1,11 +1,20 @@
 package apiserver
 
 import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/BronOS/segdb/internal/pkg/segdb"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,6 +38,10 @@ func Test_handleInfo(t *testing.T) {
 	handleInfo(s).ServeHTTP(rec, req)
 
 	assert.Equal(t, 200, rec.Code)
+
+	info := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+	assert.Equal(t, []interface{}{}, info["filter_errors"])
 }
 
 func Test_handleList(t *testing.T) {
@@ -55,6 +68,580 @@ func getAPIServer() *APIServer {
 	})
 }
 
+// getTestAPIServer returns server with storage of its own, removed by
+// returned func
+func getTestAPIServer(t *testing.T) (*APIServer, func()) {
+	dir, err := ioutil.TempDir("", "segdb")
+	assert.NoError(t, err)
+
+	s := New(&Config{
+		LogLevel:    "debug",
+		StoragePath: path.Join(dir, "segdb"),
+		BindAddr:    ":4510",
+	})
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
 func clearStorage() {
 	os.RemoveAll(storagePath)
 }
+
+func Test_parseIndexParam(t *testing.T) {
+	q, err := parseIndexParam("country", []string{"US"})
+	assert.NoError(t, err)
+	assert.Equal(t, segdb.Or(segdb.Eq("country", "US")), q)
+
+	q, err = parseIndexParam("country", []string{"US", "CA"})
+	assert.NoError(t, err)
+	assert.Equal(t, segdb.Or(segdb.Eq("country", "US"), segdb.Eq("country", "CA")), q)
+
+	q, err = parseIndexParam("age[not]", []string{"18"})
+	assert.NoError(t, err)
+	assert.Equal(t, segdb.Not(segdb.Or(segdb.Eq("age", int64(18)))), q)
+
+	q, err = parseIndexParam("country[in]", []string{"US,CA"})
+	assert.NoError(t, err)
+	assert.Equal(t, segdb.Or(segdb.Eq("country", "US"), segdb.Eq("country", "CA")), q)
+
+	q, err = parseIndexParam("age[gte]", []string{"18"})
+	assert.NoError(t, err)
+	assert.Equal(t, segdb.And(segdb.Gte("age", int64(18))), q)
+
+	_, err = parseIndexParam("age[xor]", []string{"18"})
+	assert.Error(t, err)
+}
+
+func Test_handleExplain(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/explain?country=US&limit=10", nil)
+	handleExplain(s).ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+
+	e := &segdb.Explanation{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(e))
+	assert.Equal(t, segdb.PlanFullScan, e.Plan)
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/explain?limit=ten", nil)
+	handleExplain(s).ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+}
+
+func Test_configureSegdb(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+	assert.NoError(t, s.configureSegdb())
+
+	s.config.ErrorPolicy = "panic"
+	assert.Error(t, s.configureSegdb())
+
+	s.config.SweepInterval = "soon"
+	assert.Error(t, s.configureSweeper())
+}
+
+func Test_parseQueryParams(t *testing.T) {
+	schema := segdb.Schema{"level": {Type: "int"}, "zip": {Type: "string"}}
+
+	q, err := parseQueryParams(url.Values{
+		"level": {"1"}, "zip": {"01234"}, "age": {"18"}, "country": {"US", "CA"}, "limit": {"5"}, "sort": {"id"},
+	}, schema)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"level": int64(1), "zip": "01234", "age": int64(18)}, q.Context)
+	assert.Equal(t, segdb.And(segdb.Or(segdb.Eq("country", "US"), segdb.Eq("country", "CA"))), q.Where)
+	assert.Equal(t, 5, q.Limit)
+	assert.Equal(t, segdb.SortID, q.Sort)
+
+	_, err = parseQueryParams(url.Values{"level": {"high"}}, schema)
+	assert.True(t, errors.Is(err, segdb.ErrFieldType))
+}
+
+func Test_parseQueryRequest(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "/query", strings.NewReader(`{
+		"context": {"user": {"interests": ["golf"], "age": 30}},
+		"where": {"country": ["US", "CA"]},
+		"limit": 10, "offset": 5, "sort": "id"
+	}`))
+
+	q, err := parseQueryRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, &segdb.QueryOptions{
+		Where: segdb.And(segdb.In("country", "US", "CA")),
+		Context: map[string]interface{}{
+			"user": map[string]interface{}{"interests": []interface{}{"golf"}, "age": int64(30)},
+		},
+		Limit:  10,
+		Offset: 5,
+		Sort:   segdb.SortID,
+	}, q)
+
+	for _, body := range []string{`[]`, `{"context": []}`, `{"where": {"age": {"like": 1}}}`} {
+		req, _ = http.NewRequest(http.MethodPost, "/query", strings.NewReader(body))
+		_, err = parseQueryRequest(req)
+		assert.Error(t, err, body)
+	}
+}
+
+func Test_handleQueryJSON(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/query", strings.NewReader(`{"context": {"level": 1}, "sort": "random"}`))
+	handleQueryJSON(s).ServeHTTP(rec, req)
+
+	assert.Equal(t, 400, rec.Code)
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/query", strings.NewReader(`{"context": {"level": 1}}`))
+	handleQueryJSON(s).ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "[]\n", rec.Body.String())
+}
+
+func Test_handleQueryBatch(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/query/batch", strings.NewReader(`{
+		"contexts": [{"level": 1}, {"user": {"age": 30}}],
+		"where": {"country": "US"}
+	}`))
+	handleQueryBatch(s).ServeHTTP(rec, req)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, `[{"ids":[]},{"ids":[]}]`+"\n", rec.Body.String())
+
+	for _, body := range []string{`{"contexts": [1]}`, `{"contexts": [{}], "sort": "random"}`, `{"where": []}`} {
+		rec = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodPost, "/query/batch", strings.NewReader(body))
+		handleQueryBatch(s).ServeHTTP(rec, req)
+
+		assert.Equal(t, 400, rec.Code, body)
+	}
+}
+
+func Test_handleQueryCursor(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+	for _, id := range []string{"cursor1", "cursor2", "cursor3"} {
+		assert.NoError(t, s.segdb.Add(&segdb.Segment{ID: id, Filters: `paged == true`}))
+	}
+
+	ids := []string{}
+	target := "/query?paged=true&limit=2"
+	for target != "" {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		handleQuery(s).ServeHTTP(rec, req)
+		assert.Equal(t, 200, rec.Code)
+
+		found := []map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&found))
+		for _, segment := range found {
+			ids = append(ids, segment["id"].(string))
+		}
+
+		target = ""
+		if next := rec.Header().Get(cursorHeader); next != "" {
+			target = "/query?paged=true&limit=2&cursor=" + url.QueryEscape(next)
+		}
+	}
+	assert.Equal(t, []string{"cursor1", "cursor2", "cursor3"}, ids)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/list?cursor=garbage", nil)
+	handleList(s).ServeHTTP(rec, req)
+	assert.Equal(t, 400, rec.Code)
+}
+
+func Test_handleVersions(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+	s.segdb.SetHistorySize(5)
+
+	assert.NoError(t, s.segdb.Add(&segdb.Segment{ID: "versioned", Filters: `level == 1`}))
+	assert.NoError(t, s.segdb.Add(&segdb.Segment{ID: "versioned", Filters: `level == 2`}))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/versions?id=versioned", nil)
+	handleVersions(s).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+
+	versions := []map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&versions))
+	assert.Len(t, versions, 2)
+	assert.Equal(t, 2.0, versions[1]["version"])
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/diff?id=versioned&from=1&to=2", nil)
+	handleDiff(s).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, `[{"field":"filters","from":"level == 1","to":"level == 2"}]`+"\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/rollback?id=versioned&version=1", nil)
+	handleRollback(s).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+
+	segment, _ := s.segdb.Get("versioned")
+	assert.Equal(t, uint64(3), segment.Version)
+	assert.Equal(t, `level == 1`, segment.Filters)
+
+	for target, code := range map[string]int{
+		"/rollback?id=versioned&version=9": 404,
+		"/rollback?id=unknown&version=1":   404,
+		"/rollback?id=versioned":           400,
+	} {
+		rec = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodPost, target, nil)
+		handleRollback(s).ServeHTTP(rec, req)
+		assert.Equal(t, code, rec.Code, target)
+	}
+}
+
+func Test_handleAddPrecondition(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+
+	add := func(header string, value string, filters string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/add", strings.NewReader(`{"id": "guarded", "filters": "`+filters+`"}`))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		handleAdd(s).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := add("If-None-Match", "*", "true")
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, `"1"`, rec.Header().Get("ETag"))
+
+	assert.Equal(t, 412, add("If-None-Match", "*", "false").Code)
+	assert.Equal(t, 200, add("If-Match", `"1"`, "false").Code)
+	assert.Equal(t, 412, add("If-Match", `"1"`, "level == 1").Code)
+	assert.Equal(t, 400, add("If-Match", "latest", "level == 1").Code)
+
+	rec = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/get?id=guarded", nil)
+	handleGet(s).ServeHTTP(rec, req)
+	assert.Equal(t, `"2"`, rec.Header().Get("ETag"))
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodDelete, "/delete?id=guarded", nil)
+	req.Header.Set("If-Match", `W/"1"`)
+	handleDelete(s).ServeHTTP(rec, req)
+	assert.Equal(t, 412, rec.Code)
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodDelete, "/delete?id=guarded", nil)
+	req.Header.Set("If-Match", `"2"`)
+	handleDelete(s).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+}
+
+func Test_handleAddInvalid(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+
+	add := func(body string) int {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/add", strings.NewReader(body))
+		handleAdd(s).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// segments given by client are rejected as bad requests
+	assert.Equal(t, 400, add(`{"filters": "true"}`))
+	assert.Equal(t, 400, add(`{"id": "invalid", "filters": "true", "status": "live"}`))
+	assert.Equal(t, 400, add(`{"id": "invalid", "filters": "level >"}`))
+	assert.Equal(t, 400, add(`{"id": "invalid", "filters": "@unknown"}`))
+	assert.Equal(t, 400, add(`{"id": "invalid", "filters": "unknown(level)"}`))
+	assert.NoError(t, s.segdb.SetSchema(segdb.Schema{"level": {Type: "int"}}))
+	assert.Equal(t, 400, add(`{"id": "invalid", "filters": "level == \"1\""}`))
+
+	assert.Equal(t, 200, add(`{"id": "valid", "filters": "level == 1"}`))
+	assert.Equal(t, 409, add(`{"id": "valid", "filters": "level == 1", "status": "draft"}`))
+}
+
+func Test_handlePatch(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+
+	assert.NoError(t, s.segdb.Add(&segdb.Segment{ID: "patched", Filters: `true`, Indexes: segdb.Indexes{"country": "US"}}))
+
+	patch := func(body string, ifMatch string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPatch, "/patch", strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		handlePatch(s).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := patch(`{"id": "patched", "data": "new", "set_indexes": {"age": 30}, "remove_indexes": ["country"]}`, `"1"`)
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, `"2"`, rec.Header().Get("ETag"))
+
+	segment, _ := s.segdb.Get("patched")
+	assert.Equal(t, "new", segment.Data)
+	assert.Equal(t, `true`, segment.Filters)
+	assert.Equal(t, segdb.Indexes{"age": int64(30)}, segment.Indexes)
+
+	assert.Equal(t, 412, patch(`{"id": "patched", "data": "old"}`, `"1"`).Code)
+	assert.Equal(t, 404, patch(`{"id": "unknown", "data": "old"}`, "").Code)
+	assert.Equal(t, 400, patch(`{"id": "patched", "filters": "level >"}`, "").Code)
+}
+
+func Test_handleBatch(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+
+	assert.NoError(t, s.segdb.Add(&segdb.Segment{ID: "batch1", Filters: `true`}))
+	assert.NoError(t, s.segdb.Add(&segdb.Segment{ID: "batch3", Filters: `true`}))
+
+	batch := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+		handleBatch(s).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := batch(`{"upserts": [{"id": "batch2", "filters": "true"}, {"id": "batch1", "filters": "level >"}], "deletes": ["batch3", "batch4"]}`)
+	assert.Equal(t, 400, rec.Code)
+	assert.Contains(t, rec.Body.String(), `{"id":"batch2"}`)
+	assert.Contains(t, rec.Body.String(), `{"error":"not found","id":"batch4"}`)
+	_, err := s.segdb.Get("batch3")
+	assert.NoError(t, err)
+
+	rec = batch(`{"upserts": [{"id": "batch2", "filters": "true"}, {"id": "batch1", "filters": "false", "indexes": {"country": "US"}}], "deletes": ["batch3"]}`)
+	assert.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, `{"status": "OK", "results": [
+		{"id": "batch2", "status": "created", "version": 1},
+		{"id": "batch1", "status": "updated", "version": 2},
+		{"id": "batch3", "status": "deleted", "version": 1}
+	]}`, rec.Body.String())
+	_, err = s.segdb.Get("batch3")
+	assert.Equal(t, segdb.ErrNotFound, err)
+
+	assert.Equal(t, 400, batch(`{"upserts": {}}`).Code)
+}
+
+func Test_handleImportExport(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+
+	body := `{"id": "imported1", "filters": "true", "indexes": {"country": "US"}}` + "\n" +
+		`{"id": "imported2", "filters": "level > 1", "priority": 1}` + "\n"
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/import", strings.NewReader(body))
+	handleImport(s).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, `{"status": "OK", "imported": 2}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/export", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handleExport(s).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+
+	zr, err := gzip.NewReader(rec.Body)
+	assert.NoError(t, err)
+	exported, err := ioutil.ReadAll(zr)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(exported)), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"filters":"level > 1","priority":1,"version":1`)
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/import?replace=maybe", strings.NewReader(body))
+	handleImport(s).ServeHTTP(rec, req)
+	assert.Equal(t, 400, rec.Code)
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/import", strings.NewReader(`{"id": "imported3", "filters": "level >"}`))
+	handleImport(s).ServeHTTP(rec, req)
+	assert.Equal(t, 400, rec.Code)
+	assert.Equal(t, 2, s.segdb.GetSegmentsCount())
+}
+
+func Test_handleSweep(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	s.segdb.SetClock(func() time.Time { return now })
+	defer s.segdb.SetClock(time.Now)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/add", strings.NewReader(`{"id": "windowed", "filters": "true", "active_until": "2020-06-02T00:00:00Z"}`))
+	handleAdd(s).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+
+	patch := func(body string) {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPatch, "/patch", strings.NewReader(body))
+		handlePatch(s).ServeHTTP(rec, req)
+		assert.Equal(t, 200, rec.Code)
+	}
+
+	patch(`{"id": "windowed", "active_from": "2020-05-01T00:00:00Z"}`)
+	segment, _ := s.segdb.Get("windowed")
+	assert.Equal(t, now.AddDate(0, -1, 0), segment.ActiveFrom)
+
+	// null removes bound, missing field keeps it
+	patch(`{"id": "windowed", "active_from": null}`)
+	segment, _ = s.segdb.Get("windowed")
+	assert.Equal(t, now.AddDate(0, 0, 1), segment.ActiveUntil)
+	assert.Nil(t, (*segmentJSON(segment))["active_from"])
+
+	sweep := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/sweep", nil)
+		handleSweep(s).ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.JSONEq(t, `[]`, sweep().Body.String())
+
+	now = now.AddDate(0, 0, 2)
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/list?inactive=true", nil)
+	handleList(s).ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), `"windowed"`)
+
+	rec = sweep()
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"action":"expired","id":"windowed","version":3`)
+	_, err := s.segdb.Get("windowed")
+	assert.Equal(t, segdb.ErrNotFound, err)
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/audit", nil)
+	handleAudit(s).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"id":"windowed"`)
+}
+
+func Test_handleStatus(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/add", strings.NewReader(`{"id": "drafted", "filters": "true", "status": "draft"}`))
+	handleAdd(s).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+
+	list := func(query string) string {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/list?"+query, nil)
+		handleList(s).ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	assert.NotContains(t, list(""), `"drafted"`)
+	assert.Contains(t, list("status=draft,paused"), `"status":"draft"`)
+
+	status := func(body string, ifMatch string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/status", strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		handleStatus(s).ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, 409, status(`{"id": "drafted", "status": "paused"}`, "").Code)
+	assert.Equal(t, 400, status(`{"id": "drafted", "status": "live"}`, "").Code)
+	assert.Equal(t, 412, status(`{"id": "drafted", "status": "active"}`, `"2"`).Code)
+
+	rec = status(`{"id": "drafted", "status": "active"}`, `"1"`)
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, `"2"`, rec.Header().Get("ETag"))
+	assert.Contains(t, list(""), `"drafted"`)
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPatch, "/patch", strings.NewReader(`{"id": "drafted", "status": "paused"}`))
+	handlePatch(s).ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	assert.NotContains(t, list(""), `"drafted"`)
+}
+
+func Test_handleFragments(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+
+	fragment := func(body string, ifMatch string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPut, "/fragment", strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		handleSetFragment(s).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := fragment(`{"name": "adult", "expr": "age >= 18"}`, "")
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, `"1"`, rec.Header().Get("ETag"))
+	assert.Equal(t, 400, fragment(`{"name": "adult", "expr": "age >="}`, "").Code)
+	assert.Equal(t, 412, fragment(`{"name": "adult", "expr": "age >= 21"}`, `"2"`).Code)
+
+	assert.NoError(t, s.segdb.Add(&segdb.Segment{ID: "fragmented", Filters: `@adult`}))
+	assert.Equal(t, 200, fragment(`{"name": "adult", "expr": "age >= 21"}`, `"1"`).Code)
+	assert.Empty(t, s.segdb.Query(map[string]interface{}{"age": 18}, -1))
+
+	rec = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/fragments", nil)
+	handleGetFragments(s).ServeHTTP(rec, req)
+	fragments := []*segdb.Fragment{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&fragments))
+	assert.Len(t, fragments, 1)
+	assert.Equal(t, "age >= 21", fragments[0].Expr)
+	assert.Equal(t, uint64(2), fragments[0].Version)
+
+	remove := func() int {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodDelete, "/fragment?name=adult", nil)
+		handleDeleteFragment(s).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, 409, remove())
+	assert.NoError(t, s.segdb.Delete("fragmented"))
+	assert.Equal(t, 200, remove())
+	assert.Equal(t, 404, remove())
+
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/fragment?name=adult", nil)
+	handleGetFragment(s).ServeHTTP(rec, req)
+	assert.Equal(t, 404, rec.Code)
+}
+
+func Test_handleFunctions(t *testing.T) {
+	s, cleanup := getTestAPIServer(t)
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/functions", nil)
+	handleFunctions(s).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	functions := []segdb.Function{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&functions))
+	assert.Contains(t, functions, segdb.Function{
+		Name:      "ip_in_cidr",
+		Signature: "ip_in_cidr(string, string) bool",
+		Doc:       "Whether IP address is in CIDR range, e.g. ip_in_cidr(ip, \"10.0.0.0/8\")",
+		Builtin:   true,
+	})
+}
@@ -0,0 +1,203 @@
+package segdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrBatchRejected some items of batch are invalid, nothing has been applied
+var ErrBatchRejected = errors.New("batch rejected")
+
+const (
+	// ApplyCreated segment did not exist
+	ApplyCreated = "created"
+	// ApplyUpdated segment has been replaced
+	ApplyUpdated = "updated"
+	// ApplyUnchanged segment is the same as the stored one and is kept
+	ApplyUnchanged = "unchanged"
+	// ApplyDeleted segment has been deleted
+	ApplyDeleted = "deleted"
+)
+
+// ApplyResult of one upsert or delete of Apply
+type ApplyResult struct {
+	ID string
+	// Status of applied item, empty when the batch has been rejected
+	Status string
+	// Version of segment, of the deleted one for deletes
+	Version uint64
+	// Err why item is invalid
+	Err error
+}
+
+// Apply upserts and deletes segments in one step, other segments are left
+// as they are. The whole batch is compiled and validated first, if any item
+// is invalid nothing is applied and ErrBatchRejected is returned along with
+// results telling which items failed. Storages implementing BatchStorage,
+// as all storages of this package do, apply the batch atomically. Others get
+// changes one by one and those already made are reverted, as far as they can
+// be, when one fails. Results of upserts are followed by results of deletes.
+func (s *Segdb) Apply(upserts []*Segment, deletes []string) ([]ApplyResult, error) {
+	return s.apply(upserts, deletes, s.stamp)
+}
+
+// apply is Apply with upserts versioned by stamp
+func (s *Segdb) apply(upserts []*Segment, deletes []string, stamp stampFunc) ([]ApplyResult, error) {
+	results := make([]ApplyResult, len(upserts)+len(deletes))
+	failed := 0
+
+	fail := func(i int, err error) {
+		if err != nil && results[i].Err == nil {
+			results[i].Err = err
+			failed++
+		}
+	}
+
+	requested := make([]string, len(upserts))
+	seen := make(map[string]bool, len(results))
+	for i := range results {
+		if i < len(upserts) {
+			results[i].ID = upserts[i].ID
+			requested[i] = upserts[i].Status
+			fail(i, s.compile(upserts[i]))
+		} else {
+			results[i].ID = deletes[i-len(upserts)]
+		}
+
+		if seen[results[i].ID] == true {
+			fail(i, ErrDuplicateID)
+		}
+		seen[results[i].ID] = true
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.RLock()
+	current := make(map[string]*Segment, len(results))
+	for _, result := range results {
+		if old, ok := s.segments[result.ID]; ok == true {
+			current[result.ID] = old
+		}
+	}
+	s.mu.RUnlock()
+
+	// schema is changed by writers only
+	for i, segment := range upserts {
+		if results[i].Err == nil {
+			fail(i, s.checkFilters(segment))
+		}
+		if results[i].Err == nil {
+			fail(i, resolveStatus(segment, current[segment.ID], requested[i]))
+		}
+	}
+
+	for i, id := range deletes {
+		if _, ok := current[id]; ok == false {
+			fail(len(upserts)+i, ErrNotFound)
+		}
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%w: %d of %d items are invalid", ErrBatchRejected, failed, len(results))
+	}
+
+	// segments the same as stored ones are not written
+	changed := []*Segment{}
+	olds := []*Segment{}
+	now := s.now()
+
+	for i, segment := range upserts {
+		old := current[segment.ID]
+		if err := stamp(segment, old, now); err != nil {
+			return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+
+		results[i].Version = segment.Version
+		switch {
+		case old == nil:
+			results[i].Status = ApplyCreated
+		case replaced(old, segment) == false:
+			results[i].Status = ApplyUnchanged
+			continue
+		default:
+			results[i].Status = ApplyUpdated
+			olds = append(olds, old)
+		}
+
+		changed = append(changed, segment)
+	}
+
+	for i, id := range deletes {
+		old := current[id]
+		olds = append(olds, old)
+		results[len(upserts)+i].Status = ApplyDeleted
+		results[len(upserts)+i].Version = old.Version
+	}
+
+	if err := s.applyStorage(changed, deletes, current); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	for _, segment := range changed {
+		s.segments[segment.ID] = segment
+		s.reindex(current[segment.ID], segment)
+	}
+	for _, id := range deletes {
+		s.remove(id)
+		delete(s.segments, id)
+	}
+	s.mu.Unlock()
+
+	for _, segment := range changed {
+		s.errStats.reset(segment.ID)
+	}
+	for _, id := range deletes {
+		s.errStats.reset(id)
+	}
+
+	return results, s.keep(olds...)
+}
+
+// applyStorage writes batch to storage, current holds stored versions of
+// segments to revert to if storage is not able to apply batch at once
+func (s *Segdb) applyStorage(upserts []*Segment, deletes []string, current map[string]*Segment) error {
+	if storage, ok := s.storage.(BatchStorage); ok == true {
+		return storage.Apply(upserts, deletes)
+	}
+
+	saved := 0
+	deleted := 0
+
+	revert := func() {
+		for _, segment := range upserts[:saved] {
+			if old, ok := current[segment.ID]; ok == true {
+				s.storage.Save(old)
+			} else {
+				s.storage.Delete(segment.ID)
+			}
+		}
+		for _, id := range deletes[:deleted] {
+			s.storage.Save(current[id])
+		}
+	}
+
+	for _, segment := range upserts {
+		if err := s.storage.Save(segment); err != nil {
+			revert()
+			return fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+		saved++
+	}
+
+	for _, id := range deletes {
+		if err := s.storage.Delete(id); err != nil {
+			revert()
+			return fmt.Errorf("segment %q: %w", id, err)
+		}
+		deleted++
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package segdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingStorage fails to save segment with given id
+type failingStorage struct {
+	StorageInterface
+	id string
+}
+
+func (s *failingStorage) Save(segment *Segment) error {
+	if segment.ID == s.id {
+		return os.ErrPermission
+	}
+	return s.StorageInterface.Save(segment)
+}
+
+func TestSegdb_Apply(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Publish([]*Segment{
+		{ID: "seg1", Filters: "true", Indexes: Indexes{"country": "US"}},
+		{ID: "seg2", Filters: "true", Indexes: Indexes{"country": "US"}},
+		{ID: "seg3", Filters: "true"},
+	}))
+
+	results, err := s.Apply([]*Segment{
+		{ID: "seg1", Filters: "true", Indexes: Indexes{"country": "US"}},
+		{ID: "seg2", Filters: "false", Indexes: Indexes{"country": "CA"}},
+		{ID: "seg4", Filters: "true", Indexes: Indexes{"country": "US"}},
+	}, []string{"seg3"})
+	assert.NoError(t, err)
+	assert.Equal(t, []ApplyResult{
+		{ID: "seg1", Status: ApplyUnchanged, Version: 1},
+		{ID: "seg2", Status: ApplyUpdated, Version: 2},
+		{ID: "seg4", Status: ApplyCreated, Version: 1},
+		{ID: "seg3", Status: ApplyDeleted, Version: 1},
+	}, results)
+
+	assert.Equal(t, []string{"seg1", "seg4"}, segmentIDs(s.ListWhere(Eq("country", "US"), -1, -1)))
+	assert.Equal(t, []string{"seg2"}, segmentIDs(s.ListWhere(Eq("country", "CA"), -1, -1)))
+	_, err = s.Get("seg3")
+	assert.Equal(t, ErrNotFound, err)
+
+	loaded := getSegDb()
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, 3, loaded.GetSegmentsCount())
+	segment, _ := loaded.Get("seg2")
+	assert.Equal(t, "false", segment.Filters)
+}
+
+func TestSegdb_ApplyRejected(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true"}))
+
+	results, err := s.Apply([]*Segment{
+		{ID: "seg2", Filters: "true"},
+		{ID: "seg3", Filters: "level >"},
+		{ID: "seg2", Filters: "false"},
+	}, []string{"seg1", "seg4"})
+	assert.True(t, errors.Is(err, ErrBatchRejected))
+	assert.Len(t, results, 5)
+	assert.NoError(t, results[0].Err)
+	assert.Error(t, results[1].Err)
+	assert.Equal(t, ErrDuplicateID, results[2].Err)
+	assert.NoError(t, results[3].Err)
+	assert.Equal(t, ErrNotFound, results[4].Err)
+	assert.Equal(t, "", results[0].Status)
+
+	assert.Equal(t, []string{"seg1"}, segmentIDs(s.ListWhere(And(), -1, -1)))
+}
+
+func TestSegdb_ApplyRevert(t *testing.T) {
+	s := New(&failingStorage{StorageInterface: NewMultiFileStorage(storagePath), id: "seg3"})
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true"}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg2", Filters: "true"}))
+
+	_, err := s.Apply([]*Segment{
+		{ID: "seg1", Filters: "false"},
+		{ID: "seg4", Filters: "true"},
+		{ID: "seg3", Filters: "true"},
+	}, []string{"seg2"})
+	assert.True(t, errors.Is(err, os.ErrPermission))
+	assert.Equal(t, []string{"seg1", "seg2"}, segmentIDs(s.ListWhere(And(), -1, -1)))
+
+	loaded := getSegDb()
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, 2, loaded.GetSegmentsCount())
+	segment, _ := loaded.Get("seg1")
+	assert.Equal(t, "true", segment.Filters)
+}
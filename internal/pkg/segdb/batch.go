@@ -0,0 +1,78 @@
+package segdb
+
+import (
+	"runtime"
+	"sync"
+)
+
+// BatchOptions ...
+type BatchOptions struct {
+	// Where selects segments by index values for all contexts, nil selects all
+	Where IndexQuery
+	// Contexts are matched independently like QueryOptions.Context
+	Contexts []map[string]interface{}
+	Limit    int
+	Offset   int
+	Sort     string
+	// Workers number of contexts evaluated in parallel, GOMAXPROCS when less than 1
+	Workers int
+}
+
+// BatchResult of one context
+type BatchResult struct {
+	Segments []*Segment
+	Err      error
+}
+
+// FindBatch runs Find for every context. All contexts see the same
+// segments, contexts with the same index values share index lookups and
+// filters are evaluated in parallel by a pool of workers. Results are in
+// the order of contexts, a context failing does not affect others.
+func (s *Segdb) FindBatch(q *BatchOptions) ([]BatchResult, error) {
+	if err := checkSort(q.Sort); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(q.Contexts))
+	plans := make([]*queryPlan, len(q.Contexts))
+	cache := map[string][]uint64{}
+
+	s.mu.RLock()
+	for i, m := range q.Contexts {
+		plans[i], results[i].Err = s.planLocked(q.Where, m, cache)
+	}
+	s.mu.RUnlock()
+
+	workers := q.Workers
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(plans) {
+		workers = len(plans)
+	}
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				plans[i].sort(q.Sort)
+				results[i].Segments, results[i].Err = s.match(plans[i], q.Limit, q.Offset)
+			}
+		}()
+	}
+
+	for i, p := range plans {
+		if p != nil {
+			jobs <- i
+		}
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	return results, nil
+}
@@ -0,0 +1,65 @@
+package segdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegdb_FindBatch(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, s.Add(&Segment{
+			ID:      fmt.Sprintf("seg%02d", i),
+			Filters: fmt.Sprintf("level >= %d", i%5),
+			Indexes: Indexes{"country": []string{"US", "CA", "DE"}[i%3]},
+		}))
+	}
+
+	contexts := []map[string]interface{}{}
+	for i := 0; i < 50; i++ {
+		contexts = append(contexts, map[string]interface{}{
+			"level":   i % 6,
+			"country": []string{"US", "CA", "DE", "FR"}[i%4],
+		})
+	}
+	contexts = append(contexts, map[string]interface{}{"level": nil})
+
+	s.SetErrorPolicy(ErrorPolicyFail)
+
+	results, err := s.FindBatch(&BatchOptions{Contexts: contexts, Limit: 3, Offset: 1, Sort: SortID, Workers: 4})
+	assert.NoError(t, err)
+	assert.Len(t, results, len(contexts))
+
+	for i, m := range contexts {
+		segments, err := s.Find(&QueryOptions{Context: m, Limit: 3, Offset: 1, Sort: SortID})
+		assert.Equal(t, err, results[i].Err)
+		assert.Equal(t, segmentIDs(segments), segmentIDs(results[i].Segments), m)
+	}
+	assert.Error(t, results[len(contexts)-1].Err)
+
+	_, err = s.FindBatch(&BatchOptions{Contexts: contexts, Sort: "random"})
+	assert.True(t, errors.Is(err, ErrSortOrder))
+
+	results, err = s.FindBatch(&BatchOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestSegdb_FindBatchSchema(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: `level > 1`}))
+	assert.NoError(t, s.SetSchema(Schema{"level": {Type: "int"}}))
+
+	results, err := s.FindBatch(&BatchOptions{Contexts: []map[string]interface{}{{"level": 2}, {"age": 2}}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg1"}, segmentIDs(results[0].Segments))
+	assert.True(t, errors.Is(results[1].Err, ErrUnknownField))
+	assert.Nil(t, results[1].Segments)
+}
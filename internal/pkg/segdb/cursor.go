@@ -0,0 +1,295 @@
+package segdb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// ErrCursor cursor is malformed or belongs to another sort order
+	ErrCursor = errors.New("invalid cursor")
+	// ErrCursorExpired segments have been published or reloaded since
+	// cursor was issued, iteration has to start over
+	ErrCursorExpired = errors.New("cursor expired")
+)
+
+// Page of segments
+type Page struct {
+	Segments []*Segment
+	// Next is cursor of the next page, empty when there are no more segments
+	Next string
+}
+
+// cursor is position of the last segment of a page in its sort order.
+// Sequence numbers are only valid within one generation of indexes.
+type cursor struct {
+	Order      string `json:"o"`
+	Generation uint64 `json:"g"`
+	Seq        uint64 `json:"s,omitempty"`
+	Priority   int    `json:"p,omitempty"`
+	ID         string `json:"i,omitempty"`
+}
+
+// encode ...
+func (c *cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor decodes cursor of order, nil when s is empty
+func decodeCursor(s string, order string) (*cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrCursor
+	}
+
+	c := &cursor{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, ErrCursor
+	}
+
+	if c.Order != order {
+		return nil, fmt.Errorf("%w: issued for %s order", ErrCursor, c.Order)
+	}
+
+	return c, nil
+}
+
+// ranked segments along with their sequence numbers, sorting keeps both in sync
+type ranked struct {
+	segments []*Segment
+	seqs     []uint64
+	order    string
+}
+
+// Len ...
+func (r *ranked) Len() int {
+	return len(r.segments)
+}
+
+// Less ...
+func (r *ranked) Less(i, j int) bool {
+	if r.order == SortID {
+		return r.segments[i].ID < r.segments[j].ID
+	}
+	return r.segments[i].Priority > r.segments[j].Priority
+}
+
+// Swap ...
+func (r *ranked) Swap(i, j int) {
+	r.segments[i], r.segments[j] = r.segments[j], r.segments[i]
+	r.seqs[i], r.seqs[j] = r.seqs[j], r.seqs[i]
+}
+
+// sort orders segments given in SortInserted order
+func (r *ranked) sort() {
+	switch r.order {
+	case SortPriority:
+		// nothing to do unless priorities differ
+		for _, segment := range r.segments {
+			if segment.Priority != r.segments[0].Priority {
+				sort.Stable(r)
+				return
+			}
+		}
+	case SortID:
+		sort.Sort(r)
+	}
+}
+
+// after returns index of the first segment following cursor
+func (r *ranked) after(c *cursor) int {
+	return sort.Search(len(r.segments), func(i int) bool {
+		switch r.order {
+		case SortID:
+			return r.segments[i].ID > c.ID
+		case SortPriority:
+			if r.segments[i].Priority != c.Priority {
+				return r.segments[i].Priority < c.Priority
+			}
+		}
+		return r.seqs[i] > c.Seq
+	})
+}
+
+// cursor of i-th segment
+func (r *ranked) cursor(i int, generation uint64) string {
+	c := &cursor{Order: r.order, Generation: generation, Seq: r.seqs[i]}
+
+	switch r.order {
+	case SortID:
+		c.ID, c.Seq = r.segments[i].ID, 0
+	case SortPriority:
+		c.Priority = r.segments[i].Priority
+	}
+
+	return c.encode()
+}
+
+// FindPage is Find returning cursor of the next page. Given cursor it
+// continues right after the last segment of the previous page, so pages
+// do not shift when segments are added or deleted meanwhile. Cursors
+// expire once segments are published or reloaded. Results are ordered.
+func (s *Segdb) FindPage(q *QueryOptions) (*Page, error) {
+	ordered := *q
+	ordered.Unordered = false
+
+	p, segments, err := s.find(&ordered)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{Segments: segments}
+
+	// more segments may match
+	if q.Limit > 0 && len(segments) == q.Limit {
+		last := segments[len(segments)-1]
+		for i := len(p.candidates) - 1; i >= 0; i-- {
+			if p.candidates[i] == last {
+				page.Next = p.ranked(q.Sort).cursor(i, p.generation)
+				break
+			}
+		}
+	}
+
+	return page, nil
+}
+
+// ListPage is ListBy returning cursor of the next page, see FindPage
+func (s *Segdb) ListPage(q *ListOptions) (*Page, error) {
+	if err := checkSort(q.Sort); err != nil {
+		return nil, err
+	}
+
+	for _, status := range q.Status {
+		if _, err := checkStatus(status); err != nil {
+			return nil, err
+		}
+	}
+
+	order := q.Sort
+	if order == "" {
+		order = SortInserted
+	}
+
+	c, err := decodeCursor(q.Cursor, order)
+	if err != nil {
+		return nil, err
+	}
+
+	where := q.Where
+	if where == nil {
+		where = And()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if c != nil && c.Generation != s.generation {
+		return nil, ErrCursorExpired
+	}
+
+	seqs := s.live(where.eval(s.indexSet))
+
+	// inactive segments are skipped unless asked for
+	v := visibility{statuses: q.Status}
+	if len(v.statuses) == 0 {
+		v.statuses = []string{StatusActive}
+	}
+	if q.Inactive == false {
+		v.now = s.clock()
+	}
+
+	// insertion order needs segments of the page only
+	if order == SortInserted {
+		if c != nil {
+			seqs = seqs[sort.Search(len(seqs), func(i int) bool { return seqs[i] > c.Seq }):]
+		}
+
+		// one more to tell whether there is a next page
+		max := 0
+		if q.Limit > 0 {
+			max = q.Limit + 1
+			if q.Offset > 0 {
+				max += q.Offset
+			}
+		}
+
+		r := s.rank(seqs, order, v, max)
+		from, to := bounds(len(r.segments), q.Limit, q.Offset)
+
+		page := &Page{Segments: r.segments[from:to]}
+		if to < len(r.segments) && to > from {
+			page.Next = r.cursor(to-1, s.generation)
+		}
+		return page, nil
+	}
+
+	r := s.rank(seqs, order, v, 0)
+	r.sort()
+	if c != nil {
+		i := r.after(c)
+		r.segments, r.seqs = r.segments[i:], r.seqs[i:]
+	}
+
+	from, to := bounds(len(r.segments), q.Limit, q.Offset)
+	page := &Page{Segments: r.segments[from:to]}
+	if to < len(r.segments) && to > from {
+		page.Next = r.cursor(to-1, s.generation)
+	}
+
+	return page, nil
+}
+
+// rank resolves sequence numbers into at most max segments, unlimited when
+// max is less than 1. Segments not visible to v are skipped.
+func (s *Segdb) rank(seqs []uint64, order string, v visibility, max int) *ranked {
+	n := len(seqs)
+	if max > 0 && max < n {
+		n = max
+	}
+
+	r := &ranked{
+		segments: make([]*Segment, 0, n),
+		seqs:     make([]uint64, 0, n),
+		order:    order,
+	}
+
+	for _, seq := range seqs {
+		if max > 0 && len(r.segments) == max {
+			break
+		}
+
+		segment, ok := s.segments[s.ids[seq]]
+		if ok == false || v.visible(segment) == false {
+			continue
+		}
+
+		r.segments = append(r.segments, segment)
+		r.seqs = append(r.seqs, seq)
+	}
+
+	return r
+}
+
+// bounds of page of n items, unlimited when limit is less than 1
+func bounds(n int, limit int, offset int) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > n {
+		offset = n
+	}
+	if limit < 1 || limit > n-offset {
+		limit = n - offset
+	}
+
+	return offset, offset + limit
+}
@@ -0,0 +1,118 @@
+package segdb
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegdb_ListPage(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, s.Add(&Segment{ID: "seg" + strconv.Itoa(i), Filters: "true", Priority: i % 3}))
+	}
+
+	tests := []struct {
+		sort     string
+		expected []string
+	}{
+		{"", []string{"seg0", "seg1", "seg2", "seg3", "seg4", "seg5"}},
+		{SortID, []string{"seg0", "seg1", "seg2", "seg3", "seg4", "seg5"}},
+		{SortPriority, []string{"seg2", "seg5", "seg1", "seg4", "seg0", "seg3"}},
+	}
+
+	for _, tt := range tests {
+		ids := []string{}
+		q := &ListOptions{Limit: 4, Sort: tt.sort}
+		for {
+			page, err := s.ListPage(q)
+			assert.NoError(t, err)
+			ids = append(ids, segmentIDs(page.Segments)...)
+			if page.Next == "" {
+				break
+			}
+			q.Cursor = page.Next
+		}
+		assert.Equal(t, tt.expected, ids, tt.sort)
+	}
+
+	// pages do not shift when segments are added or deleted
+	page, err := s.ListPage(&ListOptions{Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg0", "seg1"}, segmentIDs(page.Segments))
+
+	assert.NoError(t, s.Delete("seg0"))
+	assert.NoError(t, s.Delete("seg2"))
+	assert.NoError(t, s.Add(&Segment{ID: "seg6", Filters: "true"}))
+
+	// nor when they are updated
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Data: "updated", Filters: "true"}))
+	_, err = s.Apply([]*Segment{{ID: "seg3", Data: "updated", Filters: "true"}}, nil)
+	assert.NoError(t, err)
+
+	page, err = s.ListPage(&ListOptions{Limit: 2, Cursor: page.Next})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg3", "seg4"}, segmentIDs(page.Segments))
+	last, err := s.ListPage(&ListOptions{Limit: 2, Cursor: page.Next})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg5", "seg6"}, segmentIDs(last.Segments))
+
+	_, err = s.ListPage(&ListOptions{Limit: 2, Cursor: page.Next, Sort: SortID})
+	assert.True(t, errors.Is(err, ErrCursor))
+	_, err = s.ListPage(&ListOptions{Cursor: "garbage"})
+	assert.True(t, errors.Is(err, ErrCursor))
+
+	// publishing renumbers segments
+	assert.NoError(t, s.Publish([]*Segment{{ID: "seg1", Filters: "true"}}))
+	_, err = s.ListPage(&ListOptions{Limit: 2, Cursor: page.Next})
+	assert.Equal(t, ErrCursorExpired, err)
+}
+
+func TestSegdb_FindPage(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, s.Add(&Segment{ID: "seg" + strconv.Itoa(i), Filters: "level > " + strconv.Itoa(i%2), Priority: i % 4}))
+	}
+
+	m := map[string]interface{}{"level": 1}
+
+	for _, order := range []string{"", SortInserted, SortID} {
+		expected, err := s.Find(&QueryOptions{Context: m, Sort: order})
+		assert.NoError(t, err)
+
+		ids := []string{}
+		q := &QueryOptions{Context: m, Limit: 2, Sort: order}
+		for {
+			page, err := s.FindPage(q)
+			assert.NoError(t, err)
+			ids = append(ids, segmentIDs(page.Segments)...)
+			if page.Next == "" {
+				break
+			}
+			q.Cursor = page.Next
+		}
+		assert.Equal(t, segmentIDs(expected), ids, order)
+	}
+
+	page, err := s.FindPage(&QueryOptions{Context: m, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg2", "seg6"}, segmentIDs(page.Segments))
+
+	// matching segment of the same priority added later comes after the cursor
+	assert.NoError(t, s.Add(&Segment{ID: "seg10", Filters: "true", Priority: 2}))
+	assert.NoError(t, s.Delete("seg4"))
+
+	page, err = s.FindPage(&QueryOptions{Context: m, Limit: 2, Cursor: page.Next})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg10", "seg0"}, segmentIDs(page.Segments))
+
+	assert.NoError(t, s.Load())
+	_, err = s.Find(&QueryOptions{Context: m, Cursor: page.Next})
+	assert.Equal(t, ErrCursorExpired, err)
+}
@@ -0,0 +1,222 @@
+package segdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrIndexQuery JSON index query is malformed
+var ErrIndexQuery = errors.New("invalid index query")
+
+// UnmarshalIndexQuery decodes index query from JSON object. Every key is
+// an index name, all of them are combined with And:
+//
+//	{"country": "US"}                index equals value
+//	{"country": ["US", "CA"]}        index equals any of values
+//	{"age": {"gte": 18, "lt": 30}}   operators eq, in, not, gt, gte, lt, lte
+//	{"$or": [{...}, {...}]}          any of queries, $and - all of them
+//	{"$not": {...}}                  query does not match
+//
+// Values are typed like index values in JSON.
+func UnmarshalIndexQuery(data []byte) (IndexQuery, error) {
+	var v interface{}
+	if err := decodeJSON(data, &v); err != nil {
+		return nil, err
+	}
+
+	return indexQueryOf(v)
+}
+
+// indexQueryOf ...
+func indexQueryOf(v interface{}) (IndexQuery, error) {
+	obj, ok := v.(map[string]interface{})
+	if ok == false {
+		return nil, fmt.Errorf("%w: object expected", ErrIndexQuery)
+	}
+
+	queries := make([]IndexQuery, 0, len(obj))
+
+	for key, value := range obj {
+		var q IndexQuery
+		var err error
+
+		switch key {
+		case "$and", "$or":
+			q, err = indexQueriesOf(key, value)
+		case "$not":
+			if q, err = indexQueryOf(value); err == nil {
+				q = Not(q)
+			}
+		default:
+			q, err = indexTermOf(key, value)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		queries = append(queries, q)
+	}
+
+	return And(queries...), nil
+}
+
+// indexQueriesOf ...
+func indexQueriesOf(op string, value interface{}) (IndexQuery, error) {
+	list, ok := value.([]interface{})
+	if ok == false {
+		return nil, fmt.Errorf("%w: %s expects a list", ErrIndexQuery, op)
+	}
+
+	queries := make([]IndexQuery, 0, len(list))
+	for _, item := range list {
+		q, err := indexQueryOf(item)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+
+	if op == "$or" {
+		return Or(queries...), nil
+	}
+
+	return And(queries...), nil
+}
+
+// indexTermOf ...
+func indexTermOf(name string, value interface{}) (IndexQuery, error) {
+	ops, ok := value.(map[string]interface{})
+	if _, isTime := ops[timeKey]; ok == false || isTime {
+		return indexValuesOf(name, value, In)
+	}
+
+	queries := make([]IndexQuery, 0, len(ops))
+
+	for op, v := range ops {
+		var q IndexQuery
+		var err error
+
+		switch op {
+		case "eq", "in":
+			q, err = indexValuesOf(name, v, In)
+		case "not":
+			q, err = indexValuesOf(name, v, In)
+			q = Not(q)
+		case "gt", "gte", "lt", "lte":
+			q, err = indexRangeOf(name, op, v)
+		default:
+			err = fmt.Errorf("%w: unknown operator %s of index %q", ErrIndexQuery, op, name)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		queries = append(queries, q)
+	}
+
+	return And(queries...), nil
+}
+
+// indexRangeOf ...
+func indexRangeOf(name string, op string, value interface{}) (IndexQuery, error) {
+	if _, ok := value.([]interface{}); ok == true {
+		return nil, fmt.Errorf("%w: %s of index %q expects a single value", ErrIndexQuery, op, name)
+	}
+
+	v, err := decodeIndexValue(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: index %q: %v", ErrIndexQuery, name, err)
+	}
+
+	switch op {
+	case "gt":
+		return Gt(name, v), nil
+	case "gte":
+		return Gte(name, v), nil
+	case "lt":
+		return Lt(name, v), nil
+	}
+
+	return Lte(name, v), nil
+}
+
+// indexValuesOf decodes value or list of values and builds query of them
+func indexValuesOf(name string, value interface{}, build func(string, ...interface{}) IndexQuery) (IndexQuery, error) {
+	v, err := decodeIndexValue(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: index %q: %v", ErrIndexQuery, name, err)
+	}
+
+	if list, ok := v.([]interface{}); ok == true {
+		if len(list) == 0 {
+			return nil, fmt.Errorf("%w: index %q: empty list", ErrIndexQuery, name)
+		}
+		return build(name, list...), nil
+	}
+
+	return build(name, v), nil
+}
+
+// UnmarshalContext decodes query context from JSON object keeping values
+// typed: integers are int64, other numbers float64, {"$time": "<RFC3339>"}
+// objects are times, nested objects and arrays are decoded the same way
+func UnmarshalContext(data []byte) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	if err := decodeJSON(data, &m); err != nil {
+		return nil, err
+	}
+
+	v, err := contextValue(m)
+	if err != nil {
+		return nil, err
+	}
+
+	m, _ = v.(map[string]interface{})
+
+	return m, nil
+}
+
+// contextValue ...
+func contextValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case []interface{}:
+		for i := range v {
+			item, err := contextValue(v[i])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = item
+		}
+	case map[string]interface{}:
+		if s, ok := v[timeKey].(string); ok == true && len(v) == 1 {
+			return time.Parse(time.RFC3339Nano, s)
+		}
+		for key := range v {
+			item, err := contextValue(v[key])
+			if err != nil {
+				return nil, err
+			}
+			v[key] = item
+		}
+	}
+
+	return value, nil
+}
+
+// decodeJSON decodes numbers as json.Number
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
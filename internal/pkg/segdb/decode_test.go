@@ -0,0 +1,105 @@
+package segdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmarshalIndexQuery(t *testing.T) {
+	s := getQuerySegDb(t)
+	defer clearStorage()
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{`{}`, []string{"seg1", "seg2", "seg3", "seg4"}},
+		{`{"country": "US"}`, []string{"seg1", "seg2"}},
+		{`{"country": ["CA", "DE"]}`, []string{"seg3", "seg4"}},
+		{`{"country": {"in": ["US", "CA"], "not": "CA"}, "platform": {"eq": "ios"}}`, []string{"seg1"}},
+		{`{"$or": [{"country": "DE"}, {"platform": "android"}]}`, []string{"seg2", "seg4"}},
+		{`{"$not": {"country": "US"}}`, []string{"seg3", "seg4"}},
+		{`{"$and": [{"country": {"gte": "D"}}, {"country": {"lt": "V"}}]}`, []string{"seg1", "seg2", "seg4"}},
+	}
+
+	for _, tt := range tests {
+		q, err := UnmarshalIndexQuery([]byte(tt.query))
+		assert.NoError(t, err, tt.query)
+		assert.Equal(t, tt.expected, segmentIDs(s.ListWhere(q, -1, -1)), tt.query)
+	}
+
+	for _, query := range []string{
+		`[]`,
+		`{"country": {"like": "U"}}`,
+		`{"country": {"gt": ["A", "B"]}}`,
+		`{"country": []}`,
+		`{"country": null}`,
+		`{"$or": {"country": "US"}}`,
+	} {
+		_, err := UnmarshalIndexQuery([]byte(query))
+		assert.True(t, errors.Is(err, ErrIndexQuery), query)
+	}
+
+	q, err := UnmarshalIndexQuery([]byte(`{"born": {"$time": "2020-01-01T02:00:00+02:00"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, And(Or(Eq("born", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))), q)
+}
+
+func TestUnmarshalContext(t *testing.T) {
+	m, err := UnmarshalContext([]byte(`{
+		"level": 1,
+		"score": 1.5,
+		"big": 9007199254740993,
+		"user": {"tags": ["a", 2], "born": {"$time": "2020-01-01T00:00:00Z"}},
+		"premium": true,
+		"name": null
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"level": int64(1),
+		"score": 1.5,
+		"big":   int64(9007199254740993),
+		"user": map[string]interface{}{
+			"tags": []interface{}{"a", int64(2)},
+			"born": time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		"premium": true,
+		"name":    nil,
+	}, m)
+
+	_, err = UnmarshalContext([]byte(`{"born": {"$time": "yesterday"}}`))
+	assert.Error(t, err)
+
+	_, err = UnmarshalContext([]byte(`[1]`))
+	assert.Error(t, err)
+}
+
+func TestSegdb_FindPaging(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	for _, id := range []string{"c", "a", "d", "b"} {
+		assert.NoError(t, s.Add(&Segment{ID: id, Filters: `level > 0`}))
+	}
+	assert.NoError(t, s.Add(&Segment{ID: "e", Filters: `level < 0`}))
+
+	m := map[string]interface{}{"level": 1}
+
+	segments, err := s.Find(&QueryOptions{Context: m, Offset: 1, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "d"}, segmentIDs(segments))
+
+	segments, err = s.Find(&QueryOptions{Context: m, Offset: 1, Sort: SortID})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "d"}, segmentIDs(segments))
+
+	segments, err = s.Find(&QueryOptions{Context: m, Offset: 5})
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+
+	_, err = s.Find(&QueryOptions{Context: m, Sort: "random"})
+	assert.True(t, errors.Is(err, ErrSortOrder))
+}
@@ -0,0 +1,105 @@
+package segdb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrorPolicy defines what Query does when filters of a segment fail to evaluate
+type ErrorPolicy int
+
+const (
+	// ErrorPolicyIgnore segment does not match
+	ErrorPolicyIgnore ErrorPolicy = iota
+	// ErrorPolicyCount segment does not match and the error is counted
+	ErrorPolicyCount
+	// ErrorPolicyFail the error is counted and query fails with it
+	ErrorPolicyFail
+)
+
+// ErrErrorPolicy unknown error policy
+var ErrErrorPolicy = errors.New("unknown error policy")
+
+var errorPolicyNames = map[string]ErrorPolicy{
+	"ignore": ErrorPolicyIgnore,
+	"count":  ErrorPolicyCount,
+	"fail":   ErrorPolicyFail,
+}
+
+// ParseErrorPolicy parses ignore, count or fail
+func ParseErrorPolicy(name string) (ErrorPolicy, error) {
+	policy, ok := errorPolicyNames[name]
+	if ok == false {
+		return ErrorPolicyIgnore, fmt.Errorf("%w: %s", ErrErrorPolicy, name)
+	}
+	return policy, nil
+}
+
+// FilterErrors counts of filter evaluation errors of a segment
+type FilterErrors struct {
+	ID        string `json:"id"`
+	Count     uint64 `json:"count"`
+	LastError string `json:"last_error"`
+}
+
+// errorStats ...
+//
+// errorStats counts filter evaluation errors by segment id. It is guarded
+// by its own mutex as errors are counted by readers after they released
+// the segments lock.
+type errorStats struct {
+	mu    sync.Mutex
+	stats map[string]*FilterErrors
+}
+
+// newErrorStats ...
+func newErrorStats() *errorStats {
+	return &errorStats{stats: make(map[string]*FilterErrors)}
+}
+
+// add ...
+func (e *errorStats) add(id string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	stat, ok := e.stats[id]
+	if ok == false {
+		stat = &FilterErrors{ID: id}
+		e.stats[id] = stat
+	}
+
+	stat.Count++
+	stat.LastError = err.Error()
+}
+
+// reset forgets errors of segments, all of them when no id is given
+func (e *errorStats) reset(ids ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(ids) == 0 {
+		e.stats = make(map[string]*FilterErrors)
+		return
+	}
+
+	for _, id := range ids {
+		delete(e.stats, id)
+	}
+}
+
+// list returns copies of counters sorted by segment id
+func (e *errorStats) list() []FilterErrors {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]FilterErrors, 0, len(e.stats))
+	for _, stat := range e.stats {
+		result = append(result, *stat)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+
+	return result
+}
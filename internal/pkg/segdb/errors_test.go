@@ -0,0 +1,61 @@
+package segdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseErrorPolicy(t *testing.T) {
+	policy, err := ParseErrorPolicy("fail")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrorPolicyFail, policy)
+
+	_, err = ParseErrorPolicy("panic")
+	assert.True(t, errors.Is(err, ErrErrorPolicy))
+}
+
+func TestSegdb_ErrorPolicy(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "ok", Filters: `true`}))
+	assert.NoError(t, s.Add(&Segment{ID: "mismatch", Filters: `level > "1"`}))
+
+	m := map[string]interface{}{"level": 2}
+
+	// ignore
+	assert.Equal(t, []string{"ok"}, segmentIDs(s.Query(m, -1)))
+	assert.Empty(t, s.FilterErrors())
+
+	// count
+	s.SetErrorPolicy(ErrorPolicyCount)
+	assert.Equal(t, []string{"ok"}, segmentIDs(s.Query(m, -1)))
+	segments, err := s.Find(&QueryOptions{Context: m})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ok"}, segmentIDs(segments))
+
+	stats := s.FilterErrors()
+	assert.Len(t, stats, 1)
+	assert.Equal(t, "mismatch", stats[0].ID)
+	assert.Equal(t, uint64(2), stats[0].Count)
+	assert.NotEmpty(t, stats[0].LastError)
+
+	// fail
+	s.SetErrorPolicy(ErrorPolicyFail)
+	segments, err = s.Find(&QueryOptions{Context: m})
+	assert.Error(t, err)
+	assert.Nil(t, segments)
+	assert.Empty(t, s.Query(m, -1))
+	assert.Equal(t, uint64(4), s.FilterErrors()[0].Count)
+
+	// limit reached before the failing segment
+	segments, err = s.Find(&QueryOptions{Context: m, Limit: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ok"}, segmentIDs(segments))
+
+	// fixed segment starts from scratch
+	assert.NoError(t, s.Add(&Segment{ID: "mismatch", Filters: `level > 1`}))
+	assert.Empty(t, s.FilterErrors())
+}
@@ -0,0 +1,123 @@
+package segdb
+
+import (
+	"errors"
+	"time"
+)
+
+// Plan names of the way candidate segments were selected
+const (
+	PlanFullScan       = "full_scan"
+	PlanIndex          = "index"
+	PlanPrefilter      = "prefilter"
+	PlanIndexPrefilter = "index+prefilter"
+	// PlanRejected input does not match schema
+	PlanRejected = "rejected"
+)
+
+// Explanation reports how query has been evaluated
+type Explanation struct {
+	Plan string `json:"plan"`
+	// Total number of segments
+	Total int `json:"total"`
+	// Indexed number of segments selected by index values
+	Indexed int `json:"indexed"`
+	// Candidates number of segments left after pre-filtering by filter conditions
+	Candidates int                  `json:"candidates"`
+	Evaluated  int                  `json:"evaluated"`
+	Matched    int                  `json:"matched"`
+	Duration   time.Duration        `json:"duration_ns"`
+	Segments   []SegmentExplanation `json:"segments"`
+	Error      string               `json:"error,omitempty"`
+}
+
+// SegmentExplanation reports evaluation of one candidate segment
+type SegmentExplanation struct {
+	ID       string        `json:"id"`
+	Matched  bool          `json:"matched"`
+	Reason   string        `json:"reason,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Reasons of segment not being matched
+const (
+	ReasonFalse   = "false"
+	ReasonNotBool = "not_bool"
+	ReasonError   = "error"
+)
+
+// Explain ...
+func (s *Segdb) Explain(m map[string]interface{}, limit int) *Explanation {
+	return s.ExplainWhere(nil, m, limit)
+}
+
+// ExplainWhere evaluates query like QueryWhere does and reports the plan,
+// candidate counts and the outcome of every evaluated segment
+func (s *Segdb) ExplainWhere(where IndexQuery, m map[string]interface{}, limit int) *Explanation {
+	started := time.Now()
+	p, err := s.plan(where, m)
+	if err != nil {
+		return &Explanation{Plan: PlanRejected, Error: err.Error(), Segments: []SegmentExplanation{}}
+	}
+
+	p.sort(SortPriority)
+
+	e := &Explanation{
+		Plan:       p.name(),
+		Total:      p.total,
+		Indexed:    p.indexed,
+		Candidates: len(p.candidates),
+		Segments:   []SegmentExplanation{},
+	}
+
+	// unlimited
+	if limit < 1 || limit > p.total {
+		limit = p.total
+	}
+
+	for _, segment := range p.candidates {
+		if e.Matched >= limit {
+			break
+		}
+
+		evaluated := time.Now()
+		matched, err := segment.eval(p.params)
+		se := SegmentExplanation{
+			ID:       segment.ID,
+			Matched:  matched,
+			Duration: time.Since(evaluated),
+		}
+
+		switch {
+		case errors.Is(err, ErrNotBool):
+			se.Reason, se.Error = ReasonNotBool, err.Error()
+		case err != nil:
+			se.Reason, se.Error = ReasonError, err.Error()
+		case matched == false:
+			se.Reason = ReasonFalse
+		default:
+			e.Matched++
+		}
+
+		e.Evaluated++
+		e.Segments = append(e.Segments, se)
+	}
+
+	e.Duration = time.Since(started)
+
+	return e
+}
+
+// name ...
+func (p *queryPlan) name() string {
+	switch {
+	case p.indexUsed && p.prefilter:
+		return PlanIndexPrefilter
+	case p.indexUsed:
+		return PlanIndex
+	case p.prefilter:
+		return PlanPrefilter
+	}
+	return PlanFullScan
+}
@@ -0,0 +1,61 @@
+package segdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegdb_Explain(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	for _, segment := range []*Segment{
+		{ID: "us", Filters: `country == "US" && age >= 18`, Indexes: Indexes{"platform": "ios"}},
+		{ID: "ca", Filters: `country == "CA"`, Indexes: Indexes{"platform": "ios"}},
+		{ID: "any", Filters: `age > 21`, Indexes: Indexes{"platform": "android"}},
+		{ID: "name", Filters: `name + "!"`, Indexes: Indexes{"platform": "ios"}},
+	} {
+		assert.NoError(t, s.Add(segment))
+	}
+
+	e := s.Explain(map[string]interface{}{"country": "US", "age": "18", "name": "x"}, -1)
+	assert.Equal(t, PlanPrefilter, e.Plan)
+	assert.Equal(t, 4, e.Total)
+	assert.Equal(t, 4, e.Indexed)
+	assert.Equal(t, 2, e.Candidates)
+	assert.Equal(t, 2, e.Evaluated)
+	assert.Equal(t, 0, e.Matched)
+	assert.Equal(t, "us", e.Segments[0].ID)
+	assert.Equal(t, ReasonError, e.Segments[0].Reason)
+	assert.NotEmpty(t, e.Segments[0].Error)
+	assert.Equal(t, "name", e.Segments[1].ID)
+	assert.Equal(t, ReasonNotBool, e.Segments[1].Reason)
+
+	e = s.Explain(map[string]interface{}{"platform": "ios", "country": "CA"}, -1)
+	assert.Equal(t, PlanIndexPrefilter, e.Plan)
+	assert.Equal(t, 3, e.Indexed)
+	assert.Equal(t, 2, e.Candidates)
+	assert.Equal(t, 1, e.Matched)
+	assert.Equal(t, SegmentExplanation{ID: "ca", Matched: true, Duration: e.Segments[0].Duration}, e.Segments[0])
+	assert.Equal(t, ReasonError, e.Segments[1].Reason)
+
+	e = s.ExplainWhere(Eq("platform", "android"), map[string]interface{}{"age": 22.5}, -1)
+	assert.Equal(t, PlanIndex, e.Plan)
+	assert.Equal(t, []SegmentExplanation{{ID: "any", Matched: true, Duration: e.Segments[0].Duration}}, e.Segments)
+
+	e = s.ExplainWhere(Eq("platform", "ios"), map[string]interface{}{"country": "US", "age": 10, "name": "x"}, -1)
+	assert.Equal(t, "us", e.Segments[0].ID)
+	assert.Equal(t, ReasonFalse, e.Segments[0].Reason)
+	assert.Empty(t, e.Segments[0].Error)
+
+	// limit stops evaluation like Query does
+	e = s.Explain(map[string]interface{}{"age": 30, "name": "x"}, 1)
+	assert.Equal(t, 2, e.Candidates)
+	assert.Equal(t, 1, e.Matched)
+	assert.Equal(t, 1, e.Evaluated)
+
+	e = s.Explain(map[string]interface{}{"country": []string{"US"}}, -1)
+	assert.Equal(t, PlanFullScan, e.Plan)
+	assert.Equal(t, 4, e.Evaluated)
+}
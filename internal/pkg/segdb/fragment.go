@@ -0,0 +1,414 @@
+package segdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antonmedv/expr"
+)
+
+// fragmentsMeta name of fragments metadata in storage
+const fragmentsMeta = "fragments"
+
+var (
+	// ErrFragmentName fragment name is not an identifier
+	ErrFragmentName = errors.New("invalid fragment name")
+	// ErrUnknownFragment filters refer to a fragment which does not exist
+	ErrUnknownFragment = errors.New("unknown fragment")
+	// ErrFragmentCycle fragment refers to itself, directly or not
+	ErrFragmentCycle = errors.New("fragment cycle")
+	// ErrFragmentInUse fragment is referred to by segments or other fragments
+	ErrFragmentInUse = errors.New("fragment in use")
+)
+
+// Fragment is a named sub-expression shared by filters. Filters and other
+// fragments refer to it as @name, the reference is replaced by the fragment
+// in parentheses when filters are compiled.
+type Fragment struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+	// Version grows with every change of fragment
+	Version   uint64    `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// fragmentSet is replaced as a whole whenever a fragment changes, so segments
+// can tell whether they have been compiled with the current fragments. Nil
+// set has no fragments.
+type fragmentSet struct {
+	fragments map[string]*Fragment
+}
+
+// get returns fragment by name, nil when there is none
+func (fs *fragmentSet) get(name string) *Fragment {
+	if fs == nil {
+		return nil
+	}
+	return fs.fragments[name]
+}
+
+// with returns copy of set with fragment added or replaced, nil fragment
+// named name is removed
+func (fs *fragmentSet) with(name string, fragment *Fragment) *fragmentSet {
+	next := &fragmentSet{fragments: map[string]*Fragment{}}
+	if fs != nil {
+		for n, f := range fs.fragments {
+			next.fragments[n] = f
+		}
+	}
+
+	if fragment == nil {
+		delete(next.fragments, name)
+	} else {
+		next.fragments[name] = fragment
+	}
+
+	return next
+}
+
+// list returns fragments sorted by name
+func (fs *fragmentSet) list() []*Fragment {
+	list := []*Fragment{}
+	if fs == nil {
+		return list
+	}
+
+	for _, f := range fs.fragments {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// expand replaces fragment references in filters, references inside string
+// literals and comments are left alone. It returns expanded source and names
+// of all fragments it depends on, including those referred to by fragments.
+func (fs *fragmentSet) expand(filters string) (string, []string, error) {
+	refs := map[string]bool{}
+	source, err := fs.expandRefs(filters, nil, refs)
+	if err != nil {
+		return "", nil, err
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return source, names, nil
+}
+
+// expandRefs expands filters of fragments on stack, collecting references
+func (fs *fragmentSet) expandRefs(filters string, stack []string, refs map[string]bool) (string, error) {
+	if strings.IndexByte(filters, '@') < 0 {
+		return filters, nil
+	}
+
+	b := strings.Builder{}
+	for i := 0; i < len(filters); {
+		j := skipLiteral(filters, i)
+		if j > i {
+			b.WriteString(filters[i:j])
+			i = j
+			continue
+		}
+
+		if filters[i] != '@' {
+			b.WriteByte(filters[i])
+			i++
+			continue
+		}
+
+		j = i + 1
+		for j < len(filters) && isNameByte(filters[j], j == i+1) {
+			j++
+		}
+		name := filters[i+1 : j]
+		if name == "" {
+			return "", fmt.Errorf("%w: @ at %d", ErrFragmentName, i)
+		}
+
+		for _, n := range stack {
+			if n == name {
+				return "", fmt.Errorf("%w: @%s", ErrFragmentCycle, strings.Join(append(stack, name), " -> @"))
+			}
+		}
+
+		fragment := fs.get(name)
+		if fragment == nil {
+			return "", fmt.Errorf("%w: @%s", ErrUnknownFragment, name)
+		}
+		refs[name] = true
+
+		expanded, err := fs.expandRefs(fragment.Expr, append(stack, name), refs)
+		if err != nil {
+			return "", err
+		}
+
+		// line break ends a trailing comment of fragment
+		b.WriteString("(" + expanded + "\n)")
+		i = j
+	}
+
+	return b.String(), nil
+}
+
+// skipLiteral returns end of string literal or comment starting at i, i when
+// there is none
+func skipLiteral(s string, i int) int {
+	switch {
+	case s[i] == '"' || s[i] == '\'':
+		for j := i + 1; j < len(s); j++ {
+			switch s[j] {
+			case '\\':
+				j++
+			case s[i]:
+				return j + 1
+			}
+		}
+		return len(s)
+	case strings.HasPrefix(s[i:], "//"):
+		if j := strings.IndexAny(s[i:], "\r\n"); j >= 0 {
+			return i + j
+		}
+		return len(s)
+	case strings.HasPrefix(s[i:], "/*"):
+		if j := strings.Index(s[i+2:], "*/"); j >= 0 {
+			return i + 2 + j + 2
+		}
+		return len(s)
+	}
+
+	return i
+}
+
+// isNameByte tells whether b may be a byte of fragment name
+func isNameByte(b byte, first bool) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || first == false && b >= '0' && b <= '9'
+}
+
+// validFragmentName ...
+func validFragmentName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if isNameByte(name[i], i == 0) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// refersTo tells whether segment depends on fragment
+func (s *Segment) refersTo(name string) bool {
+	for _, ref := range s.refs {
+		if ref == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Fragments returns all fragments sorted by name
+func (s *Segdb) Fragments() []*Fragment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.fragments.list()
+}
+
+// Fragment returns fragment by name
+func (s *Segdb) Fragment(name string) (*Fragment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fragment := s.fragments.get(name)
+	if fragment == nil {
+		return nil, ErrNotFound
+	}
+
+	return fragment, nil
+}
+
+// SetFragment adds or replaces fragment and stores fragments alongside
+// segments. Segments depending on the fragment are recompiled, if any of them
+// or of other fragments fail to compile or do not match schema nothing is
+// changed. Stored filters of segments are not changed, so neither are their
+// versions.
+func (s *Segdb) SetFragment(name string, expression string) (*Fragment, error) {
+	return s.setFragment(name, expression, nil)
+}
+
+// SetFragmentIf is SetFragment failing with ErrConflict unless fragment has
+// given version, version 0 expects no fragment with the same name
+func (s *Segdb) SetFragmentIf(name string, expression string, version uint64) (*Fragment, error) {
+	return s.setFragment(name, expression, &version)
+}
+
+func (s *Segdb) setFragment(name string, expression string, version *uint64) (*Fragment, error) {
+	if validFragmentName(name) == false {
+		return nil, fmt.Errorf("%w: %q", ErrFragmentName, name)
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.RLock()
+	current := s.fragments
+	s.mu.RUnlock()
+
+	old := current.get(name)
+	switch {
+	case version == nil:
+	case old == nil && *version != 0:
+		return nil, fmt.Errorf("%w: fragment does not exist, expected version %d", ErrConflict, *version)
+	case old != nil && old.Version != *version:
+		return nil, fmt.Errorf("%w: version is %d, expected %d", ErrConflict, old.Version, *version)
+	}
+
+	if old != nil && old.Expr == expression {
+		return old, nil
+	}
+
+	fragment := &Fragment{Name: name, Expr: expression, Version: 1, UpdatedAt: s.now()}
+	if old != nil {
+		fragment.Version = old.Version + 1
+	}
+
+	next := current.with(name, fragment)
+	if err := next.check(); err != nil {
+		return nil, err
+	}
+
+	if err := s.applyFragments(next, name); err != nil {
+		return nil, err
+	}
+
+	return fragment, nil
+}
+
+// DeleteFragment removes fragment unless segments or other fragments refer
+// to it. Prior versions of segments kept in history may still refer to it,
+// they can be listed and compared but not rolled back to.
+func (s *Segdb) DeleteFragment(name string) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.RLock()
+	current := s.fragments
+	users := []string{}
+	for _, segment := range s.getAll(s.order()) {
+		if segment.refersTo(name) {
+			users = append(users, segment.ID)
+		}
+	}
+	s.mu.RUnlock()
+
+	if current.get(name) == nil {
+		return ErrNotFound
+	}
+
+	for _, fragment := range current.list() {
+		if _, refs, err := current.expand("@" + fragment.Name); err == nil && fragment.Name != name {
+			if (&Segment{refs: refs}).refersTo(name) {
+				users = append(users, "@"+fragment.Name)
+			}
+		}
+	}
+
+	if len(users) > 0 {
+		return fmt.Errorf("%w: by %s", ErrFragmentInUse, strings.Join(users, ", "))
+	}
+
+	return s.applyFragments(current.with(name, nil), name)
+}
+
+// check expands and compiles every fragment
+func (fs *fragmentSet) check() error {
+	for _, fragment := range fs.list() {
+		source, _, err := fs.expand("@" + fragment.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := expr.Compile(source); err != nil {
+			return fmt.Errorf("fragment %q: %w", fragment.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// applyFragments recompiles segments depending on changed fragment, stores
+// fragments and swaps them in along with recompiled segments. Callers hold wmu.
+func (s *Segdb) applyFragments(next *fragmentSet, changed string) error {
+	s.mu.RLock()
+	dependents := []*Segment{}
+	for _, segment := range s.getAll(s.order()) {
+		if segment.refersTo(changed) {
+			dependents = append(dependents, segment)
+		}
+	}
+	s.mu.RUnlock()
+
+	recompiled := make([]*Segment, 0, len(dependents))
+	for _, old := range dependents {
+		segment := *old
+		if err := compile(&segment, next, s.functions); err != nil {
+			return fmt.Errorf("segment %q: %w", old.ID, err)
+		}
+		if err := s.checkSchema(&segment); err != nil {
+			return fmt.Errorf("segment %q: %w", old.ID, err)
+		}
+		recompiled = append(recompiled, &segment)
+	}
+
+	data, err := json.Marshal(next.list())
+	if err != nil {
+		return err
+	}
+
+	if err := s.storage.SaveMeta(fragmentsMeta, data); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.fragments = next
+	for i, segment := range recompiled {
+		s.segments[segment.ID] = segment
+		s.update(dependents[i], segment)
+	}
+	s.mu.Unlock()
+
+	for _, segment := range recompiled {
+		s.errStats.reset(segment.ID)
+	}
+
+	return nil
+}
+
+// loadFragments ...
+func (s *Segdb) loadFragments() (*fragmentSet, error) {
+	data, err := s.storage.LoadMeta(fragmentsMeta)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	list := []*Fragment{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	fs := &fragmentSet{fragments: make(map[string]*Fragment, len(list))}
+	for _, fragment := range list {
+		fs.fragments[fragment.Name] = fragment
+	}
+
+	return fs, nil
+}
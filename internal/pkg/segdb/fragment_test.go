@@ -0,0 +1,126 @@
+package segdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFragmentSet_Expand(t *testing.T) {
+	fs := (*fragmentSet)(nil).
+		with("eu", &Fragment{Name: "eu", Expr: `country in ["DE", "FR"] // EU`}).
+		with("premium", &Fragment{Name: "premium", Expr: `plan == "premium" && @eu`}).
+		with("loop", &Fragment{Name: "loop", Expr: `@loop2`}).
+		with("loop2", &Fragment{Name: "loop2", Expr: `!@loop`})
+
+	source, refs, err := fs.expand(`@premium and email != "a@eu" /* @eu */`)
+	assert.NoError(t, err)
+	assert.Equal(t, "(plan == \"premium\" && (country in [\"DE\", \"FR\"] // EU\n)\n) and email != \"a@eu\" /* @eu */", source)
+	assert.Equal(t, []string{"eu", "premium"}, refs)
+
+	source, refs, err = fs.expand(`level > 1`)
+	assert.NoError(t, err)
+	assert.Equal(t, `level > 1`, source)
+	assert.Empty(t, refs)
+
+	_, _, err = fs.expand(`@unknown`)
+	assert.True(t, errors.Is(err, ErrUnknownFragment))
+	_, _, err = fs.expand(`@loop`)
+	assert.EqualError(t, err, "fragment cycle: @loop -> @loop2 -> @loop")
+	_, _, err = fs.expand(`level > 1 @`)
+	assert.True(t, errors.Is(err, ErrFragmentName))
+}
+
+func TestSegdb_Fragments(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	_, err := s.SetFragment("1eu", "true")
+	assert.True(t, errors.Is(err, ErrFragmentName))
+	_, err = s.SetFragment("eu", "country in")
+	assert.Error(t, err)
+	assert.True(t, errors.Is(s.Add(&Segment{ID: "seg1", Filters: "@eu"}), ErrUnknownFragment))
+
+	eu, err := s.SetFragment("eu", `country in ["DE", "FR"]`)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), eu.Version)
+	_, err = s.SetFragment("premium", `plan == "premium"`)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: `@eu && @premium`}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg2", Filters: `@eu`}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg3", Filters: `level > 1`}))
+
+	de := map[string]interface{}{"country": "DE", "plan": "premium", "level": 2}
+	es := map[string]interface{}{"country": "ES", "plan": "premium", "level": 2}
+	assert.Equal(t, []string{"seg1", "seg2", "seg3"}, segmentIDs(s.Query(de, -1)))
+	assert.Equal(t, []string{"seg3"}, segmentIDs(s.Query(es, -1)))
+
+	// dependents are recompiled, their versions stay
+	eu, err = s.SetFragment("eu", `country in ["DE", "FR", "ES"]`)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), eu.Version)
+	assert.Equal(t, []string{"seg1", "seg2", "seg3"}, segmentIDs(s.Query(es, -1)))
+	segment, _ := s.Get("seg2")
+	assert.Equal(t, `@eu`, segment.Filters)
+	assert.Equal(t, uint64(1), segment.Version)
+
+	_, err = s.SetFragmentIf("eu", `country == "DE"`, 1)
+	assert.True(t, errors.Is(err, ErrConflict))
+	_, err = s.SetFragment("eu", `@premium && @eu`)
+	assert.True(t, errors.Is(err, ErrFragmentCycle))
+
+	// schema rejects recompiled dependents
+	assert.NoError(t, s.SetSchema(Schema{"country": {Type: "string"}, "plan": {Type: "string"}, "level": {Type: "int"}}))
+	_, err = s.SetFragment("eu", `country > 1`)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"seg1", "seg2", "seg3"}, segmentIDs(s.Query(es, -1)))
+
+	// patched filters are expanded too
+	filters := `@premium && level > 1`
+	_, err = s.Patch("seg3", &Patch{Filters: &filters})
+	assert.NoError(t, err)
+
+	assert.True(t, errors.Is(s.DeleteFragment("premium"), ErrFragmentInUse))
+	assert.Equal(t, ErrNotFound, s.DeleteFragment("unknown"))
+
+	_, err = s.SetFragment("france", `country == "FR"`)
+	assert.NoError(t, err)
+	assert.NoError(t, s.DeleteFragment("france"))
+	_, err = s.Fragment("france")
+	assert.Equal(t, ErrNotFound, err)
+
+	loaded := getSegDb()
+	assert.NoError(t, loaded.Load())
+	assert.Len(t, loaded.Fragments(), 2)
+	assert.ElementsMatch(t, []string{"seg1", "seg2", "seg3"}, segmentIDs(loaded.Query(es, -1)))
+	assert.Equal(t, []string{"seg2"}, segmentIDs(loaded.Query(map[string]interface{}{"country": "ES", "plan": "basic", "level": 2}, -1)))
+}
+
+func TestSegdb_DeleteFragmentHistory(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+	s.SetHistorySize(5)
+
+	_, err := s.SetFragment("adult", `age >= 18`)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: `@adult`}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: `age >= 21`}))
+	assert.NoError(t, s.DeleteFragment("adult"))
+
+	// prior version referring to deleted fragment is kept uncompiled
+	versions, err := s.History("seg1")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	_, err = versions[0].Eval(map[string]interface{}{"age": 20})
+	assert.Equal(t, ErrNotCompiled, err)
+	assert.True(t, versions[1].Match(map[string]interface{}{"age": 21}))
+
+	changes, err := s.Diff("seg1", 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{{Field: "filters", From: "@adult", To: "age >= 21"}}, changes)
+
+	_, err = s.Rollback("seg1", 1)
+	assert.True(t, errors.Is(err, ErrUnknownFragment))
+}
@@ -0,0 +1,339 @@
+package segdb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antonmedv/expr/ast"
+	"github.com/antonmedv/expr/parser"
+)
+
+var (
+	// ErrFunctionName function name is not an identifier or is reserved
+	ErrFunctionName = errors.New("invalid function name")
+	// ErrFunctionType function does not return a value, optionally with error
+	ErrFunctionType = errors.New("invalid function type")
+	// ErrUnknownFunction filters call a function which is not registered
+	ErrUnknownFunction = errors.New("unknown function")
+	// ErrFunctionArgs filters call a function with wrong number of arguments
+	ErrFunctionArgs = errors.New("wrong number of arguments")
+	// ErrFunctionShadowed function and schema field have the same name
+	ErrFunctionShadowed = errors.New("function shadowed by field")
+)
+
+// reservedNames are builtins and operators of filters language
+var reservedNames = map[string]bool{
+	"len": true, "all": true, "none": true, "any": true, "one": true, "filter": true, "map": true,
+	"not": true, "and": true, "or": true, "in": true, "matches": true, "contains": true,
+	"startsWith": true, "endsWith": true, "nil": true, "true": true, "false": true,
+}
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	timeType  = reflect.TypeOf(time.Time{})
+)
+
+// Function describes function filters may call
+type Function struct {
+	Name      string `json:"name"`
+	Signature string `json:"signature"`
+	Doc       string `json:"doc"`
+	// Builtin function is a part of the standard library
+	Builtin bool `json:"builtin"`
+}
+
+// function is registered function along with the wrapper filters call
+type function struct {
+	Function
+	fn   reflect.Value
+	call func(...interface{}) interface{}
+}
+
+// functionSet is replaced as a whole whenever a function is registered.
+// Nil set has no functions.
+type functionSet struct {
+	functions map[string]*function
+	// clock tells time to segments evaluating filters on their own,
+	// time.Now when it is nil
+	clock func() time.Time
+}
+
+// get returns function by name, nil when there is none
+func (fs *functionSet) get(name string) *function {
+	if fs == nil {
+		return nil
+	}
+	return fs.functions[name]
+}
+
+// with returns copy of set with function added or replaced
+func (fs *functionSet) with(f *function) *functionSet {
+	next := &functionSet{functions: map[string]*function{}}
+	if fs != nil {
+		next.clock = fs.clock
+		for name, existing := range fs.functions {
+			next.functions[name] = existing
+		}
+	}
+	next.functions[f.Name] = f
+
+	return next
+}
+
+// now returns time of clock
+func (fs *functionSet) now() time.Time {
+	if fs == nil || fs.clock == nil {
+		return time.Now()
+	}
+	return fs.clock()
+}
+
+// list returns descriptions of functions sorted by name
+func (fs *functionSet) list() []Function {
+	list := []Function{}
+	if fs == nil {
+		return list
+	}
+
+	for _, f := range fs.functions {
+		list = append(list, f.Function)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// env adds functions to params filters are run with. Params shadow functions
+// of the same name, as schema fields do when filters are type-checked, so
+// filters reading such params keep their meaning. now is returned by now().
+func (fs *functionSet) env(params map[string]interface{}, now time.Time) map[string]interface{} {
+	if fs == nil {
+		return params
+	}
+
+	for name, f := range fs.functions {
+		if _, ok := params[name]; ok == true {
+			continue
+		}
+
+		params[name] = f.call
+		// time of query is the same for all segments
+		if name == "now" && f.Builtin {
+			params[name] = func(...interface{}) interface{} { return now }
+		}
+	}
+
+	return params
+}
+
+// shadowed fails when schema declares a field named as a function
+func (fs *functionSet) shadowed(schema Schema) error {
+	for name := range schema {
+		if fs.get(name) != nil {
+			return fmt.Errorf("%w: %s", ErrFunctionShadowed, name)
+		}
+	}
+
+	return nil
+}
+
+// types returns functions of the same types for type-checking filters,
+// checker accepts functions returning a single value only, so error is
+// dropped
+func (fs *functionSet) types() map[string]interface{} {
+	types := map[string]interface{}{}
+	if fs == nil {
+		return types
+	}
+
+	for name, f := range fs.functions {
+		t := f.fn.Type()
+		if t.NumOut() == 1 {
+			types[name] = f.fn.Interface()
+			continue
+		}
+
+		in := make([]reflect.Type, t.NumIn())
+		for i := range in {
+			in[i] = t.In(i)
+		}
+		out := t.Out(0)
+		types[name] = reflect.MakeFunc(reflect.FuncOf(in, []reflect.Type{out}, t.IsVariadic()), func([]reflect.Value) []reflect.Value {
+			return []reflect.Value{reflect.Zero(out)}
+		}).Interface()
+	}
+
+	return types
+}
+
+// check fails when filters call unknown functions or pass them wrong number
+// of arguments, it returns number of calls
+func (fs *functionSet) check(source string) (int, error) {
+	tree, err := parser.Parse(source)
+	if err != nil {
+		return 0, err
+	}
+
+	v := &callVisitor{}
+	ast.Walk(&tree.Node, v)
+
+	for _, call := range v.calls {
+		f := fs.get(call.Name)
+		if f == nil {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownFunction, call.Name)
+		}
+
+		t, n := f.fn.Type(), len(call.Arguments)
+		if t.IsVariadic() && n < t.NumIn()-1 || t.IsVariadic() == false && n != t.NumIn() {
+			return 0, fmt.Errorf("%w: %s takes %d, got %d", ErrFunctionArgs, f.Signature, t.NumIn(), n)
+		}
+	}
+
+	return len(v.calls), nil
+}
+
+// callVisitor collects function calls
+type callVisitor struct {
+	calls []*ast.FunctionNode
+}
+
+func (v *callVisitor) Enter(node *ast.Node) {}
+
+func (v *callVisitor) Exit(node *ast.Node) {
+	if call, ok := (*node).(*ast.FunctionNode); ok == true {
+		v.calls = append(v.calls, call)
+	}
+}
+
+// newFunction validates fn and wraps it so filters can pass it arguments of
+// convertible types: numbers of any type to numeric parameters and RFC3339
+// strings to time.Time ones. Error returned by fn fails the filters.
+func newFunction(name string, fn interface{}, doc string) (*function, error) {
+	if validFragmentName(name) == false || reservedNames[name] {
+		return nil, fmt.Errorf("%w: %q", ErrFunctionName, name)
+	}
+
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil, fmt.Errorf("%w: %s is not a function", ErrFunctionType, name)
+	}
+
+	t := v.Type()
+	if t.NumOut() == 0 || t.NumOut() > 2 || t.NumOut() == 2 && t.Out(1) != errorType {
+		return nil, fmt.Errorf("%w: %s must return a value and optionally an error", ErrFunctionType, name)
+	}
+
+	f := &function{
+		Function: Function{Name: name, Signature: signature(name, t), Doc: doc},
+		fn:       v,
+	}
+
+	f.call = func(args ...interface{}) interface{} {
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var pt reflect.Type
+			if t.IsVariadic() && i >= t.NumIn()-1 {
+				pt = t.In(t.NumIn() - 1).Elem()
+			} else if i < t.NumIn() {
+				pt = t.In(i)
+			} else {
+				panic(fmt.Errorf("%w: %s", ErrFunctionArgs, f.Signature))
+			}
+
+			value, err := convertArg(arg, pt)
+			if err != nil {
+				panic(fmt.Errorf("%s: argument %d: %w", name, i+1, err))
+			}
+			in[i] = value
+		}
+
+		out := v.Call(in)
+		if len(out) == 2 && out[1].IsNil() == false {
+			panic(fmt.Errorf("%s: %w", name, out[1].Interface().(error)))
+		}
+
+		return out[0].Interface()
+	}
+
+	return f, nil
+}
+
+// convertArg converts argument to parameter type
+func convertArg(arg interface{}, t reflect.Type) (reflect.Value, error) {
+	if arg == nil {
+		return reflect.Zero(t), nil
+	}
+
+	v := reflect.ValueOf(arg)
+	switch {
+	case v.Type().AssignableTo(t):
+		return v, nil
+	case isNumber(v.Kind()) && isNumber(t.Kind()):
+		return v.Convert(t), nil
+	case v.Kind() == reflect.String && t == timeType:
+		parsed, err := time.Parse(time.RFC3339, v.String())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(parsed), nil
+	}
+
+	return reflect.Value{}, fmt.Errorf("%T is not %s", arg, t)
+}
+
+// isNumber ...
+func isNumber(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+// signature formats function type as name(int, string) bool
+func signature(name string, t reflect.Type) string {
+	in := make([]string, t.NumIn())
+	for i := range in {
+		in[i] = t.In(i).String()
+	}
+	if t.IsVariadic() {
+		in[len(in)-1] = "..." + t.In(len(in)-1).Elem().String()
+	}
+
+	return fmt.Sprintf("%s(%s) %s", name, strings.Join(in, ", "), t.Out(0))
+}
+
+// RegisterFunction makes fn callable by filters as name. Fn may take any
+// arguments and must return a value, optionally followed by an error which
+// fails the filters. Functions of the standard library may be replaced.
+// Function may not be named as a field of schema, input params shadow
+// functions of the same name. Filters compiled before a function is
+// registered are not recompiled, so functions are best registered before Load.
+func (s *Segdb) RegisterFunction(name string, fn interface{}, doc string) error {
+	f, err := newFunction(name, fn, doc)
+	if err != nil {
+		return err
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schema[name]; ok == true {
+		return fmt.Errorf("%w: %s", ErrFunctionShadowed, name)
+	}
+
+	s.functions = s.functions.with(f)
+
+	return nil
+}
+
+// Functions returns functions filters may call sorted by name
+func (s *Segdb) Functions() []Function {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.functions.list()
+}
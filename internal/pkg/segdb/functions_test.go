@@ -0,0 +1,151 @@
+package segdb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFunction(t *testing.T) {
+	_, err := newFunction("1up", strings.ToUpper, "")
+	assert.True(t, errors.Is(err, ErrFunctionName))
+	_, err = newFunction("len", strings.ToUpper, "")
+	assert.True(t, errors.Is(err, ErrFunctionName))
+	_, err = newFunction("up", "upper", "")
+	assert.True(t, errors.Is(err, ErrFunctionType))
+	_, err = newFunction("up", func(string) {}, "")
+	assert.True(t, errors.Is(err, ErrFunctionType))
+	_, err = newFunction("up", func(string) (string, string) { return "", "" }, "")
+	assert.True(t, errors.Is(err, ErrFunctionType))
+
+	f, err := newFunction("join", strings.Join, "Joins strings")
+	assert.NoError(t, err)
+	assert.Equal(t, "join([]string, string) string", f.Signature)
+
+	f, err = newFunction("sum", func(base float64, values ...int) float64 {
+		for _, v := range values {
+			base += float64(v)
+		}
+		return base
+	}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "sum(float64, ...int) float64", f.Signature)
+	assert.Equal(t, 6.5, f.call(1.5, 2, int64(3)))
+	assert.Equal(t, 0.0, f.call(nil))
+	assert.Panics(t, func() { f.call("1") })
+
+	f, err = newFunction("year", func(t time.Time) int { return t.Year() }, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2020, f.call("2020-06-01T00:00:00Z"))
+	assert.Panics(t, func() { f.call("yesterday") })
+}
+
+func TestFunctionSet_check(t *testing.T) {
+	fs := newStdlib()
+
+	calls, err := fs.check(`level > 1`)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, calls)
+
+	calls, err = fs.check(`regex_match("^a", name) && geo_distance(lat, lon, 52.52, 13.40) < 10`)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	_, err = fs.check(`unknown(name)`)
+	assert.True(t, errors.Is(err, ErrUnknownFunction))
+	_, err = fs.check(`regex_match("^a")`)
+	assert.True(t, errors.Is(err, ErrFunctionArgs))
+}
+
+func TestFunctionSet_env(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	env := newStdlib().env(map[string]interface{}{"unix": 1}, now)
+
+	// params shadow functions
+	assert.Equal(t, 1, env["unix"])
+	assert.Equal(t, now, env["now"].(func(...interface{}) interface{})())
+
+	// so do schema fields when filters are type-checked
+	assert.NoError(t, Schema{"unix": {Type: "int"}}.check(`unix > 1`, newStdlib()))
+	assert.Error(t, Schema{"unix": {Type: "int"}}.check(`unix(now()) > 1`, newStdlib()))
+
+	segment := &Segment{ID: "seg1", Filters: `unix > 1`}
+	assert.NoError(t, compile(segment, nil, newStdlib()))
+	matched, err := segment.eval(newStdlib().env(map[string]interface{}{"unix": 2}, now))
+	assert.NoError(t, err)
+	assert.True(t, matched)
+}
+
+func TestSegdb_Functions(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	s.SetClock(func() time.Time { return now })
+	s.SetErrorPolicy(ErrorPolicyCount)
+
+	assert.True(t, errors.Is(s.Add(&Segment{ID: "seg1", Filters: `upper(name) == "A"`}), ErrUnknownFunction))
+	assert.True(t, errors.Is(s.RegisterFunction("in", strings.ToUpper, ""), ErrFunctionName))
+
+	assert.NoError(t, s.RegisterFunction("upper", strings.ToUpper, "Upper case of string"))
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: `upper(name) == "A"`}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg2", Filters: `days_between(signed_up, now()) >= 30`}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg3", Filters: `level > 1`}))
+
+	assert.Equal(t, []string{"seg1", "seg2"}, segmentIDs(s.Query(map[string]interface{}{
+		"name": "a", "signed_up": "2020-05-01T00:00:00Z", "level": 1,
+	}, -1)))
+	assert.Equal(t, []string{"seg3"}, segmentIDs(s.Query(map[string]interface{}{
+		"name": "b", "signed_up": "2020-05-15T00:00:00Z", "level": 2,
+	}, -1)))
+
+	// errors returned by functions fail filters
+	assert.Empty(t, s.Query(map[string]interface{}{"name": "b", "signed_up": "May"}, -1))
+	stats := s.FilterErrors()
+	assert.Len(t, stats, 1)
+	assert.Equal(t, "seg2", stats[0].ID)
+
+	// segments evaluate functions on their own
+	segment, _ := s.Get("seg1")
+	matched, err := segment.Eval(map[string]interface{}{"name": "a"})
+	assert.NoError(t, err)
+	assert.True(t, matched)
+
+	// with clock of segdb
+	segment, _ = s.Get("seg2")
+	assert.False(t, segment.Match(map[string]interface{}{"signed_up": "2020-05-15T00:00:00Z"}))
+	s.SetClock(func() time.Time { return now.AddDate(0, 1, 0) })
+	assert.True(t, segment.Match(map[string]interface{}{"signed_up": "2020-05-15T00:00:00Z"}))
+	s.SetClock(func() time.Time { return now })
+
+	// patched segments keep functions
+	priority := 5
+	segment, err = s.Patch("seg1", &Patch{Priority: &priority})
+	assert.NoError(t, err)
+	assert.True(t, segment.Match(map[string]interface{}{"name": "a"}))
+
+	filters := `upper(name) == "B"`
+	segment, err = s.Patch("seg3", &Patch{Filters: &filters})
+	assert.NoError(t, err)
+	assert.True(t, segment.Match(map[string]interface{}{"name": "b"}))
+	filters = `level > 1`
+	_, err = s.Patch("seg3", &Patch{Filters: &filters})
+	assert.NoError(t, err)
+
+	// schema checks types of arguments
+	assert.Error(t, s.SetSchema(Schema{"name": {Type: "int"}, "signed_up": {Type: "time"}, "level": {Type: "int"}}))
+	assert.NoError(t, s.SetSchema(Schema{"name": {Type: "string"}, "signed_up": {Type: "time"}, "level": {Type: "int"}}))
+	assert.True(t, errors.Is(s.SetSchema(Schema{"now": {Type: "int"}}), ErrFunctionShadowed))
+	assert.True(t, errors.Is(s.RegisterFunction("level", strings.ToUpper, ""), ErrFunctionShadowed))
+
+	functions := s.Functions()
+	assert.Len(t, functions, len(stdlib)+1)
+	for _, f := range functions {
+		if f.Name == "upper" {
+			assert.Equal(t, Function{Name: "upper", Signature: "upper(string) string", Doc: "Upper case of string"}, f)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package segdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrVersionNotFound segment has no such version in history
+	ErrVersionNotFound = errors.New("version not found")
+	// ErrHistory change has been made but prior versions failed to be kept
+	ErrHistory = errors.New("history not kept")
+)
+
+// historyMeta name of metadata keeping prior versions of segment, id is
+// escaped so it can not refer to other paths
+func historyMeta(id string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c == '-' || c == '_' || isNameByte(c, false) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return "history/" + b.String()
+}
+
+// Change of segment field between two versions, From or To is nil
+// when index is missing in one of them
+type Change struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// SetHistorySize sets number of prior versions of every segment kept in
+// storage, changed, replaced and deleted versions are kept. No history
+// is kept by default.
+func (s *Segdb) SetHistorySize(n int) {
+	s.wmu.Lock()
+	s.historySize = n
+	s.wmu.Unlock()
+}
+
+// History returns prior versions of segment kept in storage followed by
+// the current version, if segment has not been deleted. Prior versions not
+// compiling anymore are returned uncompiled, they fail to be evaluated
+// with ErrNotCompiled and rolled back to.
+func (s *Segdb) History(id string) ([]*Segment, error) {
+	versions, err := s.loadHistory(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// fragments and functions prior versions refer to may be gone,
+	// such versions are returned uncompiled
+	for _, segment := range versions {
+		if err := s.compile(segment); err != nil {
+			segment.Program = nil
+		}
+	}
+
+	if current, err := s.Get(id); err == nil {
+		versions = append(versions, current)
+	}
+
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return versions, nil
+}
+
+// Version returns given version of segment
+func (s *Segdb) Version(id string, version uint64) (*Segment, error) {
+	versions, err := s.History(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, segment := range versions {
+		if segment.Version == version {
+			return segment, nil
+		}
+	}
+
+	return nil, ErrVersionNotFound
+}
+
+// Diff lists fields of segment changed between two versions
+func (s *Segdb) Diff(id string, from uint64, to uint64) ([]Change, error) {
+	a, err := s.Version(id, from)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := s.Version(id, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffSegments(a, b), nil
+}
+
+// Rollback adds content of given version of segment as its new version,
+// deleted segment is restored the same way. Status of existing segment is
+// kept, status changes go through SetStatus only.
+func (s *Segdb) Rollback(id string, version uint64) (*Segment, error) {
+	target, err := s.Version(id, version)
+	if err != nil {
+		return nil, err
+	}
+
+	segment := &Segment{
+		ID:          target.ID,
+		Data:        target.Data,
+		Filters:     target.Filters,
+		Indexes:     target.Indexes,
+		Priority:    target.Priority,
+		ActiveFrom:  target.ActiveFrom,
+		ActiveUntil: target.ActiveUntil,
+		Status:      target.Status,
+	}
+
+	if current, err := s.Get(id); err == nil {
+		segment.Status = current.Status
+	}
+
+	if err := s.Add(segment); err != nil {
+		return nil, err
+	}
+
+	return segment, nil
+}
+
+// diffSegments ...
+func diffSegments(a *Segment, b *Segment) []Change {
+	changes := []Change{}
+
+	if a.Data != b.Data {
+		changes = append(changes, Change{Field: "data", From: a.Data, To: b.Data})
+	}
+	if a.Filters != b.Filters {
+		changes = append(changes, Change{Field: "filters", From: a.Filters, To: b.Filters})
+	}
+	if a.Priority != b.Priority {
+		changes = append(changes, Change{Field: "priority", From: a.Priority, To: b.Priority})
+	}
+	if a.ActiveFrom.Equal(b.ActiveFrom) == false {
+		changes = append(changes, Change{Field: "active_from", From: timeOrNil(a.ActiveFrom), To: timeOrNil(b.ActiveFrom)})
+	}
+	if a.ActiveUntil.Equal(b.ActiveUntil) == false {
+		changes = append(changes, Change{Field: "active_until", From: timeOrNil(a.ActiveUntil), To: timeOrNil(b.ActiveUntil)})
+	}
+	if statusOf(a) != statusOf(b) {
+		changes = append(changes, Change{Field: "status", From: statusOf(a), To: statusOf(b)})
+	}
+
+	names := []string{}
+	for name := range a.Indexes {
+		names = append(names, name)
+	}
+	for name := range b.Indexes {
+		if _, ok := a.Indexes[name]; ok == false {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if reflect.DeepEqual(a.Indexes[name], b.Indexes[name]) == false {
+			changes = append(changes, Change{Field: "indexes." + name, From: a.Indexes[name], To: b.Indexes[name]})
+		}
+	}
+
+	return changes
+}
+
+// timeOrNil ...
+func timeOrNil(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// statusOf segment, versions kept before statuses were introduced have none
+func statusOf(segment *Segment) string {
+	if segment.Status == "" {
+		return StatusActive
+	}
+	return segment.Status
+}
+
+// sameContent reports whether segments differ in versioned fields only
+func sameContent(a *Segment, b *Segment) bool {
+	if a.Data != b.Data || a.Filters != b.Filters || a.Priority != b.Priority ||
+		a.ActiveFrom.Equal(b.ActiveFrom) == false || a.ActiveUntil.Equal(b.ActiveUntil) == false ||
+		statusOf(a) != statusOf(b) {
+		return false
+	}
+
+	return len(a.Indexes) == 0 && len(b.Indexes) == 0 || reflect.DeepEqual(a.Indexes, b.Indexes)
+}
+
+// stampFunc versions segment replacing old one, nil for a new segment
+type stampFunc func(segment *Segment, old *Segment, now time.Time) error
+
+// stamp sets version and timestamps of segment replacing old one, nil for
+// a new segment. Unchanged segment keeps version of the old one. Callers
+// hold wmu.
+func (s *Segdb) stamp(segment *Segment, old *Segment, now time.Time) error {
+	if old != nil && sameContent(segment, old) {
+		segment.Version, segment.CreatedAt, segment.UpdatedAt = old.Version, old.CreatedAt, old.UpdatedAt
+		return nil
+	}
+
+	segment.UpdatedAt = now
+
+	if old != nil {
+		segment.Version, segment.CreatedAt = old.Version+1, old.CreatedAt
+		return nil
+	}
+
+	segment.Version, segment.CreatedAt = 1, now
+
+	// versions of deleted segment go on
+	if s.historySize > 0 {
+		versions, err := s.loadHistory(segment.ID)
+		if err != nil {
+			return err
+		}
+		if n := len(versions); n > 0 {
+			segment.Version = versions[n-1].Version + 1
+		}
+	}
+
+	return nil
+}
+
+// stampImported keeps version and timestamps segment has been exported
+// with as long as versions go up, segment without version or with one not
+// above the stored or kept ones is stamped as any other change. Callers
+// hold wmu.
+func (s *Segdb) stampImported(segment *Segment, old *Segment, now time.Time) error {
+	if segment.Version == 0 {
+		return s.stamp(segment, old, now)
+	}
+
+	latest := uint64(0)
+	switch {
+	case old != nil:
+		latest = old.Version
+	case s.historySize > 0:
+		versions, err := s.loadHistory(segment.ID)
+		if err != nil {
+			return err
+		}
+		if n := len(versions); n > 0 {
+			latest = versions[n-1].Version
+		}
+	}
+
+	if segment.Version <= latest {
+		return s.stamp(segment, old, now)
+	}
+
+	if segment.CreatedAt.IsZero() {
+		segment.CreatedAt = now
+	}
+	if segment.UpdatedAt.IsZero() {
+		segment.UpdatedAt = segment.CreatedAt
+	}
+
+	return nil
+}
+
+// replaced reports whether segment stamped to replace old one differs from
+// it, so old one goes to history
+func replaced(old *Segment, segment *Segment) bool {
+	return old != nil && (old.Version != segment.Version || sameContent(segment, old) == false)
+}
+
+// keep archives replaced and deleted versions once storage has the change,
+// so changes failed to be stored leave no history behind. Callers hold wmu.
+func (s *Segdb) keep(olds ...*Segment) error {
+	var failed error
+
+	for _, old := range olds {
+		if err := s.archive(old); err != nil && failed == nil {
+			failed = fmt.Errorf("%w: segment %q: %v", ErrHistory, old.ID, err)
+		}
+	}
+
+	return failed
+}
+
+// archive keeps segment in history dropping the oldest versions over
+// history size. Callers hold wmu.
+func (s *Segdb) archive(segment *Segment) error {
+	if s.historySize < 1 {
+		return nil
+	}
+
+	versions, err := s.loadHistory(segment.ID)
+	if err != nil {
+		return err
+	}
+
+	versions = append(versions, &Segment{
+		ID:          segment.ID,
+		Data:        segment.Data,
+		Filters:     segment.Filters,
+		Indexes:     segment.Indexes,
+		Priority:    segment.Priority,
+		Version:     segment.Version,
+		CreatedAt:   segment.CreatedAt,
+		UpdatedAt:   segment.UpdatedAt,
+		ActiveFrom:  segment.ActiveFrom,
+		ActiveUntil: segment.ActiveUntil,
+		Status:      segment.Status,
+	})
+
+	if len(versions) > s.historySize {
+		versions = versions[len(versions)-s.historySize:]
+	}
+
+	data, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.SaveMeta(historyMeta(segment.ID), data)
+}
+
+// loadHistory returns prior versions of segment, oldest first
+func (s *Segdb) loadHistory(id string) ([]*Segment, error) {
+	data, err := s.storage.LoadMeta(historyMeta(id))
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	versions := []*Segment{}
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
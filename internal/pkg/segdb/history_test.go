@@ -0,0 +1,122 @@
+package segdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func versionsOf(segments []*Segment) []uint64 {
+	versions := []uint64{}
+	for _, segment := range segments {
+		versions = append(versions, segment.Version)
+	}
+	return versions
+}
+
+func TestSegdb_History(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	s.SetHistorySize(2)
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "level > 1"}))
+	created, _ := s.Get("seg1")
+	assert.Equal(t, uint64(1), created.Version)
+	assert.False(t, created.CreatedAt.IsZero())
+
+	// unchanged segment keeps its version
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "level > 1"}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "level > 2"}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "level > 2", Priority: 1}))
+
+	versions, err := s.History("seg1")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3}, versionsOf(versions))
+	assert.True(t, versions[0].Match(map[string]interface{}{"level": 2}))
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "level > 3", Indexes: Indexes{"country": "US"}}))
+	versions, _ = s.History("seg1")
+	assert.Equal(t, []uint64{2, 3, 4}, versionsOf(versions))
+	assert.Equal(t, created.CreatedAt.UnixNano(), versions[2].CreatedAt.UnixNano())
+	assert.True(t, versions[2].UpdatedAt.After(created.UpdatedAt))
+
+	_, err = s.Version("seg1", 1)
+	assert.Equal(t, ErrVersionNotFound, err)
+	_, err = s.History("seg2")
+	assert.Equal(t, ErrNotFound, err)
+
+	changes, err := s.Diff("seg1", 2, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Field: "filters", From: "level > 2", To: "level > 3"},
+		{Field: "indexes.country", From: nil, To: "US"},
+	}, changes)
+
+	segment, err := s.Rollback("seg1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), segment.Version)
+	assert.Equal(t, "level > 2", segment.Filters)
+	assert.Equal(t, []string{}, segmentIDs(s.ListWhere(Eq("country", "US"), -1, -1)))
+
+	// deleted segment is restored with the next version
+	assert.NoError(t, s.Delete("seg1"))
+	versions, _ = s.History("seg1")
+	assert.Equal(t, []uint64{4, 5}, versionsOf(versions))
+
+	segment, err = s.Rollback("seg1", 4)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), segment.Version)
+
+	// publishing archives removed and replaced segments
+	assert.NoError(t, s.Publish([]*Segment{{ID: "seg2", Filters: "true"}}))
+	assert.NoError(t, s.Publish([]*Segment{{ID: "seg1", Filters: "true"}, {ID: "seg2", Filters: "true"}}))
+	seg1, _ := s.Get("seg1")
+	seg2, _ := s.Get("seg2")
+	assert.Equal(t, uint64(7), seg1.Version)
+	assert.Equal(t, uint64(1), seg2.Version)
+
+	loaded := getSegDb()
+	assert.NoError(t, loaded.Load())
+	seg1, _ = loaded.Get("seg1")
+	assert.Equal(t, uint64(7), seg1.Version)
+	versions, _ = loaded.History("seg1")
+	assert.Equal(t, []uint64{5, 6, 7}, versionsOf(versions))
+}
+
+func TestSegdb_HistoryDisabled(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true"}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "false"}))
+
+	versions, err := s.History("seg1")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2}, versionsOf(versions))
+}
+
+func TestSegdb_HistoryAfterStorage(t *testing.T) {
+	storage := &failingStorage{StorageInterface: NewMultiFileStorage(storagePath)}
+	s := New(storage)
+	s.SetHistorySize(5)
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true"}))
+
+	// failed write keeps no history, so its retry archives once
+	storage.id = "seg1"
+	assert.Error(t, s.Add(&Segment{ID: "seg1", Filters: "false"}))
+	storage.id = ""
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "false"}))
+
+	versions, err := s.History("seg1")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, versionsOf(versions))
+}
+
+func TestHistoryMeta(t *testing.T) {
+	assert.Equal(t, "history/seg-1_A", historyMeta("seg-1_A"))
+	assert.Equal(t, "history/%2E%2E%2Fschema", historyMeta("../schema"))
+	assert.Equal(t, "history/a%20b%C3%A9", historyMeta("a bé"))
+}
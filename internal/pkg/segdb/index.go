@@ -0,0 +1,342 @@
+package segdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// timeKey marks time value in JSON form of indexes: {"$time": "2006-01-02T15:04:05Z"}
+	timeKey = "$time"
+
+	// maxExactFloat is the largest integer float64 holds without losing precision
+	maxExactFloat = 1 << 53
+)
+
+// ErrIndexValue unsupported index value
+var ErrIndexValue = errors.New("unsupported index value")
+
+// Indexes ...
+//
+// Index values are normalized to one of string, int64, float64, bool or
+// time.Time, so the same value matches no matter if it came from Go code,
+// JSON or a query string:
+//   - all signed and unsigned integers become int64
+//   - floats holding an integer value (up to 2^53) become int64, others float64
+//   - times are converted to UTC
+//
+// An index may also hold a list of values, normalized to []interface{}
+// without duplicates, and the segment is indexed under each of them.
+//
+// In JSON numbers are decoded without loss of precision and times are
+// written as {"$time": "<RFC3339>"} objects, as plain strings stay strings.
+type Indexes map[string]interface{}
+
+// NormalizeIndexValue converts value to its canonical index type
+func NormalizeIndexValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string, bool, int64:
+		return v, nil
+	case time.Time:
+		return v.UTC().Round(0), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrIndexValue, v)
+		}
+		return NormalizeIndexValue(f)
+	}
+
+	rv := reflect.ValueOf(value)
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%w: %d overflows int64", ErrIndexValue, rv.Uint())
+		}
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%w: %v", ErrIndexValue, f)
+		}
+		if f == math.Trunc(f) && math.Abs(f) <= maxExactFloat {
+			return int64(f), nil
+		}
+		return f, nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.String:
+		return rv.String(), nil
+	}
+
+	return nil, fmt.Errorf("%w: %T", ErrIndexValue, value)
+}
+
+// ParseIndexValue parses query string value into its canonical index type.
+// true and false are booleans, numbers are int64 or float64, RFC3339
+// timestamps are times, everything else is a string. A value wrapped in
+// double quotes is always a string, e.g. "01234".
+func ParseIndexValue(s string) interface{} {
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		return s[1 : len(s)-1]
+	}
+
+	if s == "true" || s == "false" {
+		return s == "true"
+	}
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if v, err := NormalizeIndexValue(f); err == nil {
+			return v
+		}
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC().Round(0)
+	}
+
+	return s
+}
+
+// Normalize returns copy of indexes with all values normalized
+func (i Indexes) Normalize() (Indexes, error) {
+	if i == nil {
+		return nil, nil
+	}
+
+	normalized := make(Indexes, len(i))
+	for name, value := range i {
+		v, err := normalizeIndexValues(value)
+		if err != nil {
+			return nil, fmt.Errorf("index %q: %w", name, err)
+		}
+		normalized[name] = v
+	}
+
+	return normalized, nil
+}
+
+// normalizeIndexValues normalizes single value or list of values
+func normalizeIndexValues(value interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return NormalizeIndexValue(value)
+	}
+
+	list := make([]interface{}, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		v, err := NormalizeIndexValue(rv.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if indexOf(list, v) < 0 {
+			list = append(list, v)
+		}
+	}
+
+	return list, nil
+}
+
+// indexValues returns values of single or multi-value index
+func indexValues(value interface{}) []interface{} {
+	if list, ok := value.([]interface{}); ok == true {
+		return list
+	}
+	return []interface{}{value}
+}
+
+// indexOf ...
+func indexOf(list []interface{}, value interface{}) int {
+	for i, v := range list {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexValueRank orders types of index values: bools, numbers, strings, times
+func indexValueRank(value interface{}) int {
+	switch value.(type) {
+	case bool:
+		return 0
+	case int64, float64:
+		return 1
+	case string:
+		return 2
+	case time.Time:
+		return 3
+	}
+	return 4
+}
+
+// compareIndexValues compares normalized index values, values of
+// different types are ordered by their type rank
+func compareIndexValues(a, b interface{}) int {
+	ra, rb := indexValueRank(a), indexValueRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+
+	switch x := a.(type) {
+	case bool:
+		y := b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case y:
+			return -1
+		}
+		return 1
+	case int64:
+		if y, ok := b.(int64); ok == true {
+			return compareInt64(x, y)
+		}
+		return compareFloat64(float64(x), b.(float64))
+	case float64:
+		if y, ok := b.(int64); ok == true {
+			return compareFloat64(x, float64(y))
+		}
+		return compareFloat64(x, b.(float64))
+	case string:
+		return strings.Compare(x, b.(string))
+	case time.Time:
+		y := b.(time.Time)
+		switch {
+		case x.Before(y):
+			return -1
+		case x.After(y):
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat64(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// MarshalJSON ...
+func (i Indexes) MarshalJSON() ([]byte, error) {
+	if i == nil {
+		return []byte("null"), nil
+	}
+
+	m := make(map[string]interface{}, len(i))
+	for name, value := range i {
+		if list, ok := value.([]interface{}); ok == true {
+			encoded := make([]interface{}, 0, len(list))
+			for _, v := range list {
+				encoded = append(encoded, encodeIndexValue(v))
+			}
+			m[name] = encoded
+			continue
+		}
+		m[name] = encodeIndexValue(value)
+	}
+
+	return json.Marshal(m)
+}
+
+// encodeIndexValue prepares value for JSON encoding
+func encodeIndexValue(value interface{}) interface{} {
+	if t, ok := value.(time.Time); ok == true {
+		return map[string]string{timeKey: t.Format(time.RFC3339Nano)}
+	}
+	return value
+}
+
+// UnmarshalJSON ...
+func (i *Indexes) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	m := map[string]interface{}{}
+	if err := decoder.Decode(&m); err != nil {
+		return err
+	}
+
+	if m == nil {
+		*i = nil
+		return nil
+	}
+
+	indexes := make(Indexes, len(m))
+	for name, value := range m {
+		v, err := decodeIndexValue(value)
+		if err != nil {
+			return fmt.Errorf("index %q: %w", name, err)
+		}
+		indexes[name] = v
+	}
+
+	*i = indexes
+
+	return nil
+}
+
+// decodeIndexValue normalizes value or list of values decoded from JSON
+func decodeIndexValue(value interface{}) (interface{}, error) {
+	if list, ok := value.([]interface{}); ok == true {
+		values := make([]interface{}, 0, len(list))
+		for _, v := range list {
+			if _, ok := v.([]interface{}); ok == true {
+				return nil, ErrIndexValue
+			}
+			decoded, err := decodeIndexValue(v)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, decoded)
+		}
+		return normalizeIndexValues(values)
+	}
+
+	if obj, ok := value.(map[string]interface{}); ok == true {
+		s, ok := obj[timeKey].(string)
+		if ok == false || len(obj) != 1 {
+			return nil, ErrIndexValue
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		return NormalizeIndexValue(t)
+	}
+
+	return NormalizeIndexValue(value)
+}
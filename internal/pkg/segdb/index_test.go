@@ -0,0 +1,117 @@
+package segdb
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeIndexValue(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("EET", 7200))
+
+	tests := []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{1, int64(1)},
+		{int8(-1), int64(-1)},
+		{uint32(7), int64(7)},
+		{float32(2), int64(2)},
+		{2.0, int64(2)},
+		{2.5, 2.5},
+		{1e20, 1e20},
+		{json.Number("12345678901234567"), int64(12345678901234567)},
+		{json.Number("1.25"), 1.25},
+		{true, true},
+		{"01234", "01234"},
+		{at, at.UTC()},
+	}
+
+	for _, tt := range tests {
+		v, err := NormalizeIndexValue(tt.value)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, v)
+	}
+
+	_, err := NormalizeIndexValue(nil)
+	assert.Error(t, err)
+	_, err = NormalizeIndexValue(uint64(1 << 63))
+	assert.Error(t, err)
+	_, err = NormalizeIndexValue([]int{1})
+	assert.Error(t, err)
+}
+
+func TestParseIndexValue(t *testing.T) {
+	assert.Equal(t, int64(1), ParseIndexValue("1"))
+	assert.Equal(t, int64(1), ParseIndexValue("1.0"))
+	assert.Equal(t, 0.1, ParseIndexValue("0.1"))
+	assert.Equal(t, true, ParseIndexValue("true"))
+	assert.Equal(t, "1", ParseIndexValue("\"1\""))
+	assert.Equal(t, "T", ParseIndexValue("T"))
+	assert.Equal(t, "str", ParseIndexValue("str"))
+	assert.Equal(t, time.Date(2020, 1, 2, 1, 4, 5, 0, time.UTC), ParseIndexValue("2020-01-02T03:04:05+02:00"))
+}
+
+func TestIndexes_JSON(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	indexes, err := Indexes{
+		"int":    1,
+		"big":    int64(12345678901234567),
+		"float":  1.5,
+		"bool":   false,
+		"string": "2020-01-02T03:04:05Z",
+		"time":   at,
+		"list":   []interface{}{"US", 1, at, "US"},
+	}.Normalize()
+	assert.NoError(t, err)
+
+	data, err := json.Marshal(indexes)
+	assert.NoError(t, err)
+
+	decoded := Indexes{}
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, indexes, decoded)
+	assert.Equal(t, []interface{}{"US", int64(1), at}, decoded["list"])
+
+	assert.Error(t, json.Unmarshal([]byte(`{"a": {"b": 1}}`), &decoded))
+	assert.Error(t, json.Unmarshal([]byte(`{"a": [[1]]}`), &decoded))
+}
+
+func TestIndexes_RoundTrip(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	segment := &Segment{
+		ID:      "seg1",
+		Filters: "true",
+		Indexes: Indexes{"int": 1, "float": 0.5, "time": at, "zip": "01234"},
+	}
+
+	for _, storage := range []StorageInterface{
+		NewMultiFileStorage(storagePath),
+		NewWALStorage(storagePath + "/wal"),
+		NewSnapshotStorage(storagePath + "/segments.snapshot"),
+	} {
+		s := New(storage)
+		assert.NoError(t, s.Add(segment))
+
+		s = New(storage)
+		assert.NoError(t, s.Load())
+
+		for name, value := range map[string]interface{}{
+			"int":   ParseIndexValue("1"),
+			"float": ParseIndexValue("0.5"),
+			"time":  ParseIndexValue("2020-01-02T03:04:05Z"),
+			"zip":   ParseIndexValue("\"01234\""),
+		} {
+			assert.Len(t, s.List(map[string]interface{}{name: value}, -1, -1), 1, name)
+		}
+		assert.Len(t, s.List(map[string]interface{}{"int": 1.0}, -1, -1), 1)
+		assert.Len(t, s.List(map[string]interface{}{"int": "1"}, -1, -1), 0)
+
+		os.RemoveAll(storagePath)
+	}
+}
@@ -0,0 +1,313 @@
+package segdb
+
+import (
+	"reflect"
+	"sort"
+)
+
+// indexSet ...
+//
+// indexSet holds value indexes of segments. Every indexed segment gets a
+// sequence number growing in the order segments have been added, posting
+// lists are sets of sequence numbers read sorted so they can be merged
+// efficiently. Distinct values of every index are kept ordered for range
+// lookups. Conditions derived from filters are indexed separately by filters.
+//
+// Index entries of every segment are kept by sequence number, so adding,
+// updating and removing a segment touches its own entries only. Removed
+// segments stay in the list of all segments until half of it is stale,
+// callers drop them with live.
+type indexSet struct {
+	indexes map[string]map[interface{}]*postingSet
+	values  map[string][]interface{}
+	entries map[uint64][]indexEntry
+	all     *postingList
+	seqs    map[string]uint64
+	ids     map[uint64]string
+	nextSeq uint64
+	filters *filterIndex
+}
+
+// postingList of all segments in the order they have been added
+type postingList struct {
+	seqs []uint64
+	// stale number of removed segments left in the list
+	stale int
+}
+
+// indexEntry value of index segment is listed under
+type indexEntry struct {
+	name  string
+	value interface{}
+}
+
+// newIndexSet ...
+func newIndexSet() *indexSet {
+	return &indexSet{
+		indexes: make(map[string]map[interface{}]*postingSet),
+		values:  make(map[string][]interface{}),
+		entries: make(map[uint64][]indexEntry),
+		all:     &postingList{seqs: []uint64{}},
+		seqs:    make(map[string]uint64),
+		ids:     make(map[uint64]string),
+		filters: newFilterIndex(),
+	}
+}
+
+// buildIndexes builds fresh indexes for segments preserving their order
+func buildIndexes(segments []*Segment) *indexSet {
+	x := newIndexSet()
+
+	for _, segment := range segments {
+		x.add(segment)
+	}
+
+	return x
+}
+
+// add indexes segment, segment already indexed keeps its position
+func (x *indexSet) add(segment *Segment) {
+	seq, ok := x.seqs[segment.ID]
+	if ok == false {
+		seq = x.nextSeq
+		x.nextSeq++
+
+		x.seqs[segment.ID] = seq
+		x.ids[seq] = segment.ID
+		x.all.seqs = append(x.all.seqs, seq)
+	} else {
+		x.filters.remove(seq)
+	}
+
+	x.filters.add(seq, segment.conditions)
+
+	entries := x.entries[seq]
+	for name, value := range segment.Indexes {
+		for _, v := range indexValues(value) {
+			if x.addPosting(name, v, seq) {
+				entries = append(entries, indexEntry{name: name, value: v})
+			}
+		}
+	}
+	x.entries[seq] = entries
+}
+
+// update reindexes segment replacing its old version, only indexes and
+// filter conditions that differ are touched
+func (x *indexSet) update(old *Segment, segment *Segment) {
+	seq, ok := x.seqs[segment.ID]
+	if ok == false {
+		x.add(segment)
+		return
+	}
+
+	if old.Filters != segment.Filters || old.source != segment.source {
+		x.filters.remove(seq)
+		x.filters.add(seq, segment.conditions)
+	}
+
+	changed := func(name string, a Indexes, b Indexes) bool {
+		v, ok := b[name]
+		return ok == false || reflect.DeepEqual(v, a[name]) == false
+	}
+
+	entries := []indexEntry{}
+	for _, e := range x.entries[seq] {
+		if changed(e.name, old.Indexes, segment.Indexes) {
+			x.removePosting(e.name, e.value, seq)
+		} else {
+			entries = append(entries, e)
+		}
+	}
+
+	for name, value := range segment.Indexes {
+		if changed(name, segment.Indexes, old.Indexes) {
+			for _, v := range indexValues(value) {
+				if x.addPosting(name, v, seq) {
+					entries = append(entries, indexEntry{name: name, value: v})
+				}
+			}
+		}
+	}
+
+	x.entries[seq] = entries
+}
+
+// addPosting adds sequence number to posting list of index value,
+// false when it is already there
+func (x *indexSet) addPosting(name string, value interface{}, seq uint64) bool {
+	if _, ok := x.indexes[name]; ok == false {
+		x.indexes[name] = make(map[interface{}]*postingSet)
+	}
+
+	list, ok := x.indexes[name][value]
+	if ok == false {
+		list = &postingSet{}
+		x.indexes[name][value] = list
+		x.insertValue(name, value)
+	}
+
+	return list.add(seq)
+}
+
+// removePosting removes sequence number from posting list of index value,
+// list left empty is dropped along with the value
+func (x *indexSet) removePosting(name string, value interface{}, seq uint64) {
+	list, ok := x.indexes[name][value]
+	if ok == false {
+		return
+	}
+
+	list.remove(seq)
+	if list.len() > 0 {
+		return
+	}
+
+	values := x.indexes[name]
+	delete(values, value)
+	x.deleteValue(name, value)
+
+	if len(values) == 0 {
+		delete(x.indexes, name)
+	}
+}
+
+// insertValue adds value to ordered values of index
+func (x *indexSet) insertValue(name string, value interface{}) {
+	values := x.values[name]
+	i := sort.Search(len(values), func(i int) bool { return compareIndexValues(values[i], value) >= 0 })
+
+	values = append(values, nil)
+	copy(values[i+1:], values[i:])
+	values[i] = value
+
+	x.values[name] = values
+}
+
+// deleteValue removes value from ordered values of index
+func (x *indexSet) deleteValue(name string, value interface{}) {
+	values := x.values[name]
+	i := sort.Search(len(values), func(i int) bool { return compareIndexValues(values[i], value) >= 0 })
+
+	if i < len(values) && values[i] == value {
+		values = append(values[:i], values[i+1:]...)
+	}
+
+	if len(values) == 0 {
+		delete(x.values, name)
+		return
+	}
+
+	x.values[name] = values
+}
+
+// remove ...
+//
+// remove unindexes segment, it is left in the list of all segments as stale
+func (x *indexSet) remove(id string) {
+	seq, ok := x.seqs[id]
+	if ok == false {
+		return
+	}
+
+	delete(x.seqs, id)
+	delete(x.ids, seq)
+	x.filters.remove(seq)
+
+	for _, e := range x.entries[seq] {
+		x.removePosting(e.name, e.value, seq)
+	}
+	delete(x.entries, seq)
+
+	x.all.stale++
+	if x.all.stale*2 > len(x.all.seqs) {
+		x.all.seqs = x.live(x.all.seqs)
+		x.all.stale = 0
+	}
+}
+
+// live drops removed segments from posting list
+func (x *indexSet) live(seqs []uint64) []uint64 {
+	if x.all.stale == 0 {
+		return seqs
+	}
+
+	result := make([]uint64, 0, len(seqs))
+	for _, seq := range seqs {
+		if _, ok := x.ids[seq]; ok == true {
+			result = append(result, seq)
+		}
+	}
+
+	return result
+}
+
+// order returns ids of indexed segments in the order they have been added
+func (x *indexSet) order() []string {
+	return x.resolve(x.all.seqs)
+}
+
+// lookup returns posting list of index value
+func (x *indexSet) lookup(name string, value interface{}) []uint64 {
+	value, err := NormalizeIndexValue(value)
+	if err != nil {
+		return nil
+	}
+
+	return x.indexes[name][value].seqs()
+}
+
+// scan returns segments having index values within range
+func (x *indexSet) scan(q rangeQuery) []uint64 {
+	name, lower, upper := q.name, q.lower, q.upper
+	values := x.values[name]
+
+	from, to := 0, len(values)
+
+	if lower != nil {
+		from = sort.Search(len(values), func(i int) bool { return lower.passLower(values[i]) })
+	}
+
+	if upper != nil {
+		to = sort.Search(len(values), func(i int) bool { return upper.passUpper(values[i]) == false })
+	}
+
+	if from >= to {
+		return []uint64{}
+	}
+
+	// values of other types may fall into open ended range
+	rank := q.rank()
+
+	result := []uint64{}
+	for _, v := range values[from:to] {
+		if indexValueRank(v) != rank {
+			continue
+		}
+		result = append(result, x.indexes[name][v].seqs()...)
+	}
+
+	// multi-value indexes list the same segment under several values
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	unique := result[:0]
+	for _, seq := range result {
+		if len(unique) == 0 || seq != unique[len(unique)-1] {
+			unique = append(unique, seq)
+		}
+	}
+
+	return unique
+}
+
+// resolve maps sequence numbers to ids of segments, removed ones are skipped
+func (x *indexSet) resolve(seqs []uint64) []string {
+	ids := make([]string, 0, len(seqs))
+
+	for _, seq := range seqs {
+		if id, ok := x.ids[seq]; ok == true {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
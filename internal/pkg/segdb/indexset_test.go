@@ -0,0 +1,141 @@
+package segdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexSet_Remove(t *testing.T) {
+	segments := []*Segment{}
+	for i := 0; i < 10; i++ {
+		segments = append(segments, &Segment{
+			ID:      fmt.Sprintf("seg%d", i),
+			Indexes: Indexes{"country": []interface{}{"US", fmt.Sprintf("c%d", i%2)}, "age": int64(i)},
+		})
+	}
+
+	x := buildIndexes(segments)
+
+	for _, id := range []string{"seg0", "seg2", "seg4"} {
+		x.remove(id)
+	}
+
+	// removed segments are dropped from posting lists
+	assert.Equal(t, []uint64{1, 3, 5, 6, 7, 8, 9}, x.lookup("country", "US"))
+	assert.Equal(t, []string{"seg1", "seg3", "seg5", "seg6", "seg7", "seg8", "seg9"}, x.order())
+	assert.Equal(t, []uint64{6, 8}, x.lookup("country", "c0"))
+	assert.Nil(t, x.lookup("age", int64(2)))
+	assert.Equal(t, []interface{}{int64(1), int64(3), int64(5), int64(6), int64(7), int64(8), int64(9)}, x.values["age"])
+	// and left in the list of all segments until they make half of it
+	assert.Equal(t, 3, x.all.stale)
+	assert.Len(t, x.all.seqs, 10)
+
+	x.remove("seg6")
+	x.remove("seg8")
+	assert.Nil(t, x.lookup("country", "c0"))
+	assert.Equal(t, []interface{}{"US", "c1"}, x.values["country"])
+	assert.Equal(t, []uint64{1, 3, 5, 7, 9}, x.live(x.all.seqs))
+
+	x.remove("seg1")
+	assert.Equal(t, []uint64{3, 5, 7, 9}, x.lookup("country", "US"))
+	assert.Equal(t, []uint64{3, 5, 7, 9}, x.all.seqs)
+
+	for _, id := range []string{"seg3", "seg5", "seg7", "seg9"} {
+		x.remove(id)
+	}
+	assert.Empty(t, x.indexes)
+	assert.Empty(t, x.values)
+	assert.Empty(t, x.entries)
+	assert.Empty(t, x.live(x.all.seqs))
+}
+
+func TestIndexSet_Update(t *testing.T) {
+	old := &Segment{ID: "seg1", Indexes: Indexes{"country": "US", "platform": []interface{}{"ios", "web"}}}
+	x := buildIndexes([]*Segment{{ID: "seg0", Indexes: Indexes{"country": "US"}}, old})
+
+	segment := &Segment{ID: "seg1", Indexes: Indexes{"platform": []interface{}{"web", "android"}, "age": int64(30)}}
+	x.update(old, segment)
+
+	assert.Equal(t, []uint64{0}, x.lookup("country", "US"))
+	assert.Nil(t, x.lookup("platform", "ios"))
+	assert.Equal(t, []uint64{1}, x.lookup("platform", "android"))
+	assert.Equal(t, []uint64{1}, x.lookup("age", int64(30)))
+	assert.ElementsMatch(t, []indexEntry{{"platform", "web"}, {"platform", "android"}, {"age", int64(30)}}, x.entries[1])
+
+	x.remove("seg1")
+	assert.Nil(t, x.lookup("platform", "web"))
+	assert.Nil(t, x.lookup("age", int64(30)))
+	assert.Equal(t, []uint64{0}, x.lookup("country", "US"))
+}
+
+// benchIndexSet indexes n segments with a few low cardinality indexes
+func benchIndexSet(n int) (*indexSet, []*Segment) {
+	segments := make([]*Segment, n)
+	for i := range segments {
+		segments[i] = benchSegment(i)
+	}
+
+	return buildIndexes(segments), segments
+}
+
+func benchSegment(i int) *Segment {
+	platforms := []string{"ios", "android", "web", "tv"}
+
+	indexes, _ := Indexes{
+		"country":  fmt.Sprintf("c%d", i%50),
+		"platform": []string{platforms[i%4], platforms[(i+1)%4]},
+		"age":      i % 80,
+	}.Normalize()
+
+	return &Segment{ID: fmt.Sprintf("seg%07d", i), Indexes: indexes}
+}
+
+func BenchmarkIndexSet_Add(b *testing.B) {
+	x, segments := benchIndexSet(1000000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.add(benchSegment(len(segments) + i))
+	}
+}
+
+func BenchmarkIndexSet_Replace(b *testing.B) {
+	x, segments := benchIndexSet(1000000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		segment := segments[i%len(segments)]
+		x.remove(segment.ID)
+		x.add(segment)
+	}
+}
+
+func BenchmarkIndexSet_Update(b *testing.B) {
+	x, segments := benchIndexSet(1000000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		old := segments[i%len(segments)]
+		segment := &Segment{ID: old.ID, Indexes: Indexes{"country": "c0", "platform": old.Indexes["platform"], "age": old.Indexes["age"]}}
+		x.update(old, segment)
+		segments[i%len(segments)] = segment
+	}
+}
+
+// BenchmarkIndexSet_UpdateLongList moves segments between posting lists
+// of half a million segments each
+func BenchmarkIndexSet_UpdateLongList(b *testing.B) {
+	x, segments := benchIndexSet(1000000)
+	platforms := []string{"ios", "android", "web", "tv"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		old := segments[i%len(segments)]
+		indexes, _ := Indexes{"country": old.Indexes["country"], "platform": platforms[i%4], "age": old.Indexes["age"]}.Normalize()
+		segment := &Segment{ID: old.ID, Indexes: indexes}
+		x.update(old, segment)
+		segments[i%len(segments)] = segment
+	}
+}
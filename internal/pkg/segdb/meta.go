@@ -0,0 +1,75 @@
+package segdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Metadata is kept by storages next to segments under a name, like the
+// input schema. metaNames lists all names, so Convert can copy them.
+var metaNames = []string{schemaMeta, fragmentsMeta}
+
+// writeMetaFile replaces file atomically
+func writeMetaFile(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// readMetaFile returns nil when file does not exist
+func readMetaFile(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+// SaveMeta ...
+func (s *MultiFileStorage) SaveMeta(name string, data []byte) error {
+	return writeMetaFile(s.metaFile(name), data)
+}
+
+// LoadMeta ...
+func (s *MultiFileStorage) LoadMeta(name string) ([]byte, error) {
+	return readMetaFile(s.metaFile(name))
+}
+
+// metaFile is kept out of segments directory which is replaced on Publish
+func (s *MultiFileStorage) metaFile(name string) string {
+	return filepath.Join(filepath.Clean(s.storagePath)+".meta", name+".json")
+}
+
+// SaveMeta ...
+func (s *WALStorage) SaveMeta(name string, data []byte) error {
+	return writeMetaFile(filepath.Join(s.dir, name+".meta.json"), data)
+}
+
+// LoadMeta ...
+func (s *WALStorage) LoadMeta(name string) ([]byte, error) {
+	return readMetaFile(filepath.Join(s.dir, name+".meta.json"))
+}
+
+// SaveMeta ...
+func (s *SnapshotStorage) SaveMeta(name string, data []byte) error {
+	return writeMetaFile(s.filename+"."+name+".json", data)
+}
+
+// LoadMeta ...
+func (s *SnapshotStorage) LoadMeta(name string) ([]byte, error) {
+	return readMetaFile(s.filename + "." + name + ".json")
+}
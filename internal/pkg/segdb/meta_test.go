@@ -0,0 +1,51 @@
+package segdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorage_Meta(t *testing.T) {
+	defer clearStorage()
+
+	for _, storage := range []StorageInterface{
+		NewMultiFileStorage(storagePath),
+		NewWALStorage(storagePath + "_wal"),
+		NewSnapshotStorage(getSnapshotPath()),
+	} {
+		data, err := storage.LoadMeta("schema")
+		assert.NoError(t, err)
+		assert.Nil(t, data)
+
+		assert.NoError(t, storage.SaveMeta("schema", []byte(`{"level":{"type":"int"}}`)))
+
+		// meta survives publishing a new generation
+		generation, err := storage.Stage(sliceSource(getSegments(2)))
+		assert.NoError(t, err)
+		assert.NoError(t, generation.Commit())
+
+		data, err = storage.LoadMeta("schema")
+		assert.NoError(t, err)
+		assert.Equal(t, `{"level":{"type":"int"}}`, string(data))
+	}
+
+	os.RemoveAll(storagePath + "_wal")
+}
+
+func TestConvert_Meta(t *testing.T) {
+	defer clearStorage()
+	defer os.RemoveAll(storagePath + "_copy")
+
+	files := NewMultiFileStorage(storagePath)
+	assert.NoError(t, files.Save(getSegments(1)[0]))
+	assert.NoError(t, files.SaveMeta(schemaMeta, []byte(`{}`)))
+
+	snapshot := NewSnapshotStorage(storagePath + "_copy/segments.snapshot")
+	assert.NoError(t, Convert(snapshot, files))
+
+	data, err := snapshot.LoadMeta(schemaMeta)
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(data))
+}
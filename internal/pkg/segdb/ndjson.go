@@ -0,0 +1,223 @@
+package segdb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// exportedSegment is a line of NDJSON export
+type exportedSegment struct {
+	ID        string     `json:"id"`
+	Data      string     `json:"data,omitempty"`
+	Filters   string     `json:"filters"`
+	Indexes   Indexes    `json:"indexes,omitempty"`
+	Priority  int        `json:"priority,omitempty"`
+	Version   uint64     `json:"version,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// ActiveFrom and ActiveUntil are missing when unbounded
+	ActiveFrom  *time.Time `json:"active_from,omitempty"`
+	ActiveUntil *time.Time `json:"active_until,omitempty"`
+	// Status is active when missing
+	Status string `json:"status,omitempty"`
+}
+
+// Export writes all segments as NDJSON, one segment per line in the order
+// they have been added. Segments are encoded one at a time, those added or
+// deleted meanwhile are not exported or still are. Export returns number of
+// written segments.
+func (s *Segdb) Export(w io.Writer) (int, error) {
+	s.mu.RLock()
+	segments := s.getAll(s.order())
+	s.mu.RUnlock()
+
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+
+	for i, segment := range segments {
+		line := &exportedSegment{
+			ID:       segment.ID,
+			Data:     segment.Data,
+			Filters:  segment.Filters,
+			Indexes:  segment.Indexes,
+			Priority: segment.Priority,
+			Version:  segment.Version,
+			Status:   segment.Status,
+		}
+		if segment.CreatedAt.IsZero() == false {
+			line.CreatedAt, line.UpdatedAt = &segment.CreatedAt, &segment.UpdatedAt
+		}
+		if segment.ActiveFrom.IsZero() == false {
+			line.ActiveFrom = &segment.ActiveFrom
+		}
+		if segment.ActiveUntil.IsZero() == false {
+			line.ActiveUntil = &segment.ActiveUntil
+		}
+
+		if err := enc.Encode(line); err != nil {
+			return i, err
+		}
+	}
+
+	return len(segments), buf.Flush()
+}
+
+// importBatchSize number of segments applied at once by Import without
+// replace, replaced by tests
+var importBatchSize = 1000
+
+// Import reads NDJSON written by Export, gzipped or not, one line at a time
+// so the input is not held in memory as a whole. With replace segments
+// missing in the input are deleted like Publish does, nothing is changed
+// unless every segment is valid. Otherwise the input is applied as upserts
+// like Apply does in batches of importBatchSize segments, a batch is applied
+// only when all of its segments are valid and batches applied before stay.
+// Imported segments keep versions and timestamps of the input above the
+// stored ones, others are versioned as any other change. Import returns number
+// of imported segments.
+func (s *Segdb) Import(r io.Reader, replace bool) (int, error) {
+	d, err := newNDJSONReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer d.close()
+
+	if replace {
+		if err := s.publish(d.next, s.stampImported); err != nil {
+			return 0, err
+		}
+		return d.read, nil
+	}
+
+	imported := 0
+	seen := map[string]bool{}
+	batch := make([]*Segment, 0, importBatchSize)
+
+	for {
+		segment, err := d.next()
+		if err != nil {
+			return imported, err
+		}
+
+		if segment != nil {
+			if seen[segment.ID] == true {
+				return imported, fmt.Errorf("segment %q: %w", segment.ID, ErrDuplicateID)
+			}
+			seen[segment.ID] = true
+			batch = append(batch, segment)
+		}
+
+		if len(batch) == importBatchSize || segment == nil && len(batch) > 0 {
+			if err := s.importBatch(batch); err != nil {
+				return imported, err
+			}
+			imported += len(batch)
+			batch = batch[:0]
+		}
+
+		if segment == nil {
+			return imported, nil
+		}
+	}
+}
+
+// importBatch applies batch of imported segments as upserts
+func (s *Segdb) importBatch(batch []*Segment) error {
+	results, err := s.apply(batch, nil, s.stampImported)
+	for _, result := range results {
+		if result.Err != nil {
+			return fmt.Errorf("segment %q: %w", result.ID, result.Err)
+		}
+	}
+
+	return err
+}
+
+// ndjsonReader decodes segments line by line, empty lines are skipped
+type ndjsonReader struct {
+	in   *bufio.Reader
+	zr   *gzip.Reader
+	line int
+	eof  bool
+	// read number of decoded segments
+	read int
+}
+
+// newNDJSONReader ...
+func newNDJSONReader(r io.Reader) (*ndjsonReader, error) {
+	d := &ndjsonReader{in: bufio.NewReader(r)}
+
+	// gzip magic
+	if magic, err := d.in.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(d.in)
+		if err != nil {
+			return nil, err
+		}
+		d.zr, d.in = zr, bufio.NewReader(zr)
+	}
+
+	return d, nil
+}
+
+// next returns the next segment, nil when input is over
+func (d *ndjsonReader) next() (*Segment, error) {
+	for d.eof == false {
+		line, err := d.in.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		d.eof = err == io.EOF
+		d.line++
+
+		if line = bytes.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+
+		decoded := &exportedSegment{}
+		if err := json.Unmarshal(line, decoded); err != nil {
+			return nil, fmt.Errorf("line %d: %w", d.line, err)
+		}
+
+		segment := &Segment{
+			ID:       decoded.ID,
+			Data:     decoded.Data,
+			Filters:  decoded.Filters,
+			Indexes:  decoded.Indexes,
+			Priority: decoded.Priority,
+			Version:  decoded.Version,
+			Status:   decoded.Status,
+		}
+		if decoded.CreatedAt != nil {
+			segment.CreatedAt = *decoded.CreatedAt
+		}
+		if decoded.UpdatedAt != nil {
+			segment.UpdatedAt = *decoded.UpdatedAt
+		}
+		if decoded.ActiveFrom != nil {
+			segment.ActiveFrom = *decoded.ActiveFrom
+		}
+		if decoded.ActiveUntil != nil {
+			segment.ActiveUntil = *decoded.ActiveUntil
+		}
+
+		d.read++
+		return segment, nil
+	}
+
+	return nil, nil
+}
+
+// close ...
+func (d *ndjsonReader) close() error {
+	if d.zr != nil {
+		return d.zr.Close()
+	}
+
+	return nil
+}
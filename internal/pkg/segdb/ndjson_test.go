@@ -0,0 +1,136 @@
+package segdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegdb_ExportImport(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg2", Data: "data", Filters: "level > 1", Indexes: Indexes{"country": "US", "age": 30}, Priority: 2}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true", Indexes: Indexes{"platform": []string{"ios", "web"}}}))
+
+	out := &bytes.Buffer{}
+	n, err := s.Export(out)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], `{"id":"seg2","data":"data","filters":"level > 1","indexes":{"age":30,"country":"US"},"priority":2,"version":1,"created_at":`))
+
+	dir, err := ioutil.TempDir("", "segdb")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// gzipped input with empty lines
+	gz := &bytes.Buffer{}
+	zw := gzip.NewWriter(gz)
+	zw.Write([]byte("\n" + out.String() + "\n"))
+	zw.Close()
+
+	imported := New(NewMultiFileStorage(dir))
+	assert.NoError(t, imported.Add(&Segment{ID: "seg3", Filters: "true"}))
+
+	n, err = imported.Import(gz, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"seg3", "seg2", "seg1"}, segmentIDs(imported.ListWhere(And(), -1, -1)))
+
+	n, err = imported.Import(bytes.NewReader(out.Bytes()), true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"seg2", "seg1"}, segmentIDs(imported.ListWhere(And(), -1, -1)))
+
+	// versions and timestamps are kept
+	original, _ := s.Get("seg2")
+	segment, _ := imported.Get("seg2")
+	assert.Equal(t, original.Version, segment.Version)
+	assert.True(t, original.CreatedAt.Equal(segment.CreatedAt))
+	assert.True(t, original.UpdatedAt.Equal(segment.UpdatedAt))
+	assert.Equal(t, "data", segment.Data)
+	assert.Equal(t, 2, segment.Priority)
+	assert.Equal(t, Indexes{"country": "US", "age": int64(30)}, segment.Indexes)
+	assert.True(t, segment.Match(map[string]interface{}{"level": 2}))
+	assert.Equal(t, []string{"seg1"}, segmentIDs(imported.ListWhere(Eq("platform", "web"), -1, -1)))
+
+	_, err = imported.Import(strings.NewReader(`{"id": "seg4", "filters": "true"}`+"\n"+`{"id": "seg5"`), true)
+	assert.EqualError(t, err, "line 2: unexpected end of JSON input")
+
+	_, err = imported.Import(strings.NewReader(`{"id": "seg4", "filters": "true"}`+"\n"+`{"id": "seg5", "filters": "level >"}`), false)
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), `segment "seg5": `))
+
+	_, err = imported.Import(strings.NewReader(`{"id": "seg4", "filters": "true"}`+"\n"+`{"id": "seg4", "filters": "true"}`), false)
+	assert.True(t, errors.Is(err, ErrDuplicateID))
+	assert.Equal(t, 2, imported.GetSegmentsCount())
+
+	// batches read before an invalid one stay applied
+	importBatchSize = 1
+	defer func() { importBatchSize = 1000 }()
+
+	n, err = imported.Import(strings.NewReader(`{"id": "seg4", "filters": "true"}`+"\n"+`{"id": "seg5", "filters": "level >"}`), false)
+	assert.Error(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"seg2", "seg1", "seg4"}, segmentIDs(imported.ListWhere(And(), -1, -1)))
+
+	_, err = imported.Import(strings.NewReader(`{"id": "seg5", "filters": "true"}`+"\n"+`{"id": "seg5", "filters": "true"}`), false)
+	assert.True(t, errors.Is(err, ErrDuplicateID))
+
+	// segments without version are versioned as changes
+	n, err = imported.Import(strings.NewReader(`{"id": "seg4", "filters": "false"}`+"\n"+`{"id": "seg2", "filters": "true", "version": 7}`), false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	segment, _ = imported.Get("seg4")
+	assert.Equal(t, uint64(2), segment.Version)
+	segment, _ = imported.Get("seg2")
+	assert.Equal(t, uint64(7), segment.Version)
+	assert.False(t, segment.CreatedAt.IsZero())
+}
+
+func TestSegdb_ImportOlderExport(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+	s.SetHistorySize(10)
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Data: "v1", Filters: "true"}))
+	old := &bytes.Buffer{}
+	_, err := s.Export(old)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Data: "v2", Filters: "true"}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Data: "v3", Filters: "true"}))
+
+	// older versions are imported as changes, versions keep going up
+	_, err = s.Import(bytes.NewReader(old.Bytes()), false)
+	assert.NoError(t, err)
+	segment, _ := s.Get("seg1")
+	assert.Equal(t, uint64(4), segment.Version)
+	assert.Equal(t, "v1", segment.Data)
+
+	_, err = s.Import(bytes.NewReader(old.Bytes()), true)
+	assert.NoError(t, err)
+	segment, _ = s.Get("seg1")
+	assert.Equal(t, uint64(4), segment.Version)
+
+	// so are versions of deleted segments
+	assert.NoError(t, s.Delete("seg1"))
+	_, err = s.Import(bytes.NewReader(old.Bytes()), false)
+	assert.NoError(t, err)
+	segment, _ = s.Get("seg1")
+	assert.Equal(t, uint64(5), segment.Version)
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Data: "v6", Filters: "true"}))
+	versions, err := s.History("seg1")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6}, versionsOf(versions))
+}
@@ -0,0 +1,177 @@
+package segdb
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// parallelChunk number of candidates evaluated by a worker at once,
+// queries with fewer candidates are evaluated sequentially
+const parallelChunk = 256
+
+// SetQueryWorkers sets number of workers evaluating filters of one query
+// in parallel, GOMAXPROCS when n < 1. New Segdb evaluates sequentially.
+func (s *Segdb) SetQueryWorkers(n int) {
+	if n < 1 {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	s.mu.Lock()
+	s.workers = n
+	s.mu.Unlock()
+}
+
+// chunkResult matches found in a chunk of candidates, evaluation of
+// the chunk stops at the first error under ErrorPolicyFail
+type chunkResult struct {
+	segments []*Segment
+	err      error
+	done     bool
+}
+
+// matchParallel is match sharding candidates into chunks evaluated by
+// workers. Workers take chunks in order and stop taking new ones once
+// enough segments have been found. Ordered results are the same as
+// sequential evaluation gives, though segments past the limit may be
+// evaluated and count errors. Unordered results are taken as found.
+func (s *Segdb) matchParallel(p *queryPlan, limit int, offset int, workers int, ordered bool) ([]*Segment, error) {
+	// unlimited
+	if limit < 1 || limit > p.total {
+		limit = p.total
+	}
+
+	need := limit + offset
+	chunks := (len(p.candidates) + parallelChunk - 1) / parallelChunk
+	results := make([]chunkResult, chunks)
+
+	if workers > chunks {
+		workers = chunks
+	}
+
+	var (
+		mu      sync.Mutex
+		next    int32 = -1
+		stop    int32
+		found   int
+		prefix  int
+		matches []*Segment
+		failure error
+	)
+
+	// complete reports whether evaluated chunks already give the result
+	complete := func(i int, result chunkResult) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		results[i] = result
+		results[i].done = true
+
+		if ordered == false {
+			matches = append(matches, result.segments...)
+			if result.err != nil && failure == nil {
+				failure = result.err
+			}
+			return failure != nil || len(matches) >= need
+		}
+
+		// walk the completed prefix of chunks
+		for prefix < chunks && results[prefix].done {
+			found += len(results[prefix].segments)
+			if results[prefix].err != nil || found >= need {
+				return true
+			}
+			prefix++
+		}
+
+		return false
+	}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				i := int(atomic.AddInt32(&next, 1))
+				if i >= chunks {
+					return
+				}
+
+				from, to := i*parallelChunk, (i+1)*parallelChunk
+				if to > len(p.candidates) {
+					to = len(p.candidates)
+				}
+
+				if complete(i, s.matchChunk(p, p.candidates[from:to], need)) {
+					atomic.StoreInt32(&stop, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ordered == false {
+		if failure != nil {
+			return nil, failure
+		}
+		return page(matches, limit, offset), nil
+	}
+
+	matches = []*Segment{}
+	for _, result := range results {
+		if result.done == false {
+			break
+		}
+		matches = append(matches, result.segments...)
+		if len(matches) >= need {
+			break
+		}
+		if result.err != nil {
+			return nil, result.err
+		}
+	}
+
+	return page(matches, limit, offset), nil
+}
+
+// matchChunk evaluates candidates until need segments are found
+func (s *Segdb) matchChunk(p *queryPlan, candidates []*Segment, need int) chunkResult {
+	result := chunkResult{}
+
+	for _, segment := range candidates {
+		if len(result.segments) >= need {
+			break
+		}
+
+		matched, err := segment.eval(p.params)
+		if err != nil && p.policy != ErrorPolicyIgnore {
+			s.errStats.add(segment.ID, err)
+			if p.policy == ErrorPolicyFail {
+				result.err = fmt.Errorf("segment %q: %w", segment.ID, err)
+				break
+			}
+		}
+
+		if matched {
+			result.segments = append(result.segments, segment)
+		}
+	}
+
+	return result
+}
+
+// page skips offset segments and returns at most limit of the rest
+func page(segments []*Segment, limit int, offset int) []*Segment {
+	if offset > len(segments) {
+		offset = len(segments)
+	}
+	segments = segments[offset:]
+
+	if limit < len(segments) {
+		segments = segments[:limit]
+	}
+
+	return append([]*Segment{}, segments...)
+}
@@ -0,0 +1,111 @@
+package segdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getParallelSegDb(t *testing.T, n int) *Segdb {
+	s := getSegDb()
+
+	segments := []*Segment{}
+	for i := 0; i < n; i++ {
+		filters := fmt.Sprintf("level %% %d == 0", i%7+1)
+		if i%500 == 499 {
+			filters = `level > "1"`
+		}
+		segments = append(segments, &Segment{ID: fmt.Sprintf("seg%05d", n-i), Filters: filters})
+	}
+	assert.NoError(t, s.Publish(segments))
+
+	return s
+}
+
+func TestSegdb_FindParallel(t *testing.T) {
+	s := getParallelSegDb(t, 3000)
+	defer clearStorage()
+
+	m := map[string]interface{}{"level": 6}
+
+	tests := []QueryOptions{
+		{Context: m},
+		{Context: m, Limit: 10},
+		{Context: m, Limit: 700, Offset: 300},
+		{Context: m, Limit: 5, Offset: 2900},
+		{Context: m, Limit: 20, Sort: SortID},
+	}
+
+	for _, policy := range []ErrorPolicy{ErrorPolicyIgnore, ErrorPolicyFail} {
+		s.SetErrorPolicy(policy)
+
+		for _, q := range tests {
+			s.SetQueryWorkers(1)
+			expected, expectedErr := s.Find(&q)
+
+			s.SetQueryWorkers(4)
+			for i := 0; i < 5; i++ {
+				segments, err := s.Find(&q)
+				assert.Equal(t, expectedErr, err)
+				assert.Equal(t, segmentIDs(expected), segmentIDs(segments), q)
+			}
+		}
+	}
+
+	// unordered results are some of matched segments
+	s.SetErrorPolicy(ErrorPolicyIgnore)
+	all, _ := s.Find(&QueryOptions{Context: m})
+	segments, err := s.Find(&QueryOptions{Context: m, Limit: 100, Unordered: true})
+	assert.NoError(t, err)
+	assert.Len(t, segments, 100)
+	assert.Subset(t, segmentIDs(all), segmentIDs(segments))
+}
+
+func TestSegdb_FindParallelRace(t *testing.T) {
+	s := getParallelSegDb(t, 1000)
+	defer clearStorage()
+
+	s.SetQueryWorkers(8)
+	s.SetErrorPolicy(ErrorPolicyCount)
+
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			segments, err := s.Find(&QueryOptions{Context: map[string]interface{}{"level": i}, Limit: 50, Unordered: i%2 == 0})
+			assert.NoError(t, err)
+			assert.True(t, len(segments) <= 50)
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
+
+func BenchmarkSegdb_Find(b *testing.B) {
+	s := New(NewMultiFileStorage(storagePath))
+	defer clearStorage()
+
+	segments := []*Segment{}
+	for i := 0; i < 100000; i++ {
+		segments = append(segments, &Segment{
+			ID:      fmt.Sprintf("seg%06d", i),
+			Filters: fmt.Sprintf(`level > %d && "golf" in interests && len(name) > 3`, i%100),
+		})
+	}
+	if err := s.Publish(segments); err != nil {
+		b.Fatal(err)
+	}
+
+	m := map[string]interface{}{"level": 50, "interests": []string{"golf", "tennis"}, "name": "golfer"}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		s.SetQueryWorkers(workers)
+		b.Run(fmt.Sprintf("workers=%d", s.workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.Find(&QueryOptions{Context: m})
+			}
+		})
+	}
+}
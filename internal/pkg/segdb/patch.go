@@ -0,0 +1,157 @@
+package segdb
+
+import "time"
+
+// Patch changes selected fields of segment, nil fields are left as they are
+type Patch struct {
+	Data     *string
+	Filters  *string
+	Priority *int
+	// ActiveFrom and ActiveUntil are removed by zero time
+	ActiveFrom  *time.Time
+	ActiveUntil *time.Time
+	// Status changes only as SetStatus allows
+	Status *string
+	// SetIndexes adds or replaces indexes by name
+	SetIndexes Indexes
+	// RemoveIndexes removes indexes by name
+	RemoveIndexes []string
+}
+
+// Patch updates selected fields of segment. Filters are recompiled only
+// when they are patched and only patched indexes are reindexed.
+func (s *Segdb) Patch(id string, patch *Patch) (*Segment, error) {
+	return s.patch(id, patch, nil)
+}
+
+// PatchIf is Patch failing with ErrConflict unless segment has given version
+func (s *Segdb) PatchIf(id string, patch *Patch, version uint64) (*Segment, error) {
+	return s.patch(id, patch, &version)
+}
+
+func (s *Segdb) patch(id string, patch *Patch, version *uint64) (*Segment, error) {
+	// filters are compiled as a segment of their own
+	var compiled *Segment
+	var err error
+
+	if patch.Filters != nil {
+		compiled = &Segment{ID: id, Filters: *patch.Filters}
+		if err = s.compile(compiled); err != nil {
+			return nil, err
+		}
+	}
+
+	indexes, err := patch.SetIndexes.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	status := ""
+	if patch.Status != nil {
+		if status, err = checkStatus(*patch.Status); err != nil {
+			return nil, err
+		}
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.RLock()
+	old, ok := s.segments[id]
+	s.mu.RUnlock()
+
+	if ok == false {
+		return nil, ErrNotFound
+	}
+
+	if err := checkVersion(old, version); err != nil {
+		return nil, err
+	}
+
+	segment := &Segment{
+		ID:          old.ID,
+		Data:        old.Data,
+		Filters:     old.Filters,
+		Indexes:     old.Indexes,
+		Priority:    old.Priority,
+		Program:     old.Program,
+		ActiveFrom:  old.ActiveFrom,
+		ActiveUntil: old.ActiveUntil,
+		Status:      old.Status,
+		conditions:  old.conditions,
+		source:      old.source,
+		refs:        old.refs,
+		fragments:   old.fragments,
+		functions:   old.functions,
+	}
+
+	if patch.Data != nil {
+		segment.Data = *patch.Data
+	}
+
+	if patch.Priority != nil {
+		segment.Priority = *patch.Priority
+	}
+
+	if patch.ActiveFrom != nil {
+		segment.ActiveFrom = *patch.ActiveFrom
+	}
+
+	if patch.ActiveUntil != nil {
+		segment.ActiveUntil = *patch.ActiveUntil
+	}
+
+	if patch.Status != nil {
+		if err := checkTransition(old.Status, status); err != nil {
+			return nil, err
+		}
+		segment.Status = status
+	}
+
+	if patch.Filters != nil && *patch.Filters != old.Filters {
+		segment.Filters, segment.Program = compiled.Filters, compiled.Program
+		segment.conditions, segment.source = compiled.conditions, compiled.source
+		segment.refs, segment.fragments = compiled.refs, compiled.fragments
+		segment.functions = compiled.functions
+
+		if err := s.checkFilters(segment); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(indexes) > 0 || len(patch.RemoveIndexes) > 0 {
+		segment.Indexes = make(Indexes, len(old.Indexes)+len(indexes))
+		for name, value := range old.Indexes {
+			segment.Indexes[name] = value
+		}
+		for name, value := range indexes {
+			segment.Indexes[name] = value
+		}
+		for _, name := range patch.RemoveIndexes {
+			delete(segment.Indexes, name)
+		}
+	}
+
+	if sameContent(segment, old) {
+		return old, nil
+	}
+
+	if err := s.stamp(segment, old, s.now()); err != nil {
+		return nil, err
+	}
+
+	if err := s.storage.Save(segment); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.segments[id] = segment
+	s.update(old, segment)
+	s.mu.Unlock()
+
+	if segment.Filters != old.Filters {
+		s.errStats.reset(id)
+	}
+
+	return segment, s.keep(old)
+}
@@ -0,0 +1,63 @@
+package segdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegdb_Patch(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "level > 1", Indexes: Indexes{"country": "US", "age": 30}}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg2", Filters: "true", Indexes: Indexes{"country": "US"}}))
+	original, _ := s.Get("seg1")
+
+	// filters are not recompiled
+	data := "payload"
+	segment, err := s.Patch("seg1", &Patch{Data: &data})
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", segment.Data)
+	assert.Equal(t, uint64(2), segment.Version)
+	assert.True(t, original.Program == segment.Program)
+	assert.Equal(t, []string{"seg1", "seg2"}, segmentIDs(s.ListWhere(Eq("country", "US"), -1, -1)))
+
+	segment, err = s.Patch("seg1", &Patch{SetIndexes: Indexes{"country": "CA", "platform": []string{"ios"}}, RemoveIndexes: []string{"age"}})
+	assert.NoError(t, err)
+	assert.Equal(t, Indexes{"country": "CA", "platform": []interface{}{"ios"}}, segment.Indexes)
+	assert.Equal(t, []string{"seg2"}, segmentIDs(s.ListWhere(Eq("country", "US"), -1, -1)))
+	assert.Equal(t, []string{"seg1"}, segmentIDs(s.ListWhere(Eq("platform", "ios"), -1, -1)))
+	assert.Equal(t, []string{}, segmentIDs(s.ListWhere(Gt("age", 1), -1, -1)))
+
+	// pre-filter follows patched filters
+	assert.Equal(t, []string{"seg2"}, segmentIDs(s.Query(map[string]interface{}{"level": 0}, -1)))
+	filters := "level < 1"
+	_, err = s.Patch("seg1", &Patch{Filters: &filters})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg1", "seg2"}, segmentIDs(s.Query(map[string]interface{}{"level": 0}, -1)))
+
+	invalid := "level <"
+	_, err = s.Patch("seg1", &Patch{Filters: &invalid})
+	assert.Error(t, err)
+
+	// nothing changed
+	segment, err = s.Patch("seg1", &Patch{Data: &data})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), segment.Version)
+
+	_, err = s.Patch("seg3", &Patch{Data: &data})
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.PatchIf("seg1", &Patch{Filters: &invalid}, 3)
+	assert.Error(t, err)
+	_, err = s.PatchIf("seg1", &Patch{Data: &filters}, 3)
+	assert.True(t, errors.Is(err, ErrConflict))
+
+	loaded := getSegDb()
+	assert.NoError(t, loaded.Load())
+	segment, _ = loaded.Get("seg1")
+	assert.Equal(t, "level < 1", segment.Filters)
+	assert.Equal(t, "payload", segment.Data)
+	assert.Equal(t, Indexes{"country": "CA", "platform": []interface{}{"ios"}}, segment.Indexes)
+}
@@ -0,0 +1,227 @@
+package segdb
+
+import (
+	"sort"
+	"sync"
+)
+
+// Posting lists are ascending slices of segment sequence numbers,
+// set operations always return new lists.
+
+// gallopRatio size ratio of lists above which intersection searches
+// the longer list instead of merging both
+const gallopRatio = 32
+
+// search returns position of seq in list or where it would be inserted
+func search(list []uint64, seq uint64) int {
+	return sort.Search(len(list), func(i int) bool { return list[i] >= seq })
+}
+
+// contains ...
+func contains(list []uint64, seq uint64) bool {
+	i := search(list, seq)
+	return i < len(list) && list[i] == seq
+}
+
+// postingSet ...
+//
+// postingSet is a posting list maintained as a set, adding or removing a
+// segment does not shift the list however long it is. Segments appended
+// in the order they are numbered go straight to the sorted list, other
+// changes are kept aside and merged into it when the list is read. Lists
+// are read by readers sharing a lock, so merging is guarded by the mutex
+// of the list. Nil set is empty.
+type postingSet struct {
+	mu      sync.Mutex
+	sorted  []uint64
+	added   map[uint64]struct{}
+	removed map[uint64]struct{}
+}
+
+// add ..., false when seq is already there
+func (p *postingSet) add(seq uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.removed[seq]; ok == true {
+		delete(p.removed, seq)
+		return true
+	}
+
+	if _, ok := p.added[seq]; ok == true {
+		return false
+	}
+
+	n := len(p.sorted)
+	switch {
+	case len(p.added) == 0 && len(p.removed) == 0 && (n == 0 || p.sorted[n-1] < seq):
+		p.sorted = append(p.sorted, seq)
+	case contains(p.sorted, seq):
+		return false
+	default:
+		if p.added == nil {
+			p.added = make(map[uint64]struct{})
+		}
+		p.added[seq] = struct{}{}
+	}
+
+	return true
+}
+
+// remove ..., false when seq is not there
+func (p *postingSet) remove(seq uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.added[seq]; ok == true {
+		delete(p.added, seq)
+		return true
+	}
+
+	if _, ok := p.removed[seq]; ok == true || contains(p.sorted, seq) == false {
+		return false
+	}
+
+	if p.removed == nil {
+		p.removed = make(map[uint64]struct{})
+	}
+	p.removed[seq] = struct{}{}
+
+	return true
+}
+
+// len ...
+func (p *postingSet) len() int {
+	if p == nil {
+		return 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.sorted) - len(p.removed) + len(p.added)
+}
+
+// seqs returns sorted sequence numbers merging pending changes first,
+// the list is shared and must not be modified
+func (p *postingSet) seqs() []uint64 {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.added) == 0 && len(p.removed) == 0 {
+		return p.sorted
+	}
+
+	added := make([]uint64, 0, len(p.added))
+	for seq := range p.added {
+		added = append(added, seq)
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+
+	merged := make([]uint64, 0, len(p.sorted)-len(p.removed)+len(added))
+	for _, seq := range p.sorted {
+		if _, ok := p.removed[seq]; ok == true {
+			continue
+		}
+		for len(added) > 0 && added[0] < seq {
+			merged = append(merged, added[0])
+			added = added[1:]
+		}
+		merged = append(merged, seq)
+	}
+	merged = append(merged, added...)
+
+	p.sorted, p.added, p.removed = merged, nil, nil
+
+	return p.sorted
+}
+
+// intersect ...
+func intersect(a, b []uint64) []uint64 {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+
+	result := make([]uint64, 0, len(a))
+
+	if len(a) == 0 {
+		return result
+	}
+
+	// short list against a long one: binary search the rest of the long one
+	if len(b)/len(a) >= gallopRatio {
+		for _, seq := range a {
+			i := search(b, seq)
+			if i == len(b) {
+				break
+			}
+			if b[i] == seq {
+				result = append(result, seq)
+			}
+			b = b[i:]
+		}
+		return result
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+
+	return result
+}
+
+// union ...
+func union(a, b []uint64) []uint64 {
+	result := make([]uint64, 0, len(a)+len(b))
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// difference returns items of a which are not in b
+func difference(a, b []uint64) []uint64 {
+	result := make([]uint64, 0, len(a))
+
+	j := 0
+	for _, seq := range a {
+		for j < len(b) && b[j] < seq {
+			j++
+		}
+		if j < len(b) && b[j] == seq {
+			continue
+		}
+		result = append(result, seq)
+	}
+
+	return result
+}
@@ -0,0 +1,57 @@
+package segdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostingSet(t *testing.T) {
+	var empty *postingSet
+	assert.Nil(t, empty.seqs())
+	assert.Equal(t, 0, empty.len())
+
+	p := &postingSet{}
+	for _, seq := range []uint64{1, 3, 5, 9} {
+		assert.True(t, p.add(seq))
+	}
+	assert.False(t, p.add(3))
+	assert.Nil(t, p.added)
+
+	// changes in the middle are kept aside until the list is read
+	assert.True(t, p.add(4))
+	assert.False(t, p.add(4))
+	assert.True(t, p.remove(5))
+	assert.False(t, p.remove(5))
+	assert.False(t, p.remove(7))
+	assert.Equal(t, 4, p.len())
+	assert.Equal(t, []uint64{1, 3, 5, 9}, p.sorted)
+
+	assert.Equal(t, []uint64{1, 3, 4, 9}, p.seqs())
+	assert.Nil(t, p.added)
+	assert.Nil(t, p.removed)
+
+	// removed and added back
+	assert.True(t, p.remove(3))
+	assert.True(t, p.add(3))
+	assert.True(t, p.add(0))
+	assert.True(t, p.remove(0))
+	assert.Equal(t, []uint64{1, 3, 4, 9}, p.seqs())
+}
+
+func TestPostings_SetOperations(t *testing.T) {
+	a := []uint64{1, 2, 4, 8, 16}
+	b := []uint64{2, 3, 4, 5, 16, 17}
+
+	assert.Equal(t, []uint64{2, 4, 16}, intersect(a, b))
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 8, 16, 17}, union(a, b))
+	assert.Equal(t, []uint64{1, 8}, difference(a, b))
+	assert.Empty(t, intersect(a, nil))
+
+	// galloping path
+	long := make([]uint64, 1000)
+	for i := range long {
+		long[i] = uint64(i * 2)
+	}
+	assert.Equal(t, []uint64{0, 998, 1998}, intersect([]uint64{0, 1, 998, 999, 1998, 5000}, long))
+}
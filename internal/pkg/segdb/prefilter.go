@@ -0,0 +1,476 @@
+package segdb
+
+import (
+	"math"
+	"sort"
+
+	"github.com/antonmedv/expr/ast"
+	"github.com/antonmedv/expr/parser"
+)
+
+// condition is a necessary condition of a filter over one variable:
+// either the variable equals one of values or it is a number in range
+type condition struct {
+	name   string
+	values []interface{}
+	lower  *bound
+	upper  *bound
+}
+
+// isRange ...
+func (c *condition) isRange() bool {
+	return c.values == nil
+}
+
+// analyzeFilters extracts conditions every input matched by filters must
+// satisfy. Only conditions which fail whenever the variable is missing or
+// has another value are extracted, anything else is ignored, so the result
+// may be incomplete but is never wrong.
+func analyzeFilters(filters string) []*condition {
+	tree, err := parser.Parse(filters)
+	if err != nil {
+		return nil
+	}
+
+	conditions := analyzeNode(tree.Node)
+	result := make([]*condition, 0, len(conditions))
+	for _, c := range conditions {
+		result = append(result, c)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+
+	return result
+}
+
+// analyzeNode returns conditions implied by node being true, by variable name
+func analyzeNode(node ast.Node) map[string]*condition {
+	switch n := node.(type) {
+	case *ast.IdentifierNode:
+		// and, or and a filter itself fail on non boolean values
+		return conditionOf(&condition{name: n.Value, values: []interface{}{true}})
+	case *ast.UnaryNode:
+		if id, ok := n.Node.(*ast.IdentifierNode); ok && (n.Operator == "!" || n.Operator == "not") {
+			return conditionOf(&condition{name: id.Value, values: []interface{}{false}})
+		}
+	case *ast.BinaryNode:
+		switch n.Operator {
+		case "&&", "and":
+			return andConditions(analyzeNode(n.Left), analyzeNode(n.Right))
+		case "||", "or":
+			return orConditions(analyzeNode(n.Left), analyzeNode(n.Right))
+		case "==":
+			return analyzeEqual(n.Left, n.Right)
+		case "in":
+			return analyzeIn(n.Left, n.Right)
+		case "<", "<=", ">", ">=":
+			return analyzeCompare(n.Operator, n.Left, n.Right)
+		}
+	}
+
+	return nil
+}
+
+func conditionOf(c *condition) map[string]*condition {
+	return map[string]*condition{c.name: c}
+}
+
+// analyzeEqual ...
+func analyzeEqual(left ast.Node, right ast.Node) map[string]*condition {
+	if _, ok := left.(*ast.IdentifierNode); ok == false {
+		left, right = right, left
+	}
+
+	id, ok := left.(*ast.IdentifierNode)
+	if ok == false {
+		return nil
+	}
+
+	value, ok := literalValue(right)
+	if ok == false {
+		return nil
+	}
+
+	return conditionOf(&condition{name: id.Value, values: []interface{}{value}})
+}
+
+// analyzeIn handles "x in [literals]" and "x in from..to"
+func analyzeIn(left ast.Node, right ast.Node) map[string]*condition {
+	id, ok := left.(*ast.IdentifierNode)
+	if ok == false {
+		return nil
+	}
+
+	switch r := right.(type) {
+	case *ast.ArrayNode:
+		values := make([]interface{}, 0, len(r.Nodes))
+		for _, node := range r.Nodes {
+			value, ok := literalValue(node)
+			if ok == false {
+				return nil
+			}
+			if indexOf(values, value) < 0 {
+				values = append(values, value)
+			}
+		}
+		return conditionOf(&condition{name: id.Value, values: values})
+	case *ast.BinaryNode:
+		if r.Operator != ".." {
+			return nil
+		}
+		from, ok1 := numberValue(r.Left)
+		to, ok2 := numberValue(r.Right)
+		if ok1 == false || ok2 == false {
+			return nil
+		}
+		return conditionOf(&condition{
+			name:  id.Value,
+			lower: &bound{value: from, inclusive: true},
+			upper: &bound{value: to, inclusive: true},
+		})
+	}
+
+	return nil
+}
+
+// analyzeCompare handles comparison of variable with a number
+func analyzeCompare(op string, left ast.Node, right ast.Node) map[string]*condition {
+	if _, ok := left.(*ast.IdentifierNode); ok == false {
+		left, right = right, left
+		op = map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<="}[op]
+	}
+
+	id, ok := left.(*ast.IdentifierNode)
+	if ok == false {
+		return nil
+	}
+
+	value, ok := numberValue(right)
+	if ok == false {
+		return nil
+	}
+
+	c := &condition{name: id.Value}
+	b := &bound{value: value, inclusive: op == "<=" || op == ">="}
+	if op == ">" || op == ">=" {
+		c.lower = b
+	} else {
+		c.upper = b
+	}
+
+	return conditionOf(c)
+}
+
+// literalValue returns normalized value of literal usable for equality lookup.
+// Integers beyond float64 precision are skipped as expr compares them with
+// floats by converting to float64.
+func literalValue(node ast.Node) (interface{}, bool) {
+	switch n := node.(type) {
+	case *ast.StringNode:
+		return n.Value, true
+	case *ast.BoolNode:
+		return n.Value, true
+	}
+
+	value, ok := numberValue(node)
+	if ok == false {
+		return nil, false
+	}
+
+	switch v := value.(type) {
+	case int64:
+		return v, v <= maxExactFloat && v >= -maxExactFloat
+	case float64:
+		return v, math.Abs(v) <= maxExactFloat
+	}
+
+	return nil, false
+}
+
+// numberValue returns normalized value of numeric literal
+func numberValue(node ast.Node) (interface{}, bool) {
+	negate := false
+	if u, ok := node.(*ast.UnaryNode); ok == true && (u.Operator == "-" || u.Operator == "+") {
+		negate, node = u.Operator == "-", u.Node
+	}
+
+	var value interface{}
+	switch n := node.(type) {
+	case *ast.IntegerNode:
+		value = n.Value
+		if negate {
+			value = -n.Value
+		}
+	case *ast.FloatNode:
+		value = n.Value
+		if negate {
+			value = -n.Value
+		}
+	default:
+		return nil, false
+	}
+
+	value, err := NormalizeIndexValue(value)
+
+	return value, err == nil
+}
+
+// andConditions both sides must hold, conditions over the same variable are intersected
+func andConditions(left map[string]*condition, right map[string]*condition) map[string]*condition {
+	result := make(map[string]*condition, len(left)+len(right))
+
+	for name, c := range left {
+		result[name] = c
+	}
+
+	for name, c := range right {
+		if l, ok := result[name]; ok == true {
+			result[name] = intersectConditions(l, c)
+			continue
+		}
+		result[name] = c
+	}
+
+	return result
+}
+
+// orConditions one of sides holds, only variables constrained by both sides are kept
+func orConditions(left map[string]*condition, right map[string]*condition) map[string]*condition {
+	result := map[string]*condition{}
+
+	for name, l := range left {
+		r, ok := right[name]
+		if ok == false {
+			continue
+		}
+		if c := uniteConditions(l, r); c != nil {
+			result[name] = c
+		}
+	}
+
+	return result
+}
+
+// intersectConditions ...
+func intersectConditions(a *condition, b *condition) *condition {
+	if a.isRange() && b.isRange() {
+		r, ok := rangeQuery{name: a.name, lower: a.lower, upper: a.upper}.intersect(rangeQuery{name: b.name, lower: b.lower, upper: b.upper})
+		if ok == false {
+			return &condition{name: a.name, values: []interface{}{}}
+		}
+		return &condition{name: a.name, lower: r.lower, upper: r.upper}
+	}
+
+	if a.isRange() {
+		a, b = b, a
+	}
+
+	values := []interface{}{}
+	for _, v := range a.values {
+		if b.isRange() && b.contains(v) || !b.isRange() && indexOf(b.values, v) >= 0 {
+			values = append(values, v)
+		}
+	}
+
+	return &condition{name: a.name, values: values}
+}
+
+// uniteConditions returns condition holding when any of conditions holds,
+// nil when there is no simple one
+func uniteConditions(a *condition, b *condition) *condition {
+	if a.isRange() != b.isRange() {
+		return nil
+	}
+
+	if a.isRange() == false {
+		values := append([]interface{}{}, a.values...)
+		for _, v := range b.values {
+			if indexOf(values, v) < 0 {
+				values = append(values, v)
+			}
+		}
+		return &condition{name: a.name, values: values}
+	}
+
+	c := &condition{name: a.name}
+	if a.lower != nil && b.lower != nil {
+		c.lower = a.lower
+		if b.lower.passLower(a.lower.value) {
+			c.lower = b.lower
+		}
+	}
+	if a.upper != nil && b.upper != nil {
+		c.upper = a.upper
+		if b.upper.passUpper(a.upper.value) {
+			c.upper = b.upper
+		}
+	}
+
+	if c.lower == nil && c.upper == nil {
+		return nil
+	}
+
+	return c
+}
+
+// contains reports whether value satisfies range condition
+func (c *condition) contains(value interface{}) bool {
+	if indexValueRank(value) != indexValueRank(int64(0)) {
+		return false
+	}
+	if c.lower != nil && c.lower.passLower(value) == false {
+		return false
+	}
+	if c.upper != nil && c.upper.passUpper(value) == false {
+		return false
+	}
+	return true
+}
+
+// filterIndex ...
+//
+// filterIndex is an inverted index over conditions extracted from segment
+// filters. Every segment is indexed by its most selective condition, and
+// the segments without any are always candidates.
+type filterIndex struct {
+	always *postingSet
+	equals map[string]map[interface{}]*postingSet
+	ranges map[string][]rangeEntry
+	bySeq  map[uint64]*condition
+}
+
+// rangeEntry ...
+type rangeEntry struct {
+	seq       uint64
+	condition *condition
+}
+
+// newFilterIndex ...
+func newFilterIndex() *filterIndex {
+	return &filterIndex{
+		always: &postingSet{},
+		equals: make(map[string]map[interface{}]*postingSet),
+		ranges: make(map[string][]rangeEntry),
+		bySeq:  make(map[uint64]*condition),
+	}
+}
+
+// selective picks condition expected to select the fewest inputs
+func selective(conditions []*condition) *condition {
+	var best *condition
+
+	for _, c := range conditions {
+		switch {
+		case best == nil:
+			best = c
+		case c.isRange() == false && best.isRange():
+			best = c
+		case c.isRange() == false && len(c.values) < len(best.values):
+			best = c
+		case c.isRange() && best.isRange() && c.lower != nil && c.upper != nil:
+			best = c
+		}
+	}
+
+	return best
+}
+
+// add ...
+func (f *filterIndex) add(seq uint64, conditions []*condition) {
+	c := selective(conditions)
+	if c == nil {
+		f.always.add(seq)
+		return
+	}
+
+	f.bySeq[seq] = c
+
+	if c.isRange() {
+		f.ranges[c.name] = append(f.ranges[c.name], rangeEntry{seq: seq, condition: c})
+		return
+	}
+
+	if _, ok := f.equals[c.name]; ok == false {
+		f.equals[c.name] = make(map[interface{}]*postingSet)
+	}
+	for _, v := range c.values {
+		list, ok := f.equals[c.name][v]
+		if ok == false {
+			list = &postingSet{}
+			f.equals[c.name][v] = list
+		}
+		list.add(seq)
+	}
+}
+
+// remove ...
+func (f *filterIndex) remove(seq uint64) {
+	c, ok := f.bySeq[seq]
+	if ok == false {
+		f.always.remove(seq)
+		return
+	}
+
+	delete(f.bySeq, seq)
+
+	if c.isRange() {
+		entries := f.ranges[c.name]
+		for i, e := range entries {
+			if e.seq == seq {
+				entries = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+		if len(entries) == 0 {
+			delete(f.ranges, c.name)
+		} else {
+			f.ranges[c.name] = entries
+		}
+		return
+	}
+
+	for _, v := range c.values {
+		if list := f.equals[c.name][v]; list != nil && list.remove(seq) && list.len() == 0 {
+			delete(f.equals[c.name], v)
+		}
+	}
+	if len(f.equals[c.name]) == 0 {
+		delete(f.equals, c.name)
+	}
+}
+
+// candidates returns sorted segments whose conditions input may satisfy,
+// ok is false when input can not be checked against the index
+func (f *filterIndex) candidates(m map[string]interface{}) ([]uint64, bool) {
+	result := f.always.seqs()
+
+	for name, value := range m {
+		values, hasEquals := f.equals[name]
+		entries, hasRanges := f.ranges[name]
+		if hasEquals == false && hasRanges == false {
+			continue
+		}
+
+		v, err := NormalizeIndexValue(value)
+		if err != nil {
+			return nil, false
+		}
+
+		if hasEquals {
+			result = union(result, values[v].seqs())
+		}
+
+		if hasRanges {
+			matched := []uint64{}
+			for _, e := range entries {
+				if e.condition.contains(v) {
+					matched = append(matched, e.seq)
+				}
+			}
+			sort.Slice(matched, func(i, j int) bool { return matched[i] < matched[j] })
+			result = union(result, matched)
+		}
+	}
+
+	return result, true
+}
@@ -0,0 +1,103 @@
+package segdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func conditionStrings(conditions []*condition) []string {
+	result := []string{}
+	for _, c := range conditions {
+		if c.isRange() == false {
+			result = append(result, fmt.Sprintf("%s in %v", c.name, c.values))
+			continue
+		}
+		s := c.name
+		if c.lower != nil {
+			s += fmt.Sprintf(" >%v %v", c.lower.inclusive, c.lower.value)
+		}
+		if c.upper != nil {
+			s += fmt.Sprintf(" <%v %v", c.upper.inclusive, c.upper.value)
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func Test_analyzeFilters(t *testing.T) {
+	tests := []struct {
+		filters  string
+		expected []string
+	}{
+		{`true`, []string{}},
+		{`country == "US"`, []string{"country in [US]"}},
+		{`"US" == country && age > 18`, []string{"age >false 18", "country in [US]"}},
+		{`country in ["US", "CA"] and age >= 18 and age < 30.5`, []string{"age >true 18 <false 30.5", "country in [US CA]"}},
+		{`age in 18..30`, []string{"age >true 18 <true 30"}},
+		{`-1 < level`, []string{"level >false -1"}},
+		{`country == "US" || country == "CA"`, []string{"country in [US CA]"}},
+		{`country == "US" || platform == "ios"`, []string{}},
+		{`country in ["US", "CA"] && country != "US" && country == "CA"`, []string{"country in [CA]"}},
+		{`country == "US" && country == "CA"`, []string{"country in []"}},
+		{`premium and not trial`, []string{"premium in [true]", "trial in [false]"}},
+		{`not (country == "US")`, []string{}},
+		{`country == nil`, []string{}},
+		{`country == code`, []string{}},
+		{`version == 9007199254740993`, []string{}},
+		{`country ==`, []string{}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, conditionStrings(analyzeFilters(tt.filters)), tt.filters)
+	}
+}
+
+func TestSegdb_QueryPrefilter(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	for id, filters := range map[string]string{
+		"us":      `country == "US"`,
+		"us_ca":   `country in ["US", "CA"] && age >= 18`,
+		"adult":   `age >= 18 && age < 65`,
+		"premium": `premium`,
+		"any":     `true`,
+		"never":   `country == "US" && country == "CA"`,
+	} {
+		assert.NoError(t, s.Add(&Segment{ID: id, Filters: filters}))
+	}
+
+	tests := []struct {
+		params     map[string]interface{}
+		candidates []string
+		matched    []string
+	}{
+		{map[string]interface{}{}, []string{"any"}, []string{"any"}},
+		{map[string]interface{}{"country": "US"}, []string{"any", "us", "us_ca"}, []string{"any", "us"}},
+		{map[string]interface{}{"country": "CA", "age": 20}, []string{"adult", "any", "us_ca"}, []string{"adult", "any", "us_ca"}},
+		{map[string]interface{}{"age": 70.0, "premium": true}, []string{"any", "premium"}, []string{"any", "premium"}},
+		{map[string]interface{}{"age": "20"}, []string{"any"}, []string{"any"}},
+	}
+
+	for _, tt := range tests {
+		seqs, ok := s.filters.candidates(tt.params)
+		assert.True(t, ok)
+		assert.ElementsMatch(t, tt.candidates, s.resolve(seqs), tt.params)
+		assert.ElementsMatch(t, tt.matched, segmentIDs(s.Query(tt.params, -1)), tt.params)
+	}
+
+	// not normalizable values disable pre-filtering
+	_, ok := s.filters.candidates(map[string]interface{}{"country": []string{"US"}})
+	assert.False(t, ok)
+	assert.Equal(t, []string{"any"}, segmentIDs(s.Query(map[string]interface{}{"country": nil}, -1)))
+
+	// removed and replaced segments leave the filter index
+	assert.NoError(t, s.Delete("us"))
+	assert.NoError(t, s.Add(&Segment{ID: "adult", Filters: `country == "DE"`}))
+	seqs, _ := s.filters.candidates(map[string]interface{}{"country": "US", "age": 20})
+	assert.ElementsMatch(t, []string{"any", "us_ca"}, s.resolve(seqs))
+	seqs, _ = s.filters.candidates(map[string]interface{}{"country": "DE"})
+	assert.ElementsMatch(t, []string{"any", "adult"}, s.resolve(seqs))
+}
@@ -0,0 +1,233 @@
+package segdb
+
+import "sort"
+
+// IndexQuery is a boolean expression over index values
+type IndexQuery interface {
+	// eval returns sorted posting list of matched segments
+	eval(x *indexSet) []uint64
+}
+
+// eqQuery ...
+type eqQuery struct {
+	name  string
+	value interface{}
+}
+
+// andQuery ...
+type andQuery []IndexQuery
+
+// orQuery ...
+type orQuery []IndexQuery
+
+// notQuery ...
+type notQuery struct {
+	query IndexQuery
+}
+
+// rangeQuery ...
+type rangeQuery struct {
+	name  string
+	lower *bound
+	upper *bound
+}
+
+// bound of range, only values of the same type as bound value are in range
+type bound struct {
+	value     interface{}
+	inclusive bool
+}
+
+// passLower reports whether v satisfies b as lower bound
+func (b *bound) passLower(v interface{}) bool {
+	c := compareIndexValues(v, b.value)
+	return c > 0 || (c == 0 && b.inclusive)
+}
+
+// passUpper reports whether v satisfies b as upper bound
+func (b *bound) passUpper(v interface{}) bool {
+	c := compareIndexValues(v, b.value)
+	return c < 0 || (c == 0 && b.inclusive)
+}
+
+// Eq matches segments having index value
+func Eq(name string, value interface{}) IndexQuery {
+	return eqQuery{name: name, value: value}
+}
+
+// And matches segments matched by all queries, empty And matches everything.
+// Queries are matched on their own, so ranges over a multi-value index may
+// be matched by different values of it.
+func And(queries ...IndexQuery) IndexQuery {
+	return andQuery(queries)
+}
+
+// Or matches segments matched by any of queries, empty Or matches nothing
+func Or(queries ...IndexQuery) IndexQuery {
+	return orQuery(queries)
+}
+
+// Not matches segments not matched by query
+func Not(query IndexQuery) IndexQuery {
+	return notQuery{query: query}
+}
+
+// In matches segments having any of index values
+func In(name string, values ...interface{}) IndexQuery {
+	queries := make([]IndexQuery, 0, len(values))
+
+	for _, value := range values {
+		queries = append(queries, Eq(name, value))
+	}
+
+	return Or(queries...)
+}
+
+// Gt matches segments with index value greater than value
+func Gt(name string, value interface{}) IndexQuery {
+	return newRangeQuery(name, &bound{value: value}, nil)
+}
+
+// Gte matches segments with index value greater than or equal to value
+func Gte(name string, value interface{}) IndexQuery {
+	return newRangeQuery(name, &bound{value: value, inclusive: true}, nil)
+}
+
+// Lt matches segments with index value less than value
+func Lt(name string, value interface{}) IndexQuery {
+	return newRangeQuery(name, nil, &bound{value: value})
+}
+
+// Lte matches segments with index value less than or equal to value
+func Lte(name string, value interface{}) IndexQuery {
+	return newRangeQuery(name, nil, &bound{value: value, inclusive: true})
+}
+
+// Between matches segments with index value in [from, to) range
+func Between(name string, from interface{}, to interface{}) IndexQuery {
+	return newRangeQuery(name, &bound{value: from, inclusive: true}, &bound{value: to})
+}
+
+// newRangeQuery normalizes bound values, range with invalid bound matches nothing
+func newRangeQuery(name string, lower *bound, upper *bound) IndexQuery {
+	for _, b := range []*bound{lower, upper} {
+		if b == nil {
+			continue
+		}
+		v, err := NormalizeIndexValue(b.value)
+		if err != nil {
+			return Or()
+		}
+		b.value = v
+	}
+
+	if lower != nil && upper != nil && indexValueRank(lower.value) != indexValueRank(upper.value) {
+		return Or()
+	}
+
+	return rangeQuery{name: name, lower: lower, upper: upper}
+}
+
+// IndexesQuery makes And of Eq for every index value
+func IndexesQuery(indexes map[string]interface{}) IndexQuery {
+	queries := make([]IndexQuery, 0, len(indexes))
+
+	for name, value := range indexes {
+		queries = append(queries, Eq(name, value))
+	}
+
+	return And(queries...)
+}
+
+func (q eqQuery) eval(x *indexSet) []uint64 {
+	return x.lookup(q.name, q.value)
+}
+
+func (q rangeQuery) eval(x *indexSet) []uint64 {
+	return x.scan(q)
+}
+
+// rank returns type rank of values in range
+func (q rangeQuery) rank() int {
+	if q.lower != nil {
+		return indexValueRank(q.lower.value)
+	}
+	return indexValueRank(q.upper.value)
+}
+
+// intersect narrows range down to the intersection with other range,
+// ranges over values of different types do not intersect
+func (q rangeQuery) intersect(other rangeQuery) (rangeQuery, bool) {
+	if q.rank() != other.rank() {
+		return q, false
+	}
+
+	lower, upper := q.lower, q.upper
+
+	if other.lower != nil {
+		if lower == nil || other.lower.passLower(lower.value) == false {
+			lower = other.lower
+		}
+	}
+
+	if other.upper != nil {
+		if upper == nil || other.upper.passUpper(upper.value) == false {
+			upper = other.upper
+		}
+	}
+
+	return rangeQuery{name: q.name, lower: lower, upper: upper}, true
+}
+
+// eval intersects positive operands starting from the shortest one
+// and subtracts negated operands from the result. Ranges over the same
+// index are not merged, values of multi-value index match them one by one.
+func (q andQuery) eval(x *indexSet) []uint64 {
+	positive := make([][]uint64, 0, len(q))
+	negative := make([][]uint64, 0)
+
+	for _, query := range q {
+		if not, ok := query.(notQuery); ok == true {
+			negative = append(negative, not.query.eval(x))
+			continue
+		}
+		positive = append(positive, query.eval(x))
+	}
+
+	if len(positive) == 0 {
+		positive = append(positive, x.all.seqs)
+	}
+
+	sort.Slice(positive, func(i, j int) bool { return len(positive[i]) < len(positive[j]) })
+
+	result := positive[0]
+	for _, list := range positive[1:] {
+		if len(result) == 0 {
+			break
+		}
+		result = intersect(result, list)
+	}
+
+	for _, list := range negative {
+		if len(result) == 0 {
+			break
+		}
+		result = difference(result, list)
+	}
+
+	return result
+}
+
+func (q orQuery) eval(x *indexSet) []uint64 {
+	result := []uint64{}
+
+	for _, query := range q {
+		result = union(result, query.eval(x))
+	}
+
+	return result
+}
+
+func (q notQuery) eval(x *indexSet) []uint64 {
+	return difference(x.all.seqs, q.query.eval(x))
+}
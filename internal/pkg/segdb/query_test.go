@@ -0,0 +1,151 @@
+package segdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getQuerySegDb(t *testing.T) *Segdb {
+	s := getSegDb()
+
+	for i, indexes := range []Indexes{
+		{"country": "US", "platform": "ios"},
+		{"country": "US", "platform": "android"},
+		{"country": "CA", "platform": "ios"},
+		{"country": "DE"},
+	} {
+		assert.NoError(t, s.Add(&Segment{
+			ID:      "seg" + string(rune('1'+i)),
+			Filters: "true",
+			Indexes: indexes,
+		}))
+	}
+
+	return s
+}
+
+func segmentIDs(segments []*Segment) []string {
+	ids := []string{}
+	for _, segment := range segments {
+		ids = append(ids, segment.ID)
+	}
+	return ids
+}
+
+func TestIndexQuery(t *testing.T) {
+	s := getQuerySegDb(t)
+	defer clearStorage()
+
+	tests := []struct {
+		query    IndexQuery
+		expected []string
+	}{
+		{And(), []string{"seg1", "seg2", "seg3", "seg4"}},
+		{Eq("country", "US"), []string{"seg1", "seg2"}},
+		{And(Eq("country", "US"), Eq("platform", "ios")), []string{"seg1"}},
+		{Or(Eq("country", "US"), Eq("platform", "ios")), []string{"seg1", "seg2", "seg3"}},
+		{Not(Eq("country", "US")), []string{"seg3", "seg4"}},
+		{And(Eq("platform", "ios"), Not(Eq("country", "US"))), []string{"seg3"}},
+		{And(Not(Eq("platform", "ios"))), []string{"seg2", "seg4"}},
+		{Or(And(Eq("country", "US"), Eq("platform", "android")), Eq("country", "DE")), []string{"seg2", "seg4"}},
+		{Eq("country", "FR"), []string{}},
+		{Eq("unknown", "US"), []string{}},
+		{Or(), []string{}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, segmentIDs(s.ListWhere(tt.query, -1, -1)))
+	}
+}
+
+func TestSegdb_ListIntersectsIndexes(t *testing.T) {
+	s := getQuerySegDb(t)
+	defer clearStorage()
+
+	found := s.List(map[string]interface{}{"country": "US", "platform": "ios"}, -1, -1)
+	assert.Equal(t, []string{"seg1"}, segmentIDs(found))
+
+	found = s.List(map[string]interface{}{"country": "US"}, 1, 1)
+	assert.Equal(t, []string{"seg2"}, segmentIDs(found))
+}
+
+func TestSegdb_QueryWhere(t *testing.T) {
+	s := getQuerySegDb(t)
+	defer clearStorage()
+
+	found := s.QueryWhere(Not(Eq("country", "US")), map[string]interface{}{"platform": "ios"}, 0)
+	assert.Equal(t, []string{"seg3"}, segmentIDs(found))
+
+	found = s.QueryWhere(nil, map[string]interface{}{"country": "US"}, 0)
+	assert.Equal(t, []string{"seg1", "seg2"}, segmentIDs(found))
+}
+
+func TestIndexQuery_Range(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	for i, indexes := range []Indexes{
+		{"age": 17, "countries": []string{"US", "CA"}},
+		{"age": 18, "countries": []string{"US"}},
+		{"age": 25.5, "countries": []interface{}{}},
+		{"age": 30, "countries": []string{"DE", "CA"}},
+		{"age": "unknown"},
+	} {
+		assert.NoError(t, s.Add(&Segment{
+			ID:      "seg" + string(rune('1'+i)),
+			Filters: "true",
+			Indexes: indexes,
+		}))
+	}
+
+	tests := []struct {
+		query    IndexQuery
+		expected []string
+	}{
+		{Gte("age", 18), []string{"seg2", "seg3", "seg4"}},
+		{Gt("age", 18), []string{"seg3", "seg4"}},
+		{Lt("age", 18.5), []string{"seg1", "seg2"}},
+		{Lte("age", 30), []string{"seg1", "seg2", "seg3", "seg4"}},
+		{And(Gte("age", 18), Lt("age", 30)), []string{"seg2", "seg3"}},
+		{And(Gte("age", 18), Gte("age", 20), Lt("age", 40), Lte("age", 30)), []string{"seg3", "seg4"}},
+		{And(Gte("age", 18), Lt("age", "z")), []string{}},
+		{Between("age", 18, 30), []string{"seg2", "seg3"}},
+		{Gte("age", "a"), []string{"seg5"}},
+		{Gt("age", nil), []string{}},
+		{Eq("countries", "CA"), []string{"seg1", "seg4"}},
+		{In("countries", "US", "DE"), []string{"seg1", "seg2", "seg4"}},
+		{Gte("countries", "A"), []string{"seg1", "seg2", "seg4"}},
+		{And(Eq("countries", "US"), Not(Eq("countries", "CA"))), []string{"seg2"}},
+		{And(In("age", 17, 30), Eq("countries", "CA")), []string{"seg1", "seg4"}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, segmentIDs(s.ListWhere(tt.query, -1, -1)))
+	}
+
+	assert.NoError(t, s.Delete("seg4"))
+	assert.Equal(t, []string{"seg1"}, segmentIDs(s.ListWhere(Eq("countries", "CA"), -1, -1)))
+	assert.Equal(t, []string{"seg3"}, segmentIDs(s.ListWhere(Gt("age", 18), -1, -1)))
+	assert.Equal(t, []interface{}{"CA", "US"}, s.values["countries"])
+}
+
+func TestIndexQuery_MultiValueRange(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true", Indexes: Indexes{"ages": []int{10, 40}}}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg2", Filters: "true", Indexes: Indexes{"ages": []int{20}}}))
+
+	// every range is matched by any value on its own, however queries nest
+	for _, query := range []IndexQuery{
+		And(Gte("ages", 18), Lt("ages", 30)),
+		And(Gte("ages", 18), And(Lt("ages", 30))),
+		And(And(Gte("ages", 18)), And(Lt("ages", 30))),
+	} {
+		assert.Equal(t, []string{"seg1", "seg2"}, segmentIDs(s.ListWhere(query, -1, -1)))
+	}
+
+	// a single range is matched by one value
+	assert.Equal(t, []string{"seg2"}, segmentIDs(s.ListWhere(Between("ages", 18, 30), -1, -1)))
+}
@@ -0,0 +1,287 @@
+package segdb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antonmedv/expr"
+)
+
+// schemaMeta name of schema metadata in storage
+const schemaMeta = "schema"
+
+var (
+	// ErrSchemaType unknown type of schema field
+	ErrSchemaType = errors.New("unknown schema type")
+	// ErrStrict filters do not type-check against schema
+	ErrStrict = errors.New("filters do not match schema")
+	// ErrUnknownField input has field not declared by schema
+	ErrUnknownField = errors.New("unknown field")
+	// ErrRequiredField input misses required field
+	ErrRequiredField = errors.New("required field is missing")
+	// ErrFieldType input value does not match type of field
+	ErrFieldType = errors.New("value does not match field type")
+	// ErrEnum input value is not one of enum values of field
+	ErrEnum = errors.New("value is not one of enum values")
+)
+
+// FieldError input field does not match schema
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+// Error ...
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field %q: %v", e.Field, e.Err)
+}
+
+// Unwrap ...
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Field of input schema
+type Field struct {
+	// Type is one of string, int, float, bool, time, list, map or any
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+	// Enum lists allowed values of string, int, float, bool and time fields
+	Enum []interface{} `json:"enum,omitempty"`
+}
+
+// Schema declares fields of query input by name. Filters of segments are
+// type-checked against it and input with undeclared fields is rejected.
+type Schema map[string]Field
+
+// schemaTypes sample values used to type-check filters. A pointer to
+// interface lets checker accept any use of a field of type any.
+var schemaTypes = map[string]interface{}{
+	"string": "",
+	"int":    0,
+	"float":  0.0,
+	"bool":   false,
+	"time":   time.Time{},
+	"list":   []interface{}{},
+	"map":    map[string]interface{}{},
+	"any":    new(interface{}),
+}
+
+// Normalize validates field types and normalizes enum values
+func (s Schema) Normalize() (Schema, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	normalized := make(Schema, len(s))
+
+	for name, field := range s {
+		if _, ok := schemaTypes[field.Type]; ok == false {
+			return nil, fmt.Errorf("%w %q of field %q", ErrSchemaType, field.Type, name)
+		}
+
+		if len(field.Enum) > 0 {
+			enum := make([]interface{}, 0, len(field.Enum))
+			for _, v := range field.Enum {
+				v, err := field.enumValue(v)
+				if err != nil {
+					return nil, &FieldError{Field: name, Err: err}
+				}
+				enum = append(enum, v)
+			}
+			field.Enum = enum
+		}
+
+		normalized[name] = field
+	}
+
+	return normalized, nil
+}
+
+// enumValue normalizes enum value, times may be given as RFC3339 strings
+func (f Field) enumValue(v interface{}) (interface{}, error) {
+	switch f.Type {
+	case "string", "int", "float", "bool":
+	case "time":
+		if str, ok := v.(string); ok == true {
+			t, err := time.Parse(time.RFC3339Nano, str)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrFieldType, err)
+			}
+			v = t
+		}
+	default:
+		return nil, fmt.Errorf("%w: enum of %s", ErrFieldType, f.Type)
+	}
+
+	if err := f.checkType(v); err != nil {
+		return nil, err
+	}
+
+	return NormalizeIndexValue(v)
+}
+
+// env builds expr environment of schema along with functions, fields shadow
+// functions of the same name as input params do when filters are run
+func (s Schema) env(functions *functionSet) map[string]interface{} {
+	env := functions.types()
+
+	for name, field := range s {
+		env[name] = schemaTypes[field.Type]
+	}
+
+	return env
+}
+
+// check type-checks filters against schema, filters may use declared
+// fields and given functions only and must return a boolean
+func (s Schema) check(filters string, functions *functionSet) error {
+	if _, err := expr.Compile(filters, expr.Env(s.env(functions)), expr.AsBool()); err != nil {
+		return fmt.Errorf("%w: %v", ErrStrict, err)
+	}
+
+	return nil
+}
+
+// Validate checks input has declared fields only, all required fields
+// are present and values match types and enums of fields
+func (s Schema) Validate(m map[string]interface{}) error {
+	for name, value := range m {
+		field, ok := s[name]
+		if ok == false {
+			return &FieldError{Field: name, Err: ErrUnknownField}
+		}
+		if err := field.check(value); err != nil {
+			return &FieldError{Field: name, Err: err}
+		}
+	}
+
+	for name, field := range s {
+		if _, ok := m[name]; ok == false && field.Required {
+			return &FieldError{Field: name, Err: ErrRequiredField}
+		}
+	}
+
+	return nil
+}
+
+// check ...
+func (f Field) check(value interface{}) error {
+	if value == nil {
+		if f.Required {
+			return ErrRequiredField
+		}
+		return nil
+	}
+
+	if err := f.checkType(value); err != nil {
+		return err
+	}
+
+	if len(f.Enum) == 0 {
+		return nil
+	}
+
+	v, err := NormalizeIndexValue(value)
+	if err != nil || indexOf(f.Enum, v) < 0 {
+		return ErrEnum
+	}
+
+	return nil
+}
+
+// checkType ...
+func (f Field) checkType(value interface{}) error {
+	rv := reflect.ValueOf(value)
+	ok := true
+
+	switch f.Type {
+	case "string":
+		ok = rv.Kind() == reflect.String
+	case "int":
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		case reflect.Float32, reflect.Float64:
+			// numbers decoded from JSON are floats
+			ok = rv.Float() == math.Trunc(rv.Float()) && math.IsInf(rv.Float(), 0) == false
+		default:
+			ok = false
+		}
+	case "float":
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+		default:
+			ok = false
+		}
+	case "bool":
+		ok = rv.Kind() == reflect.Bool
+	case "time":
+		_, ok = value.(time.Time)
+	case "list":
+		ok = rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array
+	case "map":
+		ok = rv.Kind() == reflect.Map
+	}
+
+	if ok == false {
+		return fmt.Errorf("%w: %T is not %s", ErrFieldType, value, f.Type)
+	}
+
+	return nil
+}
+
+// ParseValue parses query string value by type of field, values of
+// undeclared fields are parsed like index values
+func (s Schema) ParseValue(name string, raw string) (interface{}, error) {
+	field, ok := s[name]
+	if ok == false {
+		return ParseIndexValue(raw), nil
+	}
+
+	var value interface{}
+	var err error
+
+	switch field.Type {
+	case "string":
+		value = raw
+	case "int":
+		value, err = strconv.ParseInt(raw, 10, 64)
+	case "float":
+		value, err = strconv.ParseFloat(raw, 64)
+	case "bool":
+		value, err = strconv.ParseBool(raw)
+	case "time":
+		value, err = time.Parse(time.RFC3339Nano, raw)
+	case "list":
+		list := []interface{}{}
+		for _, item := range strings.Split(raw, ",") {
+			list = append(list, ParseIndexValue(item))
+		}
+		value = list
+	case "map":
+		err = fmt.Errorf("%w: map can not be passed in query string", ErrFieldType)
+	default:
+		value = ParseIndexValue(raw)
+	}
+
+	if err != nil {
+		if errors.Is(err, ErrFieldType) == false {
+			err = fmt.Errorf("%w: %v", ErrFieldType, err)
+		}
+		return nil, &FieldError{Field: name, Err: err}
+	}
+
+	if err := field.check(value); err != nil {
+		return nil, &FieldError{Field: name, Err: err}
+	}
+
+	return value, nil
+}
@@ -0,0 +1,154 @@
+package segdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getSchema() Schema {
+	return Schema{
+		"country": {Type: "string", Required: true, Enum: []interface{}{"US", "CA"}},
+		"level":   {Type: "int", Enum: []interface{}{1.0, 2}},
+		"score":   {Type: "float"},
+		"tags":    {Type: "list"},
+		"born":    {Type: "time"},
+		"user":    {Type: "any"},
+	}
+}
+
+func TestSchema_Normalize(t *testing.T) {
+	schema, err := getSchema().Normalize()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(1), int64(2)}, schema["level"].Enum)
+
+	schema, err = Schema{"born": {Type: "time", Enum: []interface{}{"2020-01-01T00:00:00Z"}}}.Normalize()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, schema["born"].Enum)
+
+	_, err = Schema{"level": {Type: "number"}}.Normalize()
+	assert.True(t, errors.Is(err, ErrSchemaType))
+
+	_, err = Schema{"level": {Type: "int", Enum: []interface{}{"one"}}}.Normalize()
+	assert.True(t, errors.Is(err, ErrFieldType))
+
+	_, err = Schema{"tags": {Type: "list", Enum: []interface{}{"a"}}}.Normalize()
+	assert.True(t, errors.Is(err, ErrFieldType))
+}
+
+func TestSchema_check(t *testing.T) {
+	schema := getSchema()
+
+	assert.NoError(t, schema.check(`country == "US" && level > 1 && score < 0.5`, nil))
+	assert.NoError(t, schema.check(`"vip" in tags && user.premium`, nil))
+	assert.Error(t, schema.check(`levle > 1`, nil))
+	assert.Error(t, schema.check(`country > 1`, nil))
+	assert.True(t, errors.Is(schema.check(`level + 1`, nil), ErrStrict))
+
+	// functions are type-checked as well
+	assert.NoError(t, schema.check(`semver_compare(country, "1.2.0") >= 0`, newStdlib()))
+	assert.Error(t, schema.check(`semver_compare(level, "1.2.0") >= 0`, newStdlib()))
+	assert.Error(t, schema.check(`semver_compare(country, "1.2.0") >= 0`, nil))
+}
+
+func TestSchema_Validate(t *testing.T) {
+	schema, _ := getSchema().Normalize()
+
+	assert.NoError(t, schema.Validate(map[string]interface{}{"country": "US", "level": 2, "tags": []string{"a"}}))
+	assert.NoError(t, schema.Validate(map[string]interface{}{"country": "CA", "level": 1.0, "score": 1, "user": nil}))
+
+	tests := []struct {
+		m     map[string]interface{}
+		field string
+		err   error
+	}{
+		{map[string]interface{}{"level": 1}, "country", ErrRequiredField},
+		{map[string]interface{}{"country": nil}, "country", ErrRequiredField},
+		{map[string]interface{}{"country": "US", "age": 1}, "age", ErrUnknownField},
+		{map[string]interface{}{"country": "DE"}, "country", ErrEnum},
+		{map[string]interface{}{"country": "US", "level": 1.5}, "level", ErrFieldType},
+		{map[string]interface{}{"country": "US", "level": 3}, "level", ErrEnum},
+		{map[string]interface{}{"country": "US", "born": "2020-01-01"}, "born", ErrFieldType},
+	}
+
+	for _, tt := range tests {
+		err := schema.Validate(tt.m)
+		fe := &FieldError{}
+		assert.True(t, errors.As(err, &fe), tt.m)
+		assert.Equal(t, tt.field, fe.Field)
+		assert.True(t, errors.Is(err, tt.err), err)
+	}
+}
+
+func TestSchema_ParseValue(t *testing.T) {
+	schema, _ := getSchema().Normalize()
+
+	tests := []struct {
+		name     string
+		raw      string
+		expected interface{}
+		err      error
+	}{
+		{"country", "US", "US", nil},
+		{"country", "DE", nil, ErrEnum},
+		{"level", "2", int64(2), nil},
+		{"level", "2.0", nil, ErrFieldType},
+		{"score", "1", float64(1), nil},
+		{"tags", "a,1", []interface{}{"a", int64(1)}, nil},
+		{"born", "2020-01-01T00:00:00Z", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), nil},
+		{"user", "true", true, nil},
+		{"unknown", "1", int64(1), nil},
+	}
+
+	for _, tt := range tests {
+		value, err := schema.ParseValue(tt.name, tt.raw)
+		if tt.err != nil {
+			assert.True(t, errors.Is(err, tt.err), tt.raw)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, value)
+	}
+}
+
+func TestSegdb_SetSchema(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: `level > 1`}))
+
+	assert.True(t, errors.Is(s.SetSchema(Schema{"level": {Type: "number"}}), ErrSchemaType))
+	assert.True(t, errors.Is(s.SetSchema(Schema{"level": {Type: "string"}}), ErrStrict))
+	assert.Nil(t, s.Schema())
+
+	assert.NoError(t, s.SetSchema(Schema{"level": {Type: "int"}}))
+
+	err := s.Add(&Segment{ID: "seg2", Filters: `levle > 1`})
+	assert.True(t, errors.Is(err, ErrStrict))
+	_, err = s.Get("seg2")
+	assert.Equal(t, ErrNotFound, err)
+
+	err = s.Publish([]*Segment{{ID: "seg1", Filters: `level > 1`}, {ID: "seg2", Filters: `level == "1"`}})
+	assert.True(t, errors.Is(err, ErrStrict))
+
+	// input is validated
+	segments, err := s.Find(&QueryOptions{Context: map[string]interface{}{"level": 2}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg1"}, segmentIDs(segments))
+
+	_, err = s.Find(&QueryOptions{Context: map[string]interface{}{"level": 2, "age": 1}})
+	assert.True(t, errors.Is(err, ErrUnknownField))
+	assert.Equal(t, PlanRejected, s.Explain(map[string]interface{}{"level": "2"}, -1).Plan)
+
+	// schema is stored alongside segments
+	loaded := getSegDb()
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, Schema{"level": {Type: "int"}}, loaded.Schema())
+
+	assert.NoError(t, s.SetSchema(nil))
+	assert.NoError(t, s.Add(&Segment{ID: "seg2", Filters: `levle > 1`}))
+	assert.NoError(t, loaded.Load())
+	assert.Nil(t, loaded.Schema())
+}
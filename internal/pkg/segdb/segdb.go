@@ -1,7 +1,13 @@
 package segdb
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/antonmedv/expr"
@@ -12,122 +18,587 @@ var (
 	ErrNotFound = errors.New("not found")
 	// ErrReservedIndex reserved index
 	ErrReservedIndex = errors.New("reserved index")
+	// ErrEmptyID segment without id
+	ErrEmptyID = errors.New("empty id")
+	// ErrDuplicateID segment id occurs more than once in a batch
+	ErrDuplicateID = errors.New("duplicate id")
+	// ErrConflict stored segment is not of expected version
+	ErrConflict = errors.New("version conflict")
+	// ErrFilters filters of segment do not compile
+	ErrFilters = errors.New("invalid filters")
 )
 
 // Segdb ...
+//
+// Segdb is safe for concurrent use. Readers share mu, writers are serialized
+// by wmu and hold mu exclusively only while mutating in-memory state, so
+// storage IO and filter compilation never block readers. Publish and Load
+// build a complete new set of segments and indexes aside and swap it in at once.
 type Segdb struct {
-	storage  StorageInterface
-	indexes  map[string]map[interface{}][]string
+	storage StorageInterface
+
+	wmu sync.Mutex
+	mu  sync.RWMutex
+
 	segments map[string]*Segment
-	idIndex  []string
+	*indexSet
+
+	policy   ErrorPolicy
+	schema   Schema
+	errStats *errorStats
+	workers  int
+
+	// historySize and auditSize are changed by writers only
+	historySize int
+	auditSize   int
+
+	// clock tells time segments are active at and versions are stamped with
+	clock func() time.Time
+
+	// fragments and functions are changed by writers only
+	fragments *fragmentSet
+	functions *functionSet
+
+	// generation changes whenever indexes are rebuilt and
+	// sequence numbers of segments change
+	generation uint64
 }
 
 // New ...
 func New(storage StorageInterface) *Segdb {
-	return &Segdb{
-		storage:  storage,
-		indexes:  make(map[string]map[interface{}][]string),
-		segments: make(map[string]*Segment),
-		idIndex:  []string{},
+	s := &Segdb{
+		storage:   storage,
+		segments:  make(map[string]*Segment),
+		indexSet:  newIndexSet(),
+		errStats:  newErrorStats(),
+		workers:   1,
+		auditSize: DefaultAuditSize,
+		clock:     time.Now,
+		functions: newStdlib(),
+		// cursors of previous runs expire
+		generation: uint64(time.Now().UnixNano()),
+	}
+
+	// segments evaluating filters on their own follow SetClock too
+	s.functions.clock = s.now
+
+	return s
+}
+
+// SetErrorPolicy sets what Query does when filters fail to evaluate
+func (s *Segdb) SetErrorPolicy(policy ErrorPolicy) {
+	s.mu.Lock()
+	s.policy = policy
+	s.mu.Unlock()
+}
+
+// SetClock sets source of current time, time.Now by default
+func (s *Segdb) SetClock(clock func() time.Time) {
+	s.mu.Lock()
+	s.clock = clock
+	s.mu.Unlock()
+}
+
+// now ...
+func (s *Segdb) now() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.clock()
+}
+
+// SetSchema declares input schema and stores it alongside segments. Filters
+// of all segments have to type-check against it, so do filters of segments
+// added later, and queries with input not matching schema are rejected.
+// Fields may not be named as functions. Nil schema removes it.
+func (s *Segdb) SetSchema(schema Schema) error {
+	schema, err := schema.Normalize()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if schema != nil {
+		if err := s.functions.shadowed(schema); err != nil {
+			return err
+		}
+
+		s.mu.RLock()
+		segments := s.getAll(s.order())
+		s.mu.RUnlock()
+
+		for _, segment := range segments {
+			if err := schema.check(segment.source, s.functions); err != nil {
+				return fmt.Errorf("segment %q: %w", segment.ID, err)
+			}
+		}
+	}
+
+	if err := s.storage.SaveMeta(schemaMeta, data); err != nil {
+		return err
 	}
+
+	s.mu.Lock()
+	s.schema = schema
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Schema returns declared input schema, nil when there is none
+func (s *Segdb) Schema() Schema {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.schema
+}
+
+// FilterErrors returns filter evaluation errors counted by segment.
+// Segments skipped by pre-filtering are not evaluated and count nothing,
+// strict mode catches unknown variables in filters up front.
+func (s *Segdb) FilterErrors() []FilterErrors {
+	return s.errStats.list()
 }
 
 // Query ...
 func (s *Segdb) Query(m map[string]interface{}, limit int) []*Segment {
-	segments := []*Segment{}
-	indexes := map[string]interface{}{}
+	return s.QueryWhere(nil, m, limit)
+}
 
-	// find indexes in map
-	for idxName, idxValue := range m {
-		if _, ok := s.indexes[idxName]; ok == true {
-			indexes[idxName] = idxValue
-			delete(m, idxName)
+// QueryWhere matches m against segments selected by where query, or all
+// segments when where is nil. Values of m named as indexes narrow the
+// selection down like Eq queries and are not passed to filters.
+// Only segments whose filter conditions params may satisfy are matched.
+// Nothing is matched when filters fail under ErrorPolicyFail.
+func (s *Segdb) QueryWhere(where IndexQuery, m map[string]interface{}, limit int) []*Segment {
+	segments, err := s.Find(&QueryOptions{Where: where, Context: m, Limit: limit})
+	if err != nil {
+		return []*Segment{}
+	}
+
+	return segments
+}
+
+// QueryOptions ...
+type QueryOptions struct {
+	// Where selects segments by index values, nil selects all
+	Where IndexQuery
+	// Context is matched against filters, values named as indexes
+	// are used like Eq queries instead
+	Context map[string]interface{}
+	// Limit of matched segments, unlimited when less than 1
+	Limit int
+	// Offset number of matched segments to skip
+	Offset int
+	// Sort order of segments, SortPriority by default
+	Sort string
+	// Unordered lets parallel evaluation return segments in the order they
+	// are found, so it stops as soon as enough of them are found
+	Unordered bool
+	// Cursor of page to continue with, see FindPage
+	Cursor string
+}
+
+// Sort orders of query results
+const (
+	// SortPriority by priority, higher first, then in the order
+	// segments have been added
+	SortPriority = "priority"
+	// SortInserted in the order segments have been added
+	SortInserted = "inserted"
+	// SortID by segment id
+	SortID = "id"
+)
+
+// ErrSortOrder unknown sort order
+var ErrSortOrder = errors.New("unknown sort order")
+
+// Find is QueryWhere with paging and sorting options. It fails when the
+// context does not match schema or filters fail under ErrorPolicyFail.
+// Segments are ordered before they are matched, so with the default
+// order limit 1 gives the matched segment of the highest priority.
+func (s *Segdb) Find(q *QueryOptions) ([]*Segment, error) {
+	_, segments, err := s.find(q)
+	return segments, err
+}
+
+// find ...
+func (s *Segdb) find(q *QueryOptions) (*queryPlan, []*Segment, error) {
+	if err := checkSort(q.Sort); err != nil {
+		return nil, nil, err
+	}
+
+	c, err := decodeCursor(q.Cursor, queryOrder(q.Sort))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, err := s.plan(q.Where, q.Context)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.sort(q.Sort)
+
+	if c != nil {
+		if c.Generation != p.generation {
+			return nil, nil, ErrCursorExpired
 		}
+		i := p.ranked(q.Sort).after(c)
+		p.candidates, p.seqs = p.candidates[i:], p.seqs[i:]
+	}
+
+	var segments []*Segment
+	if p.workers > 1 && len(p.candidates) > parallelChunk {
+		segments, err = s.matchParallel(p, q.Limit, q.Offset, p.workers, q.Unordered == false)
+	} else {
+		segments, err = s.match(p, q.Limit, q.Offset)
+	}
+
+	return p, segments, err
+}
+
+// queryOrder is sort order of query, SortPriority by default
+func queryOrder(order string) string {
+	if order == "" {
+		return SortPriority
 	}
+	return order
+}
+
+// checkSort ...
+func checkSort(order string) error {
+	switch order {
+	case "", SortPriority, SortInserted, SortID:
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrSortOrder, order)
+}
+
+// match evaluates sorted candidates of plan in order skipping offset matches
+func (s *Segdb) match(p *queryPlan, limit int, offset int) ([]*Segment, error) {
+	segments := []*Segment{}
 
 	// unlimited
-	if limit < 1 || limit > len(s.segments) {
-		limit = len(s.segments)
+	if limit < 1 || limit > p.total {
+		limit = p.total
 	}
 
-	// match segment to map and return EXIT flag in case when limit has been achived
-	match := func(segment *Segment) bool {
-		if segment.Match(m) {
-			segments = append(segments, segment)
-			if len(segments) >= limit {
-				return true
+	for _, segment := range p.candidates {
+		if len(segments) >= limit {
+			break
+		}
+
+		matched, err := segment.eval(p.params)
+		if err != nil && p.policy != ErrorPolicyIgnore {
+			s.errStats.add(segment.ID, err)
+			if p.policy == ErrorPolicyFail {
+				return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
 			}
 		}
-		return false
+
+		if matched == false {
+			continue
+		}
+
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		segments = append(segments, segment)
 	}
 
-	if len(indexes) > 0 {
-		for _, segment := range s.List(indexes, -1, -1) {
-			if match(segment) == true {
-				return segments
-			}
+	return segments, nil
+}
+
+// queryPlan candidate segments of query and params to match them with
+type queryPlan struct {
+	candidates []*Segment
+	seqs       []uint64
+	generation uint64
+	params     map[string]interface{}
+	total      int
+	indexed    int
+	indexUsed  bool
+	prefilter  bool
+	policy     ErrorPolicy
+	workers    int
+}
+
+// sort orders candidates, they are in SortInserted order initially
+func (p *queryPlan) sort(order string) {
+	p.ranked(order).sort()
+}
+
+// ranked is view of candidates in order
+func (p *queryPlan) ranked(order string) *ranked {
+	return &ranked{segments: p.candidates, seqs: p.seqs, order: queryOrder(order)}
+}
+
+// plan selects candidate segments of query and validates params against
+// schema. Segments are never modified once added, so they are safe to match
+// after the lock has been released.
+func (s *Segdb) plan(where IndexQuery, m map[string]interface{}) (*queryPlan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.planLocked(where, m, nil)
+}
+
+// planLocked is plan for callers holding mu. Index lookups are shared
+// through cache by queries with the same index values, if cache is given.
+func (s *Segdb) planLocked(where IndexQuery, m map[string]interface{}, cache map[string][]uint64) (*queryPlan, error) {
+	queries := []IndexQuery{}
+	p := &queryPlan{params: make(map[string]interface{}, len(m))}
+
+	// empty And selects everything, no need to evaluate it
+	if q, ok := where.(andQuery); where != nil && (ok == false || len(q) > 0) {
+		queries = append(queries, where)
+	}
+
+	// find indexes in map
+	names := []string{}
+	for idxName, idxValue := range m {
+		if _, ok := s.indexes[idxName]; ok == true {
+			queries = append(queries, Eq(idxName, idxValue))
+			names = append(names, idxName)
+		} else {
+			p.params[idxName] = idxValue
 		}
-	} else {
-		for _, segment := range s.segments {
-			if match(segment) == true {
-				return segments
-			}
+	}
+
+	if s.schema != nil {
+		if err := s.schema.Validate(p.params); err != nil {
+			return nil, err
 		}
 	}
 
-	return segments
+	p.total = len(s.segments)
+	p.policy = s.policy
+	p.workers = s.workers
+	p.generation = s.generation
+
+	seqs := s.all.seqs
+	if len(queries) > 0 {
+		seqs = s.lookupCached(And(queries...), names, m, cache)
+		p.indexUsed = true
+	}
+	seqs = s.live(seqs)
+	p.indexed = len(seqs)
+
+	// skip segments whose filters can not match params anyway
+	if filtered, ok := s.filters.candidates(p.params); ok == true {
+		seqs = intersect(seqs, filtered)
+		p.prefilter = len(seqs) < p.indexed
+	}
+
+	r := s.rank(seqs, "", s.defaultVisibility(), 0)
+	p.candidates, p.seqs = r.segments, r.seqs
+
+	// filters call functions through params
+	p.params = s.functions.env(p.params, s.clock())
+
+	return p, nil
 }
 
-// Publish ...
-func (s *Segdb) Publish(m []*Segment) error {
-	processed := make(map[string]*Segment, len(m))
-	if err := s.storage.Clear(); err != nil {
-		return err
+// lookupCached evaluates query unless cache already has result for
+// the same values of indexes named in m
+func (s *Segdb) lookupCached(q IndexQuery, names []string, m map[string]interface{}, cache map[string][]uint64) []uint64 {
+	if cache == nil {
+		return q.eval(s.indexSet)
+	}
+
+	key := indexKey(names, m)
+	seqs, ok := cache[key]
+	if ok == false {
+		seqs = q.eval(s.indexSet)
+		cache[key] = seqs
 	}
 
-	for _, segment := range m {
-		program, err := expr.Compile(segment.Filters)
+	return seqs
+}
+
+// indexKey identifies index values of m by names
+func indexKey(names []string, m map[string]interface{}) string {
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		value, err := NormalizeIndexValue(m[name])
 		if err != nil {
-			if err := s.storage.Clear(); err != nil {
-				return err
-			}
-			return err
+			value = m[name]
 		}
-		segment.Program = program
+		fmt.Fprintf(&b, "%q=%T:%v;", name, value, value)
+	}
 
-		if err := s.storage.Save(segment); err != nil {
-			if err := s.storage.Clear(); err != nil {
-				return err
-			}
-			return err
+	return b.String()
+}
+
+// Publish ...
+//
+// Publish replaces all segments. Segments are compiled, validated and
+// staged by storage as a new generation; storage and memory are switched
+// to it only when everything succeeded, otherwise the previous generation
+// stays intact.
+func (s *Segdb) Publish(m []*Segment) error {
+	return s.publish(sliceSource(m), s.stamp)
+}
+
+// PublishFrom is Publish reading segments one at a time from source, so
+// input is not held in memory as a whole. Other writers wait until source
+// is exhausted.
+func (s *Segdb) PublishFrom(source SegmentSource) error {
+	return s.publish(source, s.stamp)
+}
+
+// publish stages segments read from source as a new generation and makes
+// it current, stamp versions the staged segments
+func (s *Segdb) publish(source SegmentSource, stamp stampFunc) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.RLock()
+	current := s.segments
+	s.mu.RUnlock()
+
+	processed := map[string]*Segment{}
+	indexes := newIndexSet()
+	olds := []*Segment{}
+	now := s.now()
+
+	generation, err := s.storage.Stage(func() (*Segment, error) {
+		segment, err := source()
+		if err != nil || segment == nil {
+			return nil, err
+		}
+
+		requested := segment.Status
+		if err := s.compile(segment); err != nil {
+			return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+		if _, ok := processed[segment.ID]; ok == true {
+			return nil, fmt.Errorf("segment %q: %w", segment.ID, ErrDuplicateID)
+		}
+		// schema and fragments are changed by writers only
+		if err := s.checkFilters(segment); err != nil {
+			return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+
+		old := current[segment.ID]
+		if err := resolveStatus(segment, old, requested); err != nil {
+			return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+		if err := stamp(segment, old, now); err != nil {
+			return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+		if replaced(old, segment) {
+			olds = append(olds, old)
 		}
 
 		processed[segment.ID] = segment
+		indexes.add(segment)
+
+		return segment, nil
+	})
+	if err != nil {
+		return err
 	}
 
-	s.segments = processed
-	s.Reindex()
+	// removed segments can be restored from history
+	for id, old := range current {
+		if _, ok := processed[id]; ok == false {
+			olds = append(olds, old)
+		}
+	}
 
-	return nil
+	if err := generation.Commit(); err != nil {
+		generation.Discard()
+		return err
+	}
+
+	s.mu.Lock()
+	s.segments, s.indexSet = processed, indexes
+	s.generation++
+	s.mu.Unlock()
+
+	s.errStats.reset()
+
+	return s.keep(olds...)
 }
 
 // Load ...
 func (s *Segdb) Load() error {
-	segments, err := s.storage.Load()
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
 
+	schema, err := s.loadSchema()
 	if err != nil {
-		return nil
+		return err
+	}
+
+	fragments, err := s.loadFragments()
+	if err != nil {
+		return err
+	}
+
+	segments, err := s.storage.Load()
+	if err != nil {
+		return err
 	}
 
-	s.segments = segments
+	ordered := make([]*Segment, 0, len(segments))
+	for _, segment := range segments {
+		if err := compile(segment, fragments, s.functions); err != nil {
+			return fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+		ordered = append(ordered, segment)
+	}
+
+	indexes := buildIndexes(ordered)
 
-	s.Reindex()
+	s.mu.Lock()
+	s.segments, s.indexSet, s.schema, s.fragments = segments, indexes, schema, fragments
+	s.generation++
+	s.mu.Unlock()
+
+	s.errStats.reset()
 
 	return nil
 }
 
+// loadSchema ...
+func (s *Segdb) loadSchema() (Schema, error) {
+	data, err := s.storage.LoadMeta(schemaMeta)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	schema := Schema{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+
+	return schema.Normalize()
+}
+
 // Get ...
 func (s *Segdb) Get(id string) (*Segment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.get(id)
+}
+
+func (s *Segdb) get(id string) (*Segment, error) {
 	segment, ok := s.segments[id]
 
 	if ok == false {
@@ -139,10 +610,17 @@ func (s *Segdb) Get(id string) (*Segment, error) {
 
 // GetAll ...
 func (s *Segdb) GetAll(ids []string) []*Segment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.getAll(ids)
+}
+
+func (s *Segdb) getAll(ids []string) []*Segment {
 	segments := []*Segment{}
 
 	for _, id := range ids {
-		if seg, err := s.Get(id); err == nil {
+		if seg, err := s.get(id); err == nil {
 			segments = append(segments, seg)
 		}
 	}
@@ -151,151 +629,310 @@ func (s *Segdb) GetAll(ids []string) []*Segment {
 }
 
 // List ...
+//
+// List returns segments having all given index values.
 func (s *Segdb) List(indexes map[string]interface{}, limit int, offset int) []*Segment {
-	ids := []string{}
-
-	if len(indexes) > 0 {
-		for idx, v := range indexes {
-			idxs, ok := s.indexes[idx]
-			if ok == true {
-				iids, ok := idxs[v]
-				if ok == true {
-					ids = append(ids, iids...)
-				}
-			}
-		}
-		ids = s.unique(ids)
-	} else {
-		ids = append(ids, s.idIndex...)
-	}
+	return s.ListWhere(IndexesQuery(indexes), limit, offset)
+}
 
-	if limit < 1 || limit > len(ids) {
-		limit = len(ids)
-	}
+// ListWhere returns segments matched by index query
+func (s *Segdb) ListWhere(where IndexQuery, limit int, offset int) []*Segment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if offset < 0 {
-		offset = 0
-	}
+	return s.listWhere(where, limit, offset)
+}
 
-	if offset > len(ids) {
-		offset = len(ids)
-	}
+// ListOptions ...
+type ListOptions struct {
+	// Where selects segments by index values, nil selects all
+	Where IndexQuery
+	// Limit of segments, unlimited when less than 1
+	Limit int
+	// Offset number of segments to skip
+	Offset int
+	// Sort order of segments, SortInserted by default
+	Sort string
+	// Cursor of page to continue with, see ListPage
+	Cursor string
+	// Inactive includes segments out of their time window
+	Inactive bool
+	// Status selects segments of given statuses, StatusActive by default
+	Status []string
+}
 
-	ids = ids[offset : offset+limit]
+// ListBy is ListWhere with sorting option
+func (s *Segdb) ListBy(q *ListOptions) ([]*Segment, error) {
+	page, err := s.ListPage(q)
+	if err != nil {
+		return nil, err
+	}
 
-	return s.GetAll(ids)
+	return page.Segments, nil
 }
 
-func (s *Segdb) unique(intSlice []string) []string {
-	keys := make(map[string]bool)
-	list := []string{}
-	for _, entry := range intSlice {
-		if _, value := keys[entry]; !value {
-			keys[entry] = true
-			list = append(list, entry)
-		}
-	}
-	return list
+func (s *Segdb) listWhere(where IndexQuery, limit int, offset int) []*Segment {
+	r := s.rank(s.live(where.eval(s.indexSet)), SortInserted, s.defaultVisibility(), 0)
+	from, to := bounds(len(r.segments), limit, offset)
+
+	return r.segments[from:to]
 }
 
 // Delete ...
 func (s *Segdb) Delete(id string) error {
-	if _, ok := s.segments[id]; ok == false {
+	return s.delete(id, nil)
+}
+
+// DeleteIf is Delete failing with ErrConflict unless segment has given version
+func (s *Segdb) DeleteIf(id string, version uint64) error {
+	return s.delete(id, &version)
+}
+
+func (s *Segdb) delete(id string, version *uint64) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.RLock()
+	old, ok := s.segments[id]
+	s.mu.RUnlock()
+
+	if ok == false {
 		return ErrNotFound
 	}
 
+	if err := checkVersion(old, version); err != nil {
+		return err
+	}
+
 	if err := s.storage.Delete(id); err != nil {
 		return err
 	}
 
-	s.RemoveFromIndexes(id)
+	s.mu.Lock()
+	s.remove(id)
 	delete(s.segments, id)
+	s.mu.Unlock()
 
-	return nil
+	s.errStats.reset(id)
+
+	// deleted segment can be restored from history
+	return s.keep(old)
 }
 
 // Add ...
 func (s *Segdb) Add(segment *Segment) error {
-	program, err := expr.Compile(segment.Filters)
-	if err != nil {
+	return s.put(segment, nil)
+}
+
+// AddIf is Add failing with ErrConflict unless the stored segment has given
+// version, version 0 expects no segment with the same id
+func (s *Segdb) AddIf(segment *Segment, version uint64) error {
+	return s.put(segment, &version)
+}
+
+func (s *Segdb) put(segment *Segment, version *uint64) error {
+	requested := segment.Status
+	if err := s.compile(segment); err != nil {
+		return err
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if err := s.checkFilters(segment); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	old := s.segments[segment.ID]
+	s.mu.RUnlock()
+
+	if err := checkVersion(old, version); err != nil {
+		return err
+	}
+
+	if err := resolveStatus(segment, old, requested); err != nil {
+		return err
+	}
+
+	if err := s.stamp(segment, old, s.now()); err != nil {
 		return err
 	}
-	segment.Program = program
 
 	if err := s.storage.Save(segment); err != nil {
 		return err
 	}
 
+	s.mu.Lock()
 	s.segments[segment.ID] = segment
+	s.reindex(old, segment)
+	s.mu.Unlock()
+
+	s.errStats.reset(segment.ID)
 
-	s.Index(segment, true)
+	if replaced(old, segment) {
+		return s.keep(old)
+	}
 
 	return nil
 }
 
-// Index ...
-func (s *Segdb) Index(segment *Segment, clear bool) {
-	if clear {
-		s.RemoveFromIndexes(segment.ID)
+// checkVersion compares version of stored segment, nil when there is
+// none, with expected one, if any
+func checkVersion(segment *Segment, version *uint64) error {
+	switch {
+	case version == nil:
+		return nil
+	case segment == nil && *version != 0:
+		return fmt.Errorf("%w: segment does not exist, expected version %d", ErrConflict, *version)
+	case segment != nil && *version == 0:
+		return fmt.Errorf("%w: segment exists with version %d", ErrConflict, segment.Version)
+	case segment != nil && segment.Version != *version:
+		return fmt.Errorf("%w: version is %d, expected %d", ErrConflict, segment.Version, *version)
 	}
 
-	for id, i := range segment.Indexes {
-		if _, ok := s.indexes[id]; ok == false {
-			s.indexes[id] = make(map[interface{}][]string)
-		}
+	return nil
+}
 
-		if _, ok := s.isIndexExists(s.indexes[id][i], segment.ID); ok == false {
-			s.indexes[id][i] = append(s.indexes[id][i], segment.ID)
-		}
+// checkSchema type-checks filters against schema, if any
+func (s *Segdb) checkSchema(segment *Segment) error {
+	s.mu.RLock()
+	schema, functions := s.schema, s.functions
+	s.mu.RUnlock()
+
+	if schema == nil {
+		return nil
 	}
 
-	if _, ok := s.isIndexExists(s.idIndex, segment.ID); ok == false {
-		s.idIndex = append(s.idIndex, segment.ID)
+	return schema.check(segment.source, functions)
+}
+
+// checkFilters recompiles segment when fragments have changed since it was
+// compiled and type-checks its filters against schema. Callers hold wmu.
+func (s *Segdb) checkFilters(segment *Segment) error {
+	s.mu.RLock()
+	fragments, functions := s.fragments, s.functions
+	s.mu.RUnlock()
+
+	if len(segment.refs) > 0 && segment.fragments != fragments {
+		if err := compile(segment, fragments, functions); err != nil {
+			return err
+		}
 	}
+
+	return s.checkSchema(segment)
 }
 
-// Reindex ...
-func (s *Segdb) Reindex() {
-	s.indexes = make(map[string]map[interface{}][]string)
-	s.idIndex = []string{}
+// compile compiles segment with the current fragments and functions
+func (s *Segdb) compile(segment *Segment) error {
+	s.mu.RLock()
+	fragments, functions := s.fragments, s.functions
+	s.mu.RUnlock()
 
-	for _, segment := range s.segments {
-		s.Index(segment, false)
+	return compile(segment, fragments, functions)
+}
+
+// compile validates segment, normalizes its indexes and compiles filters
+// with fragments expanded, filters may call given functions only
+func compile(segment *Segment, fragments *fragmentSet, functions *functionSet) error {
+	if segment.ID == "" {
+		return ErrEmptyID
+	}
+
+	status, err := checkStatus(segment.Status)
+	if err != nil {
+		return err
+	}
+	segment.Status = status
+
+	indexes, err := segment.Indexes.Normalize()
+	if err != nil {
+		return err
+	}
+	segment.Indexes = indexes
+
+	source, refs, err := fragments.expand(segment.Filters)
+	if err != nil {
+		return err
 	}
+
+	program, err := expr.Compile(source)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFilters, err)
+	}
+
+	calls, err := functions.check(source)
+	if err != nil {
+		return err
+	}
+
+	segment.functions = nil
+	if calls > 0 {
+		segment.functions = functions
+	}
+	segment.Program = program
+	segment.conditions = analyzeFilters(source)
+	segment.source, segment.refs, segment.fragments = source, refs, fragments
+
+	return nil
 }
 
-// RemoveFromIndexes ...
-func (s *Segdb) RemoveFromIndexes(id string) {
-	for index, m := range s.indexes {
-		for value, l := range m {
-			for i, e := range l {
-				if e == id {
-					s.indexes[index][value] = append(l[:i], l[i+1:]...)
-					break
-				}
-			}
-		}
+// Index ...
+func (s *Segdb) Index(segment *Segment, clear bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index(segment, clear)
+}
+
+// reindex indexes segment replacing old one, nil for a new segment.
+// Replaced segment keeps its position, so listing cursors stay valid.
+func (s *Segdb) reindex(old *Segment, segment *Segment) {
+	if old == nil {
+		s.add(segment)
+		return
 	}
 
-	for idx, segID := range s.idIndex {
-		if segID == id {
-			s.idIndex = append(s.idIndex[:idx], s.idIndex[idx+1:]...)
-		}
+	s.update(old, segment)
+}
+
+func (s *Segdb) index(segment *Segment, clear bool) {
+	if clear {
+		s.remove(segment.ID)
 	}
+
+	s.add(segment)
 }
 
-// isIndexExists ...
-func (s *Segdb) isIndexExists(index []string, id string) (int, bool) {
-	for idx, seg := range index {
-		if seg == id {
-			return idx, true
+// Reindex ...
+func (s *Segdb) Reindex() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments := s.getAll(s.order())
+	for _, segment := range s.segments {
+		if _, ok := s.seqs[segment.ID]; ok == false {
+			segments = append(segments, segment)
 		}
 	}
-	return -1, false
+
+	s.indexSet = buildIndexes(segments)
+	s.generation++
+}
+
+// RemoveFromIndexes ...
+func (s *Segdb) RemoveFromIndexes(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(id)
 }
 
 // GetIndexSize ...
 func (s *Segdb) GetIndexSize() uintptr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	size := unsafe.Sizeof(s.indexes)
 
 	for k, v := range s.indexes {
@@ -310,5 +947,8 @@ func (s *Segdb) GetIndexSize() uintptr {
 
 // GetSegmentsCount ...
 func (s *Segdb) GetSegmentsCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	return len(s.segments)
 }
@@ -1,9 +1,13 @@
 package segdb
 
 import (
+	"errors"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"testing"
 	"unsafe"
 
@@ -53,6 +57,19 @@ func TestSegdb_Add(t *testing.T) {
 	clearStorage()
 }
 
+func TestSegdb_Load(t *testing.T) {
+	defer clearStorage()
+
+	// nothing stored yet
+	s := getSegDb()
+	assert.NoError(t, s.Load())
+	assert.Equal(t, 0, s.GetSegmentsCount())
+
+	assert.NoError(t, os.MkdirAll(storagePath, os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(path.Join(storagePath, "seg1.json"), []byte("{"), os.ModePerm))
+	assert.Error(t, getSegDb().Load())
+}
+
 func TestSegdb_Publish(t *testing.T) {
 	s := getSegDb()
 
@@ -64,6 +81,61 @@ func TestSegdb_Publish(t *testing.T) {
 	clearStorage()
 }
 
+func TestSegdb_PublishFailureKeepsPreviousGeneration(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Publish(getSegments(2)))
+
+	segments := getSegments(5)
+	segments[3].Filters = "level >="
+
+	err := s.Publish(segments)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "seg4")
+
+	assert.Equal(t, 2, s.GetSegmentsCount())
+	_, err = s.Get("seg3")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.FileExists(t, path.Join(storagePath, "seg1.json"))
+	assert.FileExists(t, path.Join(storagePath, "seg2.json"))
+	_, err = os.Stat(path.Join(storagePath, "seg3.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, s.Load())
+	assert.Equal(t, 2, s.GetSegmentsCount())
+
+	// so does failed source
+	source := sliceSource(getSegments(5))
+	err = s.PublishFrom(func() (*Segment, error) {
+		segment, _ := source()
+		if segment.ID == "seg4" {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return segment, nil
+	})
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, 2, s.GetSegmentsCount())
+	_, err = os.Stat(path.Join(storagePath, "seg3.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSegdb_PublishValidation(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	segments := getSegments(2)
+	segments[1].ID = segments[0].ID
+	assert.True(t, errors.Is(s.Publish(segments), ErrDuplicateID))
+
+	segments = getSegments(2)
+	segments[1].ID = ""
+	assert.True(t, errors.Is(s.Publish(segments), ErrEmptyID))
+
+	assert.Equal(t, 0, s.GetSegmentsCount())
+}
+
 func TestSegdb_Delete(t *testing.T) {
 	s := getSegDb()
 
@@ -80,6 +152,28 @@ func TestSegdb_Delete(t *testing.T) {
 	clearStorage()
 }
 
+func TestSegdb_AddIf(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.AddIf(&Segment{ID: "seg1", Filters: "true"}, 0))
+	assert.True(t, errors.Is(s.AddIf(&Segment{ID: "seg1", Filters: "false"}, 0), ErrConflict))
+	assert.True(t, errors.Is(s.AddIf(&Segment{ID: "seg2", Filters: "false"}, 1), ErrConflict))
+
+	// the second writer of the same version loses
+	assert.NoError(t, s.AddIf(&Segment{ID: "seg1", Filters: "false"}, 1))
+	assert.True(t, errors.Is(s.AddIf(&Segment{ID: "seg1", Filters: "level > 1"}, 1), ErrConflict))
+
+	segment, _ := s.Get("seg1")
+	assert.Equal(t, "false", segment.Filters)
+	assert.Equal(t, uint64(2), segment.Version)
+
+	assert.True(t, errors.Is(s.DeleteIf("seg1", 1), ErrConflict))
+	assert.Equal(t, ErrNotFound, s.DeleteIf("seg2", 1))
+	assert.NoError(t, s.DeleteIf("seg1", 2))
+	assert.Equal(t, 0, s.GetSegmentsCount())
+}
+
 func TestSegdb_Get(t *testing.T) {
 	s := getSegDb()
 
@@ -155,6 +249,63 @@ func TestSegdb_List(t *testing.T) {
 	clearStorage()
 }
 
+func TestSegdb_ListBy(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	for i, id := range []string{"c", "a", "b", "d"} {
+		assert.NoError(t, s.Add(&Segment{ID: id, Filters: "true", Priority: i % 2, Indexes: Indexes{"idx1": 1}}))
+	}
+
+	tests := []struct {
+		q        *ListOptions
+		expected []string
+	}{
+		{&ListOptions{}, []string{"c", "a", "b", "d"}},
+		{&ListOptions{Sort: SortID}, []string{"a", "b", "c", "d"}},
+		{&ListOptions{Sort: SortPriority}, []string{"a", "d", "c", "b"}},
+		{&ListOptions{Sort: SortPriority, Limit: 2, Offset: 1}, []string{"d", "c"}},
+		{&ListOptions{Where: Eq("idx1", 1), Sort: SortID, Offset: 3}, []string{"d"}},
+		{&ListOptions{Where: Eq("idx1", 2), Sort: SortID}, []string{}},
+	}
+
+	for _, tt := range tests {
+		segments, err := s.ListBy(tt.q)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, segmentIDs(segments), tt.q)
+	}
+
+	_, err := s.ListBy(&ListOptions{Sort: "random"})
+	assert.True(t, errors.Is(err, ErrSortOrder))
+}
+
+func TestSegdb_QueryPriority(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "low", Filters: "true", Priority: -1}))
+	assert.NoError(t, s.Add(&Segment{ID: "default", Filters: "true"}))
+	assert.NoError(t, s.Add(&Segment{ID: "high", Filters: "true", Priority: 10}))
+	assert.NoError(t, s.Add(&Segment{ID: "high_other", Filters: "level > 1", Priority: 10}))
+
+	// limit 1 gives the highest priority every time
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []string{"high"}, segmentIDs(s.Query(map[string]interface{}{"level": 1}, 1)))
+	}
+	assert.Equal(t, []string{"high", "high_other", "default", "low"}, segmentIDs(s.Query(map[string]interface{}{"level": 2}, -1)))
+
+	segments, err := s.Find(&QueryOptions{Context: map[string]interface{}{"level": 2}, Sort: SortInserted})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"low", "default", "high", "high_other"}, segmentIDs(segments))
+
+	assert.Equal(t, "high", s.Explain(map[string]interface{}{"level": 1}, 1).Segments[0].ID)
+
+	// priority is stored
+	loaded := getSegDb()
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, []string{"high"}, segmentIDs(loaded.Query(map[string]interface{}{"level": 1}, 1)))
+}
+
 func TestSegdb_Query(t *testing.T) {
 	s := getSegDb()
 
@@ -237,13 +388,13 @@ func TestSegdb_IdIndex(t *testing.T) {
 	assert.NoError(t, s.Add(segment2))
 	assert.Equal(t, 2, s.GetSegmentsCount())
 
-	assert.Len(t, s.idIndex, 2)
-	assert.Equal(t, segment1.ID, s.idIndex[0])
-	assert.Equal(t, segment2.ID, s.idIndex[1])
+	assert.Len(t, s.order(), 2)
+	assert.Equal(t, segment1.ID, s.order()[0])
+	assert.Equal(t, segment2.ID, s.order()[1])
 
 	assert.NoError(t, s.Delete(segment1.ID))
-	assert.Len(t, s.idIndex, 1)
-	assert.Equal(t, segment2.ID, s.idIndex[0])
+	assert.Len(t, s.order(), 1)
+	assert.Equal(t, segment2.ID, s.order()[0])
 
 	clearStorage()
 }
@@ -274,4 +425,85 @@ func getSegDb() *Segdb {
 
 func clearStorage() {
 	os.RemoveAll(storagePath)
+	os.RemoveAll(storagePath + ".meta")
+}
+
+func TestSegdb_ConcurrentReadWrite(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Publish(getSegments(20)))
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Query(map[string]interface{}{"idx1": 1, "level": 1, "uvs": 1}, 0)
+				s.Query(map[string]interface{}{"level": 1, "uvs": 1}, 3)
+				s.List(map[string]interface{}{"idx2": "idx2_str"}, 2, 1)
+				s.List(nil, -1, -1)
+				s.Get("seg1")
+				s.GetAll([]string{"seg2", "seg3"})
+				s.GetIndexSize()
+				s.GetSegmentsCount()
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		seg := getSegments(25)[20+i%5]
+		assert.NoError(t, s.Add(seg))
+		if i%3 == 0 {
+			assert.NoError(t, s.Delete(seg.ID))
+		}
+		if i%10 == 0 {
+			assert.NoError(t, s.Publish(getSegments(20)))
+			assert.NoError(t, s.Load())
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestSegdb_ConcurrentWriters(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for _, seg := range getSegments(10) {
+				seg.ID = seg.ID + "_" + strconv.Itoa(w)
+				assert.NoError(t, s.Add(seg))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 80, s.GetSegmentsCount())
+	assert.Len(t, s.List(nil, -1, -1), 80)
+	assert.Len(t, s.List(map[string]interface{}{"idx1": 1}, -1, -1), 80)
+}
+
+func TestSegdb_QueryDoesNotModifyInput(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Publish(getSegments(2)))
+
+	m := map[string]interface{}{"idx1": 1, "level": 1, "uvs": 1}
+	assert.Len(t, s.Query(m, 0), 2)
+	assert.Len(t, m, 3)
 }
@@ -1,6 +1,10 @@
 package segdb
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/antonmedv/expr"
 	"github.com/antonmedv/expr/vm"
 )
@@ -10,17 +14,92 @@ type Segment struct {
 	ID      string
 	Data    string
 	Filters string
-	Indexes map[string]interface{}
-	Program *vm.Program
+	Indexes Indexes
+	// Priority orders matched segments, higher first
+	Priority int
+	Program  *vm.Program
+
+	// Version grows with every change of segment, CreatedAt is time of
+	// its first version and UpdatedAt of the current one
+	Version   uint64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// ActiveFrom and ActiveUntil limit time segment is found by queries and
+	// lists, zero time leaves it unbounded. ActiveUntil is exclusive.
+	ActiveFrom  time.Time
+	ActiveUntil time.Time
+
+	// Status is one of StatusActive, StatusPaused, StatusDraft or
+	// StatusArchived, only active segments are found by queries
+	Status string
+
+	// conditions are necessary conditions of filters used to pre-filter segments
+	conditions []*condition
+
+	// source is filters with fragments expanded, refs are names of fragments
+	// they depend on and fragments is the set they have been compiled with
+	source    string
+	refs      []string
+	fragments *fragmentSet
+
+	// functions filters call, nil when they call none
+	functions *functionSet
 }
 
+// Active reports whether segment is active at given time
+func (s *Segment) Active(now time.Time) bool {
+	return (s.ActiveFrom.IsZero() || now.Before(s.ActiveFrom) == false) &&
+		(s.ActiveUntil.IsZero() || now.Before(s.ActiveUntil))
+}
+
+// Expired reports whether segment is not going to be active after given time
+func (s *Segment) Expired(now time.Time) bool {
+	return s.ActiveUntil.IsZero() == false && now.Before(s.ActiveUntil) == false
+}
+
+var (
+	// ErrNotBool filters result is not a boolean
+	ErrNotBool = errors.New("filters result is not a boolean")
+	// ErrNotCompiled segment filters have not been compiled
+	ErrNotCompiled = errors.New("segment is not compiled")
+)
+
 // Match with map
 func (s *Segment) Match(m map[string]interface{}) bool {
-	output, err := expr.Run(s.Program, m)
+	matched, err := s.Eval(m)
+	return err == nil && matched == true
+}
+
+// Eval runs filters with map, unlike Match it reports why filters failed
+func (s *Segment) Eval(m map[string]interface{}) (bool, error) {
+	if s.functions == nil {
+		return s.eval(m)
+	}
+
+	env := make(map[string]interface{}, len(m))
+	for name, value := range m {
+		env[name] = value
+	}
+
+	return s.eval(s.functions.env(env, s.functions.now()))
+}
+
+// eval is Eval with functions already in env
+func (s *Segment) eval(env map[string]interface{}) (bool, error) {
+	if s.Program == nil {
+		return false, ErrNotCompiled
+	}
+
+	output, err := expr.Run(s.Program, env)
 	if err != nil {
-		return false
+		return false, err
 	}
 
 	b, ok := output.(bool)
-	return ok == true && b == true
+	if ok == false {
+		return false, fmt.Errorf("%w: %T", ErrNotBool, output)
+	}
+
+	return b, nil
 }
@@ -1,6 +1,7 @@
 package segdb
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,3 +15,21 @@ func TestSegment_Match(t *testing.T) {
 		"uvs":   1,
 	}))
 }
+
+func TestSegment_Eval(t *testing.T) {
+	segment := getSegments(1)[0]
+
+	matched, err := segment.Eval(map[string]interface{}{"level": 1, "uvs": 1})
+	assert.NoError(t, err)
+	assert.True(t, matched)
+
+	matched, err = segment.Eval(map[string]interface{}{"level": "1", "uvs": 1})
+	assert.Error(t, err)
+	assert.False(t, matched)
+
+	segment = &Segment{ID: "seg", Filters: "level"}
+	assert.NoError(t, compile(segment, nil, nil))
+	matched, err = segment.Eval(map[string]interface{}{"level": 1})
+	assert.True(t, errors.Is(err, ErrNotBool))
+	assert.False(t, matched)
+}
@@ -0,0 +1,581 @@
+package segdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	kbinary "github.com/kelindar/binary"
+)
+
+const (
+	// SnapshotVersion version of binary snapshot format
+	SnapshotVersion = 1
+
+	snapshotMagic      = "SEGDBSNP"
+	snapshotHeaderSize = len(snapshotMagic) + 8
+
+	// kindTime marks time.Time index value, reflect kinds never reach it
+	kindTime = 255
+)
+
+var (
+	// ErrSnapshotVersion snapshot has been written by unsupported format version
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+	// ErrSnapshotChecksum snapshot payload does not match its checksum
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// SnapshotStorage ...
+//
+// SnapshotStorage keeps the whole segment set in one versioned and
+// checksummed binary file. Every change rewrites the file, so it suits
+// catalogs that are published in bulk and loaded often.
+type SnapshotStorage struct {
+	mu       sync.Mutex
+	filename string
+	segments map[string]*snapshotSegment
+}
+
+// snapshotFile ...
+type snapshotFile struct {
+	Segments []snapshotSegment
+}
+
+// snapshotSegment ...
+type snapshotSegment struct {
+	ID       string
+	Data     string
+	Filters  string
+	Indexes  []snapshotIndexValue
+	Priority int64
+	Version  uint64
+	// times are encoded by MarshalBinary, empty when zero,
+	// so ActiveFrom and ActiveUntil are empty when unbounded
+	CreatedAt   []byte
+	UpdatedAt   []byte
+	ActiveFrom  []byte
+	ActiveUntil []byte
+	Status      string
+}
+
+// snapshotIndexValue stores index value along with its kind. Every value
+// of a multi-value index is stored separately with Multi set, an empty
+// list is stored as a single Multi value of invalid kind.
+type snapshotIndexValue struct {
+	Name  string
+	Kind  uint8
+	Int   int64
+	Uint  uint64
+	Float float64
+	Bool  bool
+	Str   string
+	Multi bool
+}
+
+// NewSnapshotStorage ...
+func NewSnapshotStorage(filename string) *SnapshotStorage {
+	return &SnapshotStorage{filename: filename}
+}
+
+// Save ...
+func (s *SnapshotStorage) Save(segment *Segment) error {
+	encoded, err := encodeSnapshotSegment(segment)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	segments := s.copySegments()
+	segments[segment.ID] = encoded
+
+	return s.write(segments)
+}
+
+// Delete ...
+func (s *SnapshotStorage) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	if _, ok := s.segments[id]; ok == false {
+		return os.ErrNotExist
+	}
+
+	segments := s.copySegments()
+	delete(segments, id)
+
+	return s.write(segments)
+}
+
+// Apply saves and deletes segments writing snapshot once
+func (s *SnapshotStorage) Apply(upserts []*Segment, deletes []string) error {
+	encoded := make([]*snapshotSegment, 0, len(upserts))
+	for _, segment := range upserts {
+		e, err := encodeSnapshotSegment(segment)
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, e)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	segments := s.copySegments()
+	for _, id := range deletes {
+		if _, ok := segments[id]; ok == false {
+			return os.ErrNotExist
+		}
+		delete(segments, id)
+	}
+	for i, segment := range upserts {
+		segments[segment.ID] = encoded[i]
+	}
+
+	return s.write(segments)
+}
+
+// Clear ...
+func (s *SnapshotStorage) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.segments = map[string]*snapshotSegment{}
+
+	return nil
+}
+
+// Load ...
+func (s *SnapshotStorage) Load() (map[string]*Segment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.segments = nil
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	segments := make(map[string]*Segment, len(s.segments))
+	for id, encoded := range s.segments {
+		segment, err := decodeSnapshotSegment(encoded)
+		if err != nil {
+			return nil, err
+		}
+		segments[id] = segment
+	}
+
+	return segments, nil
+}
+
+// Stage ...
+func (s *SnapshotStorage) Stage(source SegmentSource) (Generation, error) {
+	staged := map[string]*snapshotSegment{}
+	for {
+		segment, err := source()
+		if err != nil {
+			return nil, err
+		}
+		if segment == nil {
+			break
+		}
+
+		encoded, err := encodeSnapshotSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		staged[segment.ID] = encoded
+	}
+
+	g := &snapshotGeneration{
+		storage:  s,
+		filename: s.filename + ".stage",
+		segments: staged,
+	}
+
+	if err := writeSnapshotFile(g.filename, staged); err != nil {
+		os.Remove(g.filename)
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// open reads snapshot file unless it is already in memory
+func (s *SnapshotStorage) open() error {
+	if s.segments != nil {
+		return nil
+	}
+
+	segments, err := readSnapshotFile(s.filename)
+	if os.IsNotExist(err) {
+		segments, err = map[string]*snapshotSegment{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.segments = segments
+
+	return nil
+}
+
+// write replaces snapshot file and in-memory copy with segments. Renamed
+// file is current, so failing to flush directory afterwards does not fail
+// the write.
+func (s *SnapshotStorage) write(segments map[string]*snapshotSegment) error {
+	tmp := s.filename + ".tmp"
+
+	if err := writeSnapshotFile(tmp, segments); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, s.filename); err != nil {
+		return err
+	}
+
+	s.segments = segments
+	syncDir(filepath.Dir(s.filename))
+
+	return nil
+}
+
+func (s *SnapshotStorage) copySegments() map[string]*snapshotSegment {
+	segments := make(map[string]*snapshotSegment, len(s.segments)+1)
+	for id, encoded := range s.segments {
+		segments[id] = encoded
+	}
+	return segments
+}
+
+// snapshotGeneration ...
+type snapshotGeneration struct {
+	storage  *SnapshotStorage
+	filename string
+	segments map[string]*snapshotSegment
+}
+
+// Commit ...
+//
+// Commit succeeds once staged file is renamed, failing to flush directory
+// afterwards does not fail it, as write does.
+func (g *snapshotGeneration) Commit() error {
+	g.storage.mu.Lock()
+	defer g.storage.mu.Unlock()
+
+	if err := os.Rename(g.filename, g.storage.filename); err != nil {
+		return err
+	}
+
+	g.storage.segments = g.segments
+	syncDir(filepath.Dir(g.storage.filename))
+
+	return nil
+}
+
+// Discard ...
+func (g *snapshotGeneration) Discard() error {
+	return os.Remove(g.filename)
+}
+
+// writeSnapshotFile encodes segments as: magic, version, crc32 of payload, payload
+func writeSnapshotFile(filename string, segments map[string]*snapshotSegment) error {
+	file := &snapshotFile{Segments: make([]snapshotSegment, 0, len(segments))}
+	for _, encoded := range segments {
+		file.Segments = append(file.Segments, *encoded)
+	}
+
+	payload, err := kbinary.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, snapshotHeaderSize, snapshotHeaderSize+len(payload))
+	copy(buf, snapshotMagic)
+	binary.BigEndian.PutUint32(buf[len(snapshotMagic):], SnapshotVersion)
+	binary.BigEndian.PutUint32(buf[len(snapshotMagic)+4:], crc32.ChecksumIEEE(payload))
+	buf = append(buf, payload...)
+
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return err
+	}
+
+	return writeFileSync(filename, buf)
+}
+
+// readSnapshotFile ...
+func readSnapshotFile(filename string) (map[string]*snapshotSegment, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < snapshotHeaderSize || !bytes.Equal(data[:len(snapshotMagic)], []byte(snapshotMagic)) {
+		return nil, ErrCorruptedSnapshot
+	}
+
+	version := binary.BigEndian.Uint32(data[len(snapshotMagic):])
+	if version != SnapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+
+	payload := data[snapshotHeaderSize:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[len(snapshotMagic)+4:]) {
+		return nil, ErrSnapshotChecksum
+	}
+
+	file := &snapshotFile{}
+	if err := kbinary.Unmarshal(payload, file); err != nil {
+		return nil, err
+	}
+
+	segments := make(map[string]*snapshotSegment, len(file.Segments))
+	for i := range file.Segments {
+		segments[file.Segments[i].ID] = &file.Segments[i]
+	}
+
+	return segments, nil
+}
+
+// encodeSnapshotSegment ...
+func encodeSnapshotSegment(segment *Segment) (*snapshotSegment, error) {
+	encoded := &snapshotSegment{
+		ID:       segment.ID,
+		Data:     segment.Data,
+		Filters:  segment.Filters,
+		Indexes:  make([]snapshotIndexValue, 0, len(segment.Indexes)),
+		Priority: int64(segment.Priority),
+		Version:  segment.Version,
+		Status:   segment.Status,
+	}
+
+	times := []struct {
+		t   time.Time
+		dst *[]byte
+	}{
+		{segment.CreatedAt, &encoded.CreatedAt},
+		{segment.UpdatedAt, &encoded.UpdatedAt},
+		{segment.ActiveFrom, &encoded.ActiveFrom},
+		{segment.ActiveUntil, &encoded.ActiveUntil},
+	}
+	for _, t := range times {
+		b, err := encodeSnapshotTime(t.t)
+		if err != nil {
+			return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+		*t.dst = b
+	}
+
+	for name, value := range segment.Indexes {
+		list, ok := value.([]interface{})
+		if ok == false {
+			iv, err := encodeSnapshotIndexValue(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
+			}
+			encoded.Indexes = append(encoded.Indexes, iv)
+			continue
+		}
+
+		if len(list) == 0 {
+			encoded.Indexes = append(encoded.Indexes, snapshotIndexValue{Name: name, Multi: true})
+		}
+
+		for _, v := range list {
+			iv, err := encodeSnapshotIndexValue(name, v)
+			if err != nil {
+				return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
+			}
+			iv.Multi = true
+			encoded.Indexes = append(encoded.Indexes, iv)
+		}
+	}
+
+	return encoded, nil
+}
+
+// decodeSnapshotSegment ...
+func decodeSnapshotSegment(encoded *snapshotSegment) (*Segment, error) {
+	segment := &Segment{
+		ID:       encoded.ID,
+		Data:     encoded.Data,
+		Filters:  encoded.Filters,
+		Indexes:  make(map[string]interface{}, len(encoded.Indexes)),
+		Priority: int(encoded.Priority),
+		Version:  encoded.Version,
+		Status:   encoded.Status,
+	}
+
+	times := []struct {
+		b   []byte
+		dst *time.Time
+	}{
+		{encoded.CreatedAt, &segment.CreatedAt},
+		{encoded.UpdatedAt, &segment.UpdatedAt},
+		{encoded.ActiveFrom, &segment.ActiveFrom},
+		{encoded.ActiveUntil, &segment.ActiveUntil},
+	}
+	for _, t := range times {
+		decoded, err := decodeSnapshotTime(t.b)
+		if err != nil {
+			return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+		*t.dst = decoded
+	}
+
+	for _, iv := range encoded.Indexes {
+		if iv.Multi && reflect.Kind(iv.Kind) == reflect.Invalid {
+			segment.Indexes[iv.Name] = []interface{}{}
+			continue
+		}
+
+		value, err := decodeSnapshotIndexValue(iv)
+		if err != nil {
+			return nil, fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+
+		if iv.Multi {
+			list, _ := segment.Indexes[iv.Name].([]interface{})
+			segment.Indexes[iv.Name] = append(list, value)
+			continue
+		}
+
+		segment.Indexes[iv.Name] = value
+	}
+
+	return segment, nil
+}
+
+// encodeSnapshotTime encodes time as MarshalBinary does, zero time is
+// encoded empty
+func encodeSnapshotTime(t time.Time) ([]byte, error) {
+	if t.IsZero() {
+		return nil, nil
+	}
+
+	return t.MarshalBinary()
+}
+
+// decodeSnapshotTime ...
+func decodeSnapshotTime(b []byte) (time.Time, error) {
+	t := time.Time{}
+	if len(b) == 0 {
+		return t, nil
+	}
+
+	err := t.UnmarshalBinary(b)
+	return t, err
+}
+
+// encodeSnapshotIndexValue ...
+func encodeSnapshotIndexValue(name string, value interface{}) (snapshotIndexValue, error) {
+	iv := snapshotIndexValue{Name: name}
+
+	if t, ok := value.(time.Time); ok == true {
+		b, err := t.MarshalBinary()
+		if err != nil {
+			return iv, err
+		}
+		iv.Kind, iv.Str = kindTime, string(b)
+		return iv, nil
+	}
+
+	if value == nil {
+		iv.Kind = uint8(reflect.Invalid)
+		return iv, nil
+	}
+
+	rv := reflect.ValueOf(value)
+	iv.Kind = uint8(rv.Kind())
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		iv.Int = rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		iv.Uint = rv.Uint()
+	case reflect.Float32, reflect.Float64:
+		iv.Float = rv.Float()
+	case reflect.Bool:
+		iv.Bool = rv.Bool()
+	case reflect.String:
+		iv.Str = rv.String()
+	default:
+		return iv, fmt.Errorf("index %q: unsupported value type %T", name, value)
+	}
+
+	return iv, nil
+}
+
+// decodeSnapshotIndexValue ...
+func decodeSnapshotIndexValue(iv snapshotIndexValue) (interface{}, error) {
+	if iv.Kind == kindTime {
+		t := time.Time{}
+		if err := t.UnmarshalBinary([]byte(iv.Str)); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	kind := reflect.Kind(iv.Kind)
+	var rv reflect.Value
+
+	switch kind {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		rv = reflect.ValueOf(iv.Int)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		rv = reflect.ValueOf(iv.Uint)
+	case reflect.Float32, reflect.Float64:
+		rv = reflect.ValueOf(iv.Float)
+	case reflect.Bool:
+		return iv.Bool, nil
+	case reflect.String:
+		return iv.Str, nil
+	default:
+		return nil, fmt.Errorf("index %q: unsupported value kind %d", iv.Name, iv.Kind)
+	}
+
+	return rv.Convert(kindTypes[kind]).Interface(), nil
+}
+
+// kindTypes maps numeric kinds to their builtin types
+var kindTypes = map[reflect.Kind]reflect.Type{
+	reflect.Int:     reflect.TypeOf(int(0)),
+	reflect.Int8:    reflect.TypeOf(int8(0)),
+	reflect.Int16:   reflect.TypeOf(int16(0)),
+	reflect.Int32:   reflect.TypeOf(int32(0)),
+	reflect.Int64:   reflect.TypeOf(int64(0)),
+	reflect.Uint:    reflect.TypeOf(uint(0)),
+	reflect.Uint8:   reflect.TypeOf(uint8(0)),
+	reflect.Uint16:  reflect.TypeOf(uint16(0)),
+	reflect.Uint32:  reflect.TypeOf(uint32(0)),
+	reflect.Uint64:  reflect.TypeOf(uint64(0)),
+	reflect.Float32: reflect.TypeOf(float32(0)),
+	reflect.Float64: reflect.TypeOf(float64(0)),
+}
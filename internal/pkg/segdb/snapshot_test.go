@@ -0,0 +1,247 @@
+package segdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getSnapshotPath() string {
+	return path.Join(storagePath, "segments.snapshot")
+}
+
+func TestSnapshotStorage_SaveDeleteLoad(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewSnapshotStorage(getSnapshotPath())
+	segments := getSegments(3)
+
+	for _, segment := range segments {
+		assert.NoError(t, s.Save(segment))
+	}
+	assert.NoError(t, s.Delete("seg2"))
+	assert.Error(t, s.Delete("seg2"))
+
+	loaded, err := NewSnapshotStorage(getSnapshotPath()).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Equal(t, segments[0].Filters, loaded["seg1"].Filters)
+	assert.Equal(t, segments[2].Data, loaded["seg3"].Data)
+}
+
+func TestSnapshotStorage_Apply(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewSnapshotStorage(getSnapshotPath())
+	segments := getSegments(3)
+
+	assert.NoError(t, s.Apply(segments[:2], nil))
+	segments[0].Data = "changed"
+	assert.Equal(t, os.ErrNotExist, s.Apply([]*Segment{segments[2]}, []string{"seg3"}))
+	assert.NoError(t, s.Apply([]*Segment{segments[0], segments[2]}, []string{"seg2"}))
+
+	loaded, err := NewSnapshotStorage(getSnapshotPath()).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Equal(t, "changed", loaded["seg1"].Data)
+	assert.Equal(t, segments[2].Filters, loaded["seg3"].Filters)
+}
+
+func TestSnapshotStorage_IndexTypes(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	segment := &Segment{
+		ID:      "seg1",
+		Filters: "true",
+		Indexes: map[string]interface{}{
+			"int":     1,
+			"int64":   int64(-2),
+			"uint8":   uint8(3),
+			"float32": float32(1.5),
+			"float64": 2.5,
+			"bool":    true,
+			"string":  "str",
+			"time":    at,
+			"nil":     nil,
+		},
+	}
+
+	s := NewSnapshotStorage(getSnapshotPath())
+	assert.NoError(t, s.Save(segment))
+
+	loaded, err := NewSnapshotStorage(getSnapshotPath()).Load()
+	assert.NoError(t, err)
+	assert.Equal(t, segment.Indexes, loaded["seg1"].Indexes)
+
+	assert.Error(t, s.Save(&Segment{ID: "seg2", Indexes: map[string]interface{}{"map": map[string]int{}}}))
+}
+
+func TestSnapshotStorage_Checksum(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewSnapshotStorage(getSnapshotPath())
+	assert.NoError(t, s.Save(getSegments(1)[0]))
+
+	f, err := os.OpenFile(getSnapshotPath(), os.O_RDWR, os.ModePerm)
+	assert.NoError(t, err)
+	info, _ := f.Stat()
+	_, err = f.WriteAt([]byte{'x'}, info.Size()-1)
+	assert.NoError(t, err)
+	f.Close()
+
+	_, err = NewSnapshotStorage(getSnapshotPath()).Load()
+	assert.Equal(t, ErrSnapshotChecksum, err)
+}
+
+func TestSnapshotStorage_Stage(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewSnapshotStorage(getSnapshotPath())
+	segments := getSegments(3)
+	assert.NoError(t, s.Save(segments[0]))
+
+	g, err := s.Stage(sliceSource(segments[1:]))
+	assert.NoError(t, err)
+	assert.NoError(t, g.Discard())
+
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+
+	g, err = s.Stage(sliceSource(segments[1:]))
+	assert.NoError(t, err)
+	assert.NoError(t, g.Commit())
+
+	loaded, err = NewSnapshotStorage(getSnapshotPath()).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Contains(t, loaded, "seg2")
+	assert.Contains(t, loaded, "seg3")
+}
+
+func TestConvert(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+	defer os.RemoveAll(storagePath + "_copy")
+
+	files := NewMultiFileStorage(storagePath)
+	for _, segment := range getSegments(3) {
+		assert.NoError(t, files.Save(segment))
+	}
+
+	snapshot := NewSnapshotStorage(storagePath + "_copy/segments.snapshot")
+	assert.NoError(t, Convert(snapshot, files))
+
+	loaded, err := snapshot.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 3)
+
+	assert.NoError(t, files.Clear())
+	assert.NoError(t, Convert(files, snapshot))
+
+	loaded, err = files.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 3)
+	assert.Equal(t, "test data", loaded["seg2"].Data)
+}
+
+func TestSnapshotStorage_MultiValue(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	indexes, err := Indexes{
+		"countries": []string{"US", "CA"},
+		"one":       []int{1},
+		"empty":     []string{},
+		"scalar":    "US",
+	}.Normalize()
+	assert.NoError(t, err)
+
+	s := NewSnapshotStorage(getSnapshotPath())
+	assert.NoError(t, s.Save(&Segment{ID: "seg1", Filters: "true", Indexes: indexes}))
+
+	loaded, err := NewSnapshotStorage(getSnapshotPath()).Load()
+	assert.NoError(t, err)
+	assert.Equal(t, indexes, loaded["seg1"].Indexes)
+}
+
+func TestSnapshotStorage_Version(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewSnapshotStorage(getSnapshotPath())
+	assert.NoError(t, s.Save(&Segment{ID: "seg1", Filters: "true", Status: StatusPaused}))
+
+	loaded, err := NewSnapshotStorage(getSnapshotPath()).Load()
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPaused, loaded["seg1"].Status)
+
+	f, err := os.OpenFile(getSnapshotPath(), os.O_RDWR, os.ModePerm)
+	assert.NoError(t, err)
+	version := make([]byte, 4)
+	binary.BigEndian.PutUint32(version, SnapshotVersion+1)
+	_, err = f.WriteAt(version, int64(len(snapshotMagic)))
+	assert.NoError(t, err)
+	f.Close()
+
+	_, err = NewSnapshotStorage(getSnapshotPath()).Load()
+	assert.Equal(t, ErrSnapshotVersion, err)
+}
+
+func TestSnapshotStorage_Times(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	epoch := time.Unix(0, 0).UTC()
+	farFuture := time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC)
+	zone := time.FixedZone("", 2*60*60)
+
+	segments := []*Segment{
+		{ID: "seg1", Filters: "true", CreatedAt: epoch, UpdatedAt: farFuture, ActiveFrom: epoch, ActiveUntil: farFuture},
+		{ID: "seg2", Filters: "true", CreatedAt: farFuture.In(zone), UpdatedAt: epoch.In(zone)},
+	}
+
+	s := NewSnapshotStorage(getSnapshotPath())
+	for _, segment := range segments {
+		assert.NoError(t, s.Save(segment))
+	}
+
+	loaded, err := NewSnapshotStorage(getSnapshotPath()).Load()
+	assert.NoError(t, err)
+
+	for _, segment := range segments {
+		assert.True(t, segment.CreatedAt.Equal(loaded[segment.ID].CreatedAt))
+		assert.True(t, segment.UpdatedAt.Equal(loaded[segment.ID].UpdatedAt))
+		assert.True(t, segment.ActiveFrom.Equal(loaded[segment.ID].ActiveFrom))
+		assert.True(t, segment.ActiveUntil.Equal(loaded[segment.ID].ActiveUntil))
+	}
+
+	// zero times stay zero, epoch is not mistaken for them
+	assert.False(t, loaded["seg1"].ActiveFrom.IsZero())
+	assert.True(t, loaded["seg2"].ActiveFrom.IsZero())
+	assert.True(t, loaded["seg2"].ActiveUntil.IsZero())
+}
+
+func TestSnapshotStorage_NotFlushed(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	db := New(NewSnapshotStorage(getSnapshotPath()))
+	assert.NoError(t, db.Publish([]*Segment{{ID: "seg1", Data: "old", Filters: "true"}}))
+
+	flush := syncDir
+	defer func() { syncDir = flush }()
+	syncDir = func(dir string) error { return errors.New("flush failed") }
+
+	// renamed snapshot is current, memory follows it
+	assert.NoError(t, db.Publish([]*Segment{{ID: "seg1", Data: "new", Filters: "true"}}))
+	assert.NoError(t, db.Add(&Segment{ID: "seg2", Filters: "true"}))
+	segment, _ := db.Get("seg1")
+	assert.Equal(t, "new", segment.Data)
+
+	loaded, err := NewSnapshotStorage(getSnapshotPath()).Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "new", loaded["seg1"].Data)
+	assert.Len(t, loaded, 2)
+}
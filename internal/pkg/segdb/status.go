@@ -0,0 +1,122 @@
+package segdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// StatusActive segment is found by queries, it is the default status
+	StatusActive = "active"
+	// StatusPaused segment has been taken out of queries for a while
+	StatusPaused = "paused"
+	// StatusDraft segment is validated and stored but has never been live
+	StatusDraft = "draft"
+	// StatusArchived segment is kept for the record only
+	StatusArchived = "archived"
+)
+
+var (
+	// ErrInvalidStatus unknown segment status
+	ErrInvalidStatus = errors.New("invalid status")
+	// ErrTransition segment can not change from its status to the requested one
+	ErrTransition = errors.New("invalid status transition")
+)
+
+// transitions lists statuses every status may change to
+var transitions = map[string][]string{
+	StatusDraft:    {StatusActive, StatusArchived},
+	StatusActive:   {StatusPaused, StatusArchived},
+	StatusPaused:   {StatusActive, StatusArchived},
+	StatusArchived: {StatusDraft},
+}
+
+// checkStatus validates status, empty one is StatusActive
+func checkStatus(status string) (string, error) {
+	if status == "" {
+		return StatusActive, nil
+	}
+
+	if _, ok := transitions[status]; ok == false {
+		return "", fmt.Errorf("%w: %q", ErrInvalidStatus, status)
+	}
+
+	return status, nil
+}
+
+// checkTransition tells whether segment may change status from one to another
+func checkTransition(from string, to string) error {
+	if from == to {
+		return nil
+	}
+
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s to %s", ErrTransition, from, to)
+}
+
+// resolveStatus sets status of segment replacing old one, nil for a new
+// segment. Requested status is the one segment had before compiling, when
+// it is missing old status is kept, otherwise it has to be reachable from
+// the old one as SetStatus requires.
+func resolveStatus(segment *Segment, old *Segment, requested string) error {
+	if old == nil {
+		return nil
+	}
+
+	if requested == "" {
+		segment.Status = statusOf(old)
+		return nil
+	}
+
+	return checkTransition(statusOf(old), segment.Status)
+}
+
+// SetStatus moves segment to another status, see Patch. Drafts go active,
+// active segments are paused and resumed, any but archived ones are archived
+// and archived ones return to drafts.
+func (s *Segdb) SetStatus(id string, status string) (*Segment, error) {
+	return s.patch(id, &Patch{Status: &status}, nil)
+}
+
+// SetStatusIf is SetStatus failing with ErrConflict unless segment has given
+// version
+func (s *Segdb) SetStatusIf(id string, status string, version uint64) (*Segment, error) {
+	return s.patch(id, &Patch{Status: &status}, &version)
+}
+
+// visibility selects segments found by queries and lists
+type visibility struct {
+	// now skips segments inactive at the time, unless zero
+	now time.Time
+	// statuses skips segments of other statuses, unless empty
+	statuses []string
+}
+
+// defaultVisibility selects active segments within their time window
+func (s *Segdb) defaultVisibility() visibility {
+	return visibility{now: s.clock(), statuses: []string{StatusActive}}
+}
+
+func (v visibility) visible(segment *Segment) bool {
+	if v.now.IsZero() == false && segment.Active(v.now) == false {
+		return false
+	}
+
+	if len(v.statuses) == 0 {
+		return true
+	}
+
+	for _, status := range v.statuses {
+		if segment.Status == status {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,118 @@
+package segdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegdb_Status(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+	s.SetHistorySize(5)
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true"}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg2", Filters: "true", Status: StatusDraft}))
+	assert.True(t, errors.Is(s.Add(&Segment{ID: "seg3", Filters: "true", Status: "deleted"}), ErrInvalidStatus))
+
+	segment, _ := s.Get("seg1")
+	assert.Equal(t, StatusActive, segment.Status)
+
+	assert.Equal(t, []string{"seg1"}, segmentIDs(s.Query(nil, -1)))
+	assert.Equal(t, []string{"seg1"}, segmentIDs(s.ListWhere(And(), -1, -1)))
+
+	drafts, err := s.ListBy(&ListOptions{Status: []string{StatusDraft}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg2"}, segmentIDs(drafts))
+
+	all, err := s.ListBy(&ListOptions{Status: []string{StatusActive, StatusDraft}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg1", "seg2"}, segmentIDs(all))
+
+	_, err = s.ListBy(&ListOptions{Status: []string{"live"}})
+	assert.True(t, errors.Is(err, ErrInvalidStatus))
+
+	// draft goes live
+	segment, err = s.SetStatus("seg2", StatusActive)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), segment.Version)
+	assert.Equal(t, []string{"seg1", "seg2"}, segmentIDs(s.Query(nil, -1)))
+
+	_, err = s.SetStatusIf("seg1", StatusPaused, 2)
+	assert.True(t, errors.Is(err, ErrConflict))
+	_, err = s.SetStatusIf("seg1", StatusPaused, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg2"}, segmentIDs(s.Query(nil, -1)))
+
+	// unchanged status keeps version
+	segment, err = s.SetStatus("seg1", StatusPaused)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), segment.Version)
+
+	_, err = s.SetStatus("seg1", StatusDraft)
+	assert.True(t, errors.Is(err, ErrTransition))
+	_, err = s.SetStatus("seg3", StatusActive)
+	assert.Equal(t, ErrNotFound, err)
+
+	changes, err := s.Diff("seg1", 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{{Field: "status", From: StatusActive, To: StatusPaused}}, changes)
+
+	// rollback keeps status
+	data := "new"
+	_, err = s.Patch("seg1", &Patch{Data: &data})
+	assert.NoError(t, err)
+	segment, err = s.Rollback("seg1", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPaused, segment.Status)
+	assert.Equal(t, "", segment.Data)
+
+	_, err = s.SetStatus("seg1", StatusArchived)
+	assert.NoError(t, err)
+	segment, err = s.SetStatus("seg1", StatusDraft)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusDraft, segment.Status)
+
+	loaded := getSegDb()
+	assert.NoError(t, loaded.Load())
+	segment, _ = loaded.Get("seg1")
+	assert.Equal(t, StatusDraft, segment.Status)
+	assert.Equal(t, []string{"seg2"}, segmentIDs(loaded.Query(nil, -1)))
+}
+
+func TestSegdb_StatusOnReplace(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true"}))
+	_, err := s.SetStatus("seg1", StatusPaused)
+	assert.NoError(t, err)
+
+	// missing status keeps the stored one
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Data: "edited", Filters: "true"}))
+	segment, _ := s.Get("seg1")
+	assert.Equal(t, StatusPaused, segment.Status)
+	assert.Equal(t, "edited", segment.Data)
+
+	results, err := s.Apply([]*Segment{{ID: "seg1", Filters: "true"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, ApplyUpdated, results[0].Status)
+	segment, _ = s.Get("seg1")
+	assert.Equal(t, StatusPaused, segment.Status)
+
+	// given status goes through transitions
+	_, err = s.SetStatus("seg1", StatusArchived)
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(s.Add(&Segment{ID: "seg1", Filters: "true", Status: StatusActive}), ErrTransition))
+
+	results, err = s.Apply([]*Segment{{ID: "seg1", Filters: "true", Status: StatusActive}}, nil)
+	assert.True(t, errors.Is(err, ErrBatchRejected))
+	assert.True(t, errors.Is(results[0].Err, ErrTransition))
+
+	assert.True(t, errors.Is(s.Publish([]*Segment{{ID: "seg1", Filters: "true", Status: StatusActive}}), ErrTransition))
+
+	segment, _ = s.Get("seg1")
+	assert.Equal(t, StatusArchived, segment.Status)
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true", Status: StatusDraft}))
+}
@@ -0,0 +1,263 @@
+package segdb
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// earthRadius mean radius of the Earth in kilometers
+const earthRadius = 6371.0088
+
+// stdlib is the standard library of functions available to filters
+var stdlib = []struct {
+	name string
+	fn   interface{}
+	doc  string
+}{
+	{"geo_distance", geoDistance, "Great-circle distance in kilometers between two points given by latitude and longitude in degrees"},
+	{"semver_compare", semverCompare, "Compares semantic versions, v prefix is optional: -1 when a < b, 0 when equal, 1 when a > b"},
+	{"ip_in_cidr", ipInCIDR, "Whether IP address is in CIDR range, e.g. ip_in_cidr(ip, \"10.0.0.0/8\")"},
+	{"regex_match", regexMatch, "Whether string matches regular expression, compiled expressions are cached"},
+	{"now", time.Now, "Time of query, the same for all segments"},
+	{"parse_time", parseTime, "Parses RFC3339 time"},
+	{"add_duration", addDuration, "Adds duration like \"1h30m\" or \"-15m\" to time"},
+	{"add_days", addDays, "Adds number of days to time"},
+	{"days_between", daysBetween, "Number of days from the first time to the second one, negative when it is earlier"},
+	{"unix", unix, "Unix time in seconds"},
+}
+
+// newStdlib ...
+func newStdlib() *functionSet {
+	var fs *functionSet
+	for _, entry := range stdlib {
+		f, err := newFunction(entry.name, entry.fn, entry.doc)
+		if err != nil {
+			panic(err)
+		}
+		f.Builtin = true
+		fs = fs.with(f)
+	}
+
+	return fs
+}
+
+// geoDistance by haversine formula
+func geoDistance(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat, dLon := rad(lat2-lat1), rad(lon2-lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// semverCompare compares versions by semver precedence, build metadata is
+// ignored
+func semverCompare(a string, b string) (int, error) {
+	va, err := parseSemver(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseSemver(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < 3; i++ {
+		if va.core[i] != vb.core[i] {
+			return compareUint(va.core[i], vb.core[i]), nil
+		}
+	}
+
+	// release has higher precedence than pre-release
+	switch {
+	case len(va.pre) == 0 && len(vb.pre) == 0:
+		return 0, nil
+	case len(va.pre) == 0:
+		return 1, nil
+	case len(vb.pre) == 0:
+		return -1, nil
+	}
+
+	for i := 0; i < len(va.pre) && i < len(vb.pre); i++ {
+		if c := comparePrerelease(va.pre[i], vb.pre[i]); c != 0 {
+			return c, nil
+		}
+	}
+
+	return compareUint(uint64(len(va.pre)), uint64(len(vb.pre))), nil
+}
+
+// semver ...
+type semver struct {
+	core [3]uint64
+	pre  []string
+}
+
+// parseSemver parses MAJOR[.MINOR[.PATCH]][-PRERELEASE][+BUILD]
+func parseSemver(s string) (*semver, error) {
+	v := &semver{}
+	rest := strings.TrimPrefix(s, "v")
+
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		rest = rest[:i]
+	}
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		v.pre = strings.Split(rest[i+1:], ".")
+		rest = rest[:i]
+	}
+
+	parts := strings.Split(rest, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+		v.core[i] = n
+	}
+
+	return v, nil
+}
+
+// comparePrerelease compares identifiers, numeric ones lower than others
+func comparePrerelease(a string, b string) int {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+
+	switch {
+	case errA == nil && errB == nil:
+		return compareUint(na, nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
+
+// compareUint ...
+func compareUint(a uint64, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// ipInCIDR ...
+func ipInCIDR(ip string, cidr string) (bool, error) {
+	network, err := cidrCache.get(cidr, func() (interface{}, error) {
+		_, network, err := net.ParseCIDR(cidr)
+		return network, err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false, fmt.Errorf("invalid IP address %q", ip)
+	}
+
+	return network.(*net.IPNet).Contains(parsed), nil
+}
+
+// regexMatch ...
+func regexMatch(pattern string, s string) (bool, error) {
+	re, err := regexCache.get(pattern, func() (interface{}, error) {
+		return regexp.Compile(pattern)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return re.(*regexp.Regexp).MatchString(s), nil
+}
+
+// parseTime ...
+func parseTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339, s)
+}
+
+// addDuration ...
+func addDuration(t time.Time, d string) (time.Time, error) {
+	duration, err := time.ParseDuration(d)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return t.Add(duration), nil
+}
+
+// addDays ...
+func addDays(t time.Time, days int) time.Time {
+	return t.AddDate(0, 0, days)
+}
+
+// daysBetween ...
+func daysBetween(a time.Time, b time.Time) float64 {
+	return b.Sub(a).Hours() / 24
+}
+
+// unix ...
+func unix(t time.Time) int64 {
+	return t.Unix()
+}
+
+// maxCacheSize number of entries a cache keeps before it starts over
+const maxCacheSize = 1024
+
+var (
+	cidrCache  = newParseCache()
+	regexCache = newParseCache()
+)
+
+// parseCache keeps parsed arguments of functions, those failed to parse
+// are not cached
+type parseCache struct {
+	mu      sync.RWMutex
+	entries map[string]interface{}
+}
+
+// newParseCache ...
+func newParseCache() *parseCache {
+	return &parseCache{entries: map[string]interface{}{}}
+}
+
+// get returns parsed value of key, parsing it when it is not cached
+func (c *parseCache) get(key string, parse func() (interface{}, error)) (interface{}, error) {
+	c.mu.RLock()
+	value, ok := c.entries[key]
+	c.mu.RUnlock()
+
+	if ok == true {
+		return value, nil
+	}
+
+	value, err := parse()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= maxCacheSize {
+		c.entries = map[string]interface{}{}
+	}
+	c.entries[key] = value
+	c.mu.Unlock()
+
+	return value, nil
+}
@@ -0,0 +1,110 @@
+package segdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoDistance(t *testing.T) {
+	// Berlin to Paris
+	assert.InDelta(t, 878, geoDistance(52.5200, 13.4050, 48.8566, 2.3522), 1)
+	assert.Equal(t, 0.0, geoDistance(10, 20, 10, 20))
+}
+
+func TestSemverCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.10.0", "1.9.0", 1},
+		{"1.2.3", "2", -1},
+		{"1.0.0-alpha", "1.0.0", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha", 1},
+		{"1.0.0-alpha.2", "1.0.0-alpha.10", -1},
+		{"1.0.0-alpha.beta", "1.0.0-alpha.1", 1},
+		{"1.0.0+build.1", "1.0.0+build.2", 0},
+	}
+	for _, c := range cases {
+		got, err := semverCompare(c.a, c.b)
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, got, c.a+" vs "+c.b)
+	}
+
+	_, err := semverCompare("1.x", "1.0")
+	assert.Error(t, err)
+	_, err = semverCompare("1.0.0.0", "1.0")
+	assert.Error(t, err)
+}
+
+func TestIPInCIDR(t *testing.T) {
+	in, err := ipInCIDR("10.1.2.3", "10.0.0.0/8")
+	assert.NoError(t, err)
+	assert.True(t, in)
+	in, err = ipInCIDR("192.168.0.1", "10.0.0.0/8")
+	assert.NoError(t, err)
+	assert.False(t, in)
+	in, err = ipInCIDR("2001:db8::1", "2001:db8::/32")
+	assert.NoError(t, err)
+	assert.True(t, in)
+
+	_, err = ipInCIDR("10.1.2", "10.0.0.0/8")
+	assert.Error(t, err)
+	_, err = ipInCIDR("10.1.2.3", "10.0.0.0")
+	assert.Error(t, err)
+}
+
+func TestRegexMatch(t *testing.T) {
+	matched, err := regexMatch(`^[a-z]+@example\.com$`, "john@example.com")
+	assert.NoError(t, err)
+	assert.True(t, matched)
+	matched, err = regexMatch(`^[a-z]+@example\.com$`, "john@example.org")
+	assert.NoError(t, err)
+	assert.False(t, matched)
+
+	_, err = regexMatch(`(`, "john")
+	assert.Error(t, err)
+}
+
+func TestParseCache(t *testing.T) {
+	c := newParseCache()
+	parsed := 0
+	parse := func() (interface{}, error) {
+		parsed++
+		return parsed, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		value, err := c.get("a", parse)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, value)
+	}
+
+	for i := 0; i < maxCacheSize; i++ {
+		_, _ = c.get(string(rune('b'+i)), parse)
+	}
+	assert.True(t, len(c.entries) <= maxCacheSize)
+}
+
+func TestTimeFunctions(t *testing.T) {
+	at, err := parseTime("2020-06-01T00:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1590969600), unix(at))
+
+	_, err = parseTime("June")
+	assert.Error(t, err)
+
+	later, err := addDuration(at, "36h")
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, daysBetween(at, later))
+	assert.Equal(t, -1.5, daysBetween(later, at))
+
+	_, err = addDuration(at, "1 day")
+	assert.Error(t, err)
+
+	assert.Equal(t, time.Date(2020, 5, 31, 0, 0, 0, 0, time.UTC), addDays(at, -1))
+}
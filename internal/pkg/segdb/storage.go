@@ -2,6 +2,7 @@ package segdb
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -14,6 +15,43 @@ type StorageInterface interface {
 	Delete(id string) error
 	Clear() error
 	Load() (map[string]*Segment, error)
+	// Stage writes segments read from source aside as a new generation,
+	// the current one is kept untouched until Commit. Nothing is staged
+	// when source fails.
+	Stage(source SegmentSource) (Generation, error)
+	// SaveMeta stores named metadata alongside segments
+	SaveMeta(name string, data []byte) error
+	// LoadMeta returns named metadata, nil when there is none
+	LoadMeta(name string) ([]byte, error)
+}
+
+// SegmentSource yields segments one at a time, nil when there are no more
+type SegmentSource func() (*Segment, error)
+
+// sliceSource yields segments of slice
+func sliceSource(segments []*Segment) SegmentSource {
+	i := 0
+	return func() (*Segment, error) {
+		if i == len(segments) {
+			return nil, nil
+		}
+		i++
+		return segments[i-1], nil
+	}
+}
+
+// BatchStorage is implemented by storages able to save and delete many
+// segments at once, so either all of them are changed or none is
+type BatchStorage interface {
+	Apply(upserts []*Segment, deletes []string) error
+}
+
+// Generation is a fully written set of segments waiting to replace the current one
+type Generation interface {
+	// Commit makes generation current
+	Commit() error
+	// Discard removes staged data
+	Discard() error
 }
 
 // MultiFileStorage ...
@@ -59,15 +97,173 @@ func (s *MultiFileStorage) Clear() error {
 	if err := os.RemoveAll(dir); err != nil {
 		return err
 	}
+	if err := os.RemoveAll(s.journalPath()); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// journalEntry keeps prior content of segment file changed by Apply, no
+// content means there was no file
+type journalEntry struct {
+	ID    string          `json:"id"`
+	Prior json.RawMessage `json:"prior,omitempty"`
+}
+
+// Apply saves and deletes segments so either all of them are changed or
+// none is. Prior content of the files is journaled before they are changed
+// and the journal is removed once all of them are flushed to disk. Batch
+// failed meanwhile is rolled back from the journal, so is batch interrupted
+// by a crash when storage is loaded.
+func (s *MultiFileStorage) Apply(upserts []*Segment, deletes []string) error {
+	if err := s.recover(); err != nil {
+		return err
+	}
+
+	journal := make([]journalEntry, 0, len(upserts)+len(deletes))
+	data := make([][]byte, len(upserts))
+
+	for i, segment := range upserts {
+		segmentJSON, err := json.Marshal(segment)
+		if err != nil {
+			return err
+		}
+		data[i] = segmentJSON
+		journal = append(journal, journalEntry{ID: segment.ID})
+	}
+
+	for _, id := range deletes {
+		journal = append(journal, journalEntry{ID: id})
+	}
+
+	for i := range journal {
+		prior, err := ioutil.ReadFile(s.segmentPath(journal[i].ID))
+		switch {
+		case os.IsNotExist(err) && i >= len(upserts):
+			return os.ErrNotExist
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		default:
+			journal[i].Prior = prior
+		}
+	}
+
+	journalJSON, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.storagePath, os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := writeFileSync(s.journalPath(), journalJSON); err != nil {
+		os.Remove(s.journalPath())
+		return err
+	}
+
+	if err := syncDir(path.Dir(s.journalPath())); err != nil {
+		os.Remove(s.journalPath())
+		return err
+	}
+
+	if err := s.applyFiles(upserts, data, deletes); err != nil {
+		s.rollback()
+		return err
+	}
+
+	// batch is committed once journal is removed
+	if err := os.Remove(s.journalPath()); err != nil {
+		s.rollback()
+		return err
+	}
+
+	syncDir(path.Dir(s.journalPath()))
+
+	return nil
+}
+
+// applyFiles writes and removes segment files and flushes them to disk
+func (s *MultiFileStorage) applyFiles(upserts []*Segment, data [][]byte, deletes []string) error {
+	for i, segment := range upserts {
+		if err := writeFileSync(s.segmentPath(segment.ID), data[i]); err != nil {
+			return fmt.Errorf("segment %q: %w", segment.ID, err)
+		}
+	}
+
+	for _, id := range deletes {
+		if err := os.Remove(s.segmentPath(id)); err != nil {
+			return fmt.Errorf("segment %q: %w", id, err)
+		}
+	}
+
+	return syncDir(s.storagePath)
+}
+
+// rollback restores segment files from journal and removes it. Journal
+// which can not be decoded has been torn before any file was changed.
+func (s *MultiFileStorage) rollback() error {
+	journalJSON, err := ioutil.ReadFile(s.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	journal := []journalEntry{}
+	if err := json.Unmarshal(journalJSON, &journal); err == nil {
+		for _, entry := range journal {
+			if len(entry.Prior) == 0 {
+				err = os.Remove(s.segmentPath(entry.ID))
+				if os.IsNotExist(err) {
+					err = nil
+				}
+			} else {
+				err = writeFileSync(s.segmentPath(entry.ID), entry.Prior)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := syncDir(s.storagePath); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(s.journalPath()); err != nil {
+		return err
+	}
+
+	return syncDir(path.Dir(s.journalPath()))
+}
+
+// segmentPath ...
+func (s *MultiFileStorage) segmentPath(id string) string {
+	return path.Join(s.storagePath, id+".json")
+}
+
+// journalPath ...
+func (s *MultiFileStorage) journalPath() string {
+	return s.storagePath + ".journal"
+}
+
 // Load ...
 func (s *MultiFileStorage) Load() (map[string]*Segment, error) {
 	segments := map[string]*Segment{}
 
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+
+	// nothing has been stored yet
 	files, err := ioutil.ReadDir(s.storagePath)
+	if os.IsNotExist(err) {
+		return segments, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -88,3 +284,197 @@ func (s *MultiFileStorage) Load() (map[string]*Segment, error) {
 
 	return segments, nil
 }
+
+// Stage ...
+func (s *MultiFileStorage) Stage(source SegmentSource) (Generation, error) {
+	// batch left behind would be rolled back over the new generation
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+
+	g := &multiFileGeneration{
+		storage: s,
+		path:    s.storagePath + ".stage",
+	}
+
+	if err := os.RemoveAll(g.path); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(g.path, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	for {
+		segment, err := source()
+		if err != nil {
+			g.Discard()
+			return nil, err
+		}
+		if segment == nil {
+			break
+		}
+
+		segmentsJSON, err := json.Marshal(segment)
+		if err != nil {
+			g.Discard()
+			return nil, err
+		}
+
+		if err := writeFileSync(path.Join(g.path, segment.ID+".json"), segmentsJSON); err != nil {
+			g.Discard()
+			return nil, err
+		}
+	}
+
+	if err := syncDir(g.path); err != nil {
+		g.Discard()
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// recover finishes generation switch interrupted between renames and rolls
+// back batch interrupted by a crash
+func (s *MultiFileStorage) recover() error {
+	prev := s.storagePath + ".prev"
+
+	if _, err := os.Stat(s.storagePath); os.IsNotExist(err) {
+		if _, err := os.Stat(prev); err == nil {
+			if err := os.Rename(prev, s.storagePath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.rollback()
+}
+
+// multiFileGeneration ...
+type multiFileGeneration struct {
+	storage *MultiFileStorage
+	path    string
+}
+
+// Commit swaps staged directory with the current one. Current directory is
+// moved aside first so the switch can be completed by recover after a crash.
+// Switch which can not be flushed to disk is undone. Once it is flushed the
+// generation is committed, prior directory failed to be removed is removed
+// by the next Commit.
+func (g *multiFileGeneration) Commit() error {
+	current := g.storage.storagePath
+	prev := current + ".prev"
+
+	if err := os.RemoveAll(prev); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(current); err == nil {
+		if err := os.Rename(current, prev); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(g.path, current); err != nil {
+		os.Rename(prev, current)
+		return err
+	}
+
+	if err := syncDir(path.Dir(current)); err != nil {
+		os.Rename(current, g.path)
+		os.Rename(prev, current)
+		return err
+	}
+
+	os.RemoveAll(prev)
+
+	return nil
+}
+
+// Discard ...
+func (g *multiFileGeneration) Discard() error {
+	return os.RemoveAll(g.path)
+}
+
+// writeFileSync writes file and flushes it to disk
+func writeFileSync(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncDir flushes directory entries to disk, replaced by tests
+var syncDir = func(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Convert copies all segments, metadata and history of existing segments
+// from src storage into dst replacing its content, e.g. to migrate a JSON
+// directory into a binary snapshot and back
+func Convert(dst StorageInterface, src StorageInterface) error {
+	loaded, err := src.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range metaNames {
+		data, err := src.LoadMeta(name)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		if err := dst.SaveMeta(name, data); err != nil {
+			return err
+		}
+	}
+
+	segments := make([]*Segment, 0, len(loaded))
+	for _, segment := range loaded {
+		segments = append(segments, segment)
+
+		data, err := src.LoadMeta(historyMeta(segment.ID))
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		if err := dst.SaveMeta(historyMeta(segment.ID), data); err != nil {
+			return err
+		}
+	}
+
+	generation, err := dst.Stage(sliceSource(segments))
+	if err != nil {
+		return err
+	}
+
+	if err := generation.Commit(); err != nil {
+		generation.Discard()
+		return err
+	}
+
+	return nil
+}
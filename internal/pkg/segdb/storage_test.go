@@ -2,6 +2,7 @@ package segdb
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"path"
 	"testing"
@@ -140,3 +141,185 @@ func TestMultiFileStorage_Load(t *testing.T) {
 
 	assert.Equal(t, output1, output2)
 }
+
+func TestMultiFileStorage_Stage(t *testing.T) {
+	storagePath := "../../../var/lib/segdb_test"
+	defer os.RemoveAll(storagePath)
+
+	s := NewMultiFileStorage(storagePath)
+	segments := getSegments(3)
+
+	assert.NoError(t, s.Save(segments[0]))
+
+	g, err := s.Stage(sliceSource(segments[1:]))
+	assert.NoError(t, err)
+
+	// current generation is untouched until commit
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Contains(t, loaded, "seg1")
+
+	assert.NoError(t, g.Commit())
+
+	loaded, err = s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Contains(t, loaded, "seg2")
+	assert.Contains(t, loaded, "seg3")
+
+	_, err = os.Stat(storagePath + ".stage")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(storagePath + ".prev")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMultiFileStorage_StageDiscard(t *testing.T) {
+	storagePath := "../../../var/lib/segdb_test"
+	defer os.RemoveAll(storagePath)
+
+	s := NewMultiFileStorage(storagePath)
+	segments := getSegments(2)
+
+	assert.NoError(t, s.Save(segments[0]))
+
+	g, err := s.Stage(sliceSource(segments[1:]))
+	assert.NoError(t, err)
+	assert.NoError(t, g.Discard())
+
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Contains(t, loaded, "seg1")
+
+	_, err = os.Stat(storagePath + ".stage")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMultiFileStorage_RecoverInterruptedCommit(t *testing.T) {
+	storagePath := "../../../var/lib/segdb_test"
+	defer os.RemoveAll(storagePath)
+
+	s := NewMultiFileStorage(storagePath)
+	assert.NoError(t, s.Save(getSegments(1)[0]))
+
+	// crash right after current generation has been moved aside
+	assert.NoError(t, os.Rename(storagePath, storagePath+".prev"))
+
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Contains(t, loaded, "seg1")
+}
+
+func TestMultiFileStorage_CommitNotFlushed(t *testing.T) {
+	storagePath := "../../../var/lib/segdb_test"
+	defer os.RemoveAll(storagePath)
+
+	s := NewMultiFileStorage(storagePath)
+	segments := getSegments(2)
+	assert.NoError(t, s.Save(segments[0]))
+
+	g, err := s.Stage(sliceSource(segments[1:]))
+	assert.NoError(t, err)
+
+	flush := syncDir
+	defer func() { syncDir = flush }()
+	syncDir = func(dir string) error { return errors.New("flush failed") }
+
+	// switch is undone, current generation stays
+	assert.Error(t, g.Commit())
+	assert.NoError(t, g.Discard())
+
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Contains(t, loaded, "seg1")
+
+	// prior directory left behind does not fail the next commit
+	syncDir = flush
+	assert.NoError(t, os.MkdirAll(storagePath+".prev", os.ModePerm))
+	g, err = s.Stage(sliceSource(segments[1:]))
+	assert.NoError(t, err)
+	assert.NoError(t, g.Commit())
+
+	loaded, err = s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Contains(t, loaded, "seg2")
+}
+
+func TestMultiFileStorage_Apply(t *testing.T) {
+	storagePath := "../../../var/lib/segdb_test"
+	defer os.RemoveAll(storagePath)
+
+	s := NewMultiFileStorage(storagePath)
+	segments := getSegments(3)
+	assert.NoError(t, s.Save(segments[0]))
+
+	assert.Equal(t, os.ErrNotExist, s.Apply(segments[1:2], []string{"seg3"}))
+	assert.NoError(t, s.Apply(segments[1:], []string{"seg1"}))
+
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Contains(t, loaded, "seg2")
+	assert.Contains(t, loaded, "seg3")
+
+	_, err = os.Stat(storagePath + ".journal")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMultiFileStorage_ApplyRollback(t *testing.T) {
+	storagePath := "../../../var/lib/segdb_test"
+	defer os.RemoveAll(storagePath)
+
+	s := NewMultiFileStorage(storagePath)
+	segments := getSegments(3)
+	assert.NoError(t, s.Save(segments[0]))
+
+	// segment file can not be written over a directory
+	assert.NoError(t, os.MkdirAll(path.Join(storagePath, "seg3.json", "blocked"), os.ModePerm))
+
+	changed := *segments[0]
+	changed.Data = "changed"
+	assert.Error(t, s.Apply([]*Segment{&changed, segments[1], segments[2]}, nil))
+	assert.NoError(t, os.RemoveAll(path.Join(storagePath, "seg3.json")))
+
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Equal(t, segments[0].Data, loaded["seg1"].Data)
+}
+
+func TestMultiFileStorage_RecoverInterruptedApply(t *testing.T) {
+	storagePath := "../../../var/lib/segdb_test"
+	defer os.RemoveAll(storagePath)
+
+	s := NewMultiFileStorage(storagePath)
+	segments := getSegments(2)
+	assert.NoError(t, s.Save(segments[0]))
+
+	prior, err := json.Marshal(segments[0])
+	assert.NoError(t, err)
+	journal, err := json.Marshal([]journalEntry{{ID: "seg1", Prior: prior}, {ID: "seg2"}})
+	assert.NoError(t, err)
+
+	// crash after files of journaled batch have been changed
+	assert.NoError(t, writeFileSync(storagePath+".journal", journal))
+	assert.NoError(t, s.Save(segments[1]))
+	assert.NoError(t, s.Delete("seg1"))
+
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Contains(t, loaded, "seg1")
+
+	// torn journal is dropped
+	assert.NoError(t, writeFileSync(storagePath+".journal", journal[:len(journal)/2]))
+	loaded, err = s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	_, err = os.Stat(storagePath + ".journal")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,165 @@
+package segdb
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	// auditMeta name of metadata keeping audit trail
+	auditMeta = "audit"
+
+	// DefaultAuditSize number of audit entries kept by default
+	DefaultAuditSize = 1000
+
+	// AuditExpired expired segment has been deleted by Sweep
+	AuditExpired = "expired"
+)
+
+// AuditEntry records change made by Segdb itself rather than by a client
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	ID      string    `json:"id"`
+	Version uint64    `json:"version"`
+	// ActiveUntil of expired segment
+	ActiveUntil time.Time `json:"active_until"`
+}
+
+// SetAuditSize sets number of the latest audit entries kept in storage
+func (s *Segdb) SetAuditSize(n int) {
+	s.wmu.Lock()
+	s.auditSize = n
+	s.wmu.Unlock()
+}
+
+// Audit returns audit trail, oldest entries first
+func (s *Segdb) Audit() ([]AuditEntry, error) {
+	data, err := s.storage.LoadMeta(auditMeta)
+	if err != nil || data == nil {
+		return []AuditEntry{}, err
+	}
+
+	entries := []AuditEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Sweep deletes segments whose time window is over, they are kept in
+// history like deleted ones are. Deletions are recorded in audit trail
+// and returned.
+func (s *Segdb) Sweep() ([]AuditEntry, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	now := s.now()
+
+	s.mu.RLock()
+	expired := []string{}
+	current := map[string]*Segment{}
+	for _, segment := range s.getAll(s.order()) {
+		if segment.Expired(now) {
+			expired = append(expired, segment.ID)
+			current[segment.ID] = segment
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(expired) == 0 {
+		return []AuditEntry{}, nil
+	}
+
+	if err := s.applyStorage(nil, expired, current); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	for _, id := range expired {
+		s.remove(id)
+		delete(s.segments, id)
+	}
+	s.mu.Unlock()
+
+	olds := make([]*Segment, 0, len(expired))
+	entries := make([]AuditEntry, 0, len(expired))
+	for _, id := range expired {
+		olds = append(olds, current[id])
+		s.errStats.reset(id)
+		entries = append(entries, AuditEntry{
+			Time:        now,
+			Action:      AuditExpired,
+			ID:          id,
+			Version:     current[id].Version,
+			ActiveUntil: current[id].ActiveUntil,
+		})
+	}
+
+	err := s.keep(olds...)
+	if auditErr := s.audit(entries); err == nil {
+		err = auditErr
+	}
+
+	return entries, err
+}
+
+// StartSweeper runs Sweep every interval until returned stop is called.
+// Report, if given, gets outcome of every sweep that deleted something
+// or failed.
+func (s *Segdb) StartSweeper(interval time.Duration, report func([]AuditEntry, error)) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				entries, err := s.Sweep()
+				if report != nil && (len(entries) > 0 || err != nil) {
+					report(entries, err)
+				}
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { close(stop) })
+		<-done
+	}
+}
+
+// audit appends entries to audit trail dropping the oldest ones over
+// audit size. Callers hold wmu.
+func (s *Segdb) audit(entries []AuditEntry) error {
+	if s.auditSize < 1 {
+		return nil
+	}
+
+	trail, err := s.Audit()
+	if err != nil {
+		return err
+	}
+
+	trail = append(trail, entries...)
+	if len(trail) > s.auditSize {
+		trail = trail[len(trail)-s.auditSize:]
+	}
+
+	data, err := json.Marshal(trail)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.SaveMeta(auditMeta, data)
+}
@@ -0,0 +1,126 @@
+package segdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegdb_TimeWindow(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	s.SetClock(func() time.Time { return now })
+
+	assert.NoError(t, s.Add(&Segment{ID: "always", Filters: "true"}))
+	assert.NoError(t, s.Add(&Segment{ID: "june", Filters: "true", ActiveFrom: now, ActiveUntil: now.AddDate(0, 1, 0)}))
+	assert.NoError(t, s.Add(&Segment{ID: "july", Filters: "true", ActiveFrom: now.AddDate(0, 1, 0)}))
+	assert.NoError(t, s.Add(&Segment{ID: "may", Filters: "true", ActiveUntil: now}))
+
+	assert.Equal(t, []string{"always", "june"}, segmentIDs(s.Query(nil, -1)))
+	assert.Equal(t, []string{"always", "june"}, segmentIDs(s.ListWhere(And(), -1, -1)))
+
+	page, err := s.ListPage(&ListOptions{Limit: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"always"}, segmentIDs(page.Segments))
+	page, err = s.ListPage(&ListOptions{Limit: 1, Cursor: page.Next})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"june"}, segmentIDs(page.Segments))
+	assert.Equal(t, "", page.Next)
+
+	page, err = s.ListPage(&ListOptions{Inactive: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"always", "june", "july", "may"}, segmentIDs(page.Segments))
+
+	now = now.AddDate(0, 1, 0)
+	assert.Equal(t, []string{"always", "july"}, segmentIDs(s.Query(nil, -1)))
+
+	// patched window
+	until := now.Add(time.Hour)
+	segment, err := s.Patch("may", &Patch{ActiveUntil: &until})
+	assert.NoError(t, err)
+	assert.Equal(t, now, segment.UpdatedAt)
+	assert.Equal(t, []string{"always", "july", "may"}, segmentIDs(s.Query(nil, -1)))
+
+	zero := time.Time{}
+	_, err = s.Patch("june", &Patch{ActiveUntil: &zero})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"always", "june", "july", "may"}, segmentIDs(s.Query(nil, -1)))
+
+	loaded := getSegDb()
+	assert.NoError(t, loaded.Load())
+	segment, _ = loaded.Get("may")
+	assert.True(t, until.Equal(segment.ActiveUntil))
+}
+
+func TestSegdb_Sweep(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	s.SetClock(func() time.Time { return now })
+	s.SetHistorySize(1)
+	s.SetAuditSize(2)
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true", ActiveUntil: now.Add(time.Hour)}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg2", Filters: "true", ActiveUntil: now.Add(2 * time.Hour)}))
+	assert.NoError(t, s.Add(&Segment{ID: "seg3", Filters: "true", ActiveFrom: now.Add(time.Hour)}))
+
+	entries, err := s.Sweep()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	now = now.Add(time.Hour)
+	entries, err = s.Sweep()
+	assert.NoError(t, err)
+	assert.Equal(t, []AuditEntry{{Time: now, Action: AuditExpired, ID: "seg1", Version: 1, ActiveUntil: now}}, entries)
+
+	_, err = s.Get("seg1")
+	assert.Equal(t, ErrNotFound, err)
+	versions, err := s.History("seg1")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, versionsOf(versions))
+
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true", ActiveUntil: now}))
+	entries, err = s.Sweep()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seg2", "seg1"}, []string{entries[0].ID, entries[1].ID})
+
+	// audit trail keeps the latest entries
+	trail, err := s.Audit()
+	assert.NoError(t, err)
+	assert.Len(t, trail, 2)
+	assert.Equal(t, "seg1", trail[1].ID)
+	assert.Equal(t, uint64(2), trail[1].Version)
+
+	loaded := getSegDb()
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, []string{"seg3"}, segmentIDs(loaded.ListWhere(And(), -1, -1)))
+}
+
+func TestSegdb_StartSweeper(t *testing.T) {
+	s := getSegDb()
+	defer clearStorage()
+
+	assert.NoError(t, s.Add(&Segment{ID: "seg1", Filters: "true", ActiveUntil: time.Now().Add(-time.Second)}))
+
+	reported := make(chan []AuditEntry, 1)
+	stop := s.StartSweeper(time.Millisecond, func(entries []AuditEntry, err error) {
+		assert.NoError(t, err)
+		reported <- entries
+	})
+
+	select {
+	case entries := <-reported:
+		assert.Equal(t, "seg1", entries[0].ID)
+	case <-time.After(time.Second):
+		t.Error("expired segment has not been swept")
+	}
+
+	stop()
+	stop()
+	assert.Equal(t, 0, s.GetSegmentsCount())
+}
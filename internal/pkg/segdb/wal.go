@@ -0,0 +1,524 @@
+package segdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+const (
+	walLogFile      = "wal.log"
+	walSnapshotFile = "snapshot.json"
+	walStageFile    = "snapshot.stage"
+
+	walOpSave   = "save"
+	walOpDelete = "delete"
+	walOpBatch  = "batch"
+
+	walHeaderSize = 8
+
+	// DefaultCompactEvery number of log records after which WAL is compacted
+	DefaultCompactEvery = 1000
+)
+
+// ErrCorruptedSnapshot snapshot file can not be decoded
+var ErrCorruptedSnapshot = errors.New("corrupted snapshot")
+
+// WALStorage ...
+//
+// WALStorage keeps segments in a snapshot file plus an append-only log of
+// changes made after it. Every record is checksummed and flushed to disk
+// before Save, Delete or Apply returns. Records carry the generation of the snapshot
+// they follow, so records already folded into a newer snapshot are skipped
+// on recovery, and a torn tail left by a crash is truncated.
+type WALStorage struct {
+	mu           sync.Mutex
+	dir          string
+	log          *os.File
+	generation   uint64
+	records      int
+	compactEvery int
+	segments     map[string]json.RawMessage
+}
+
+// walRecord ...
+type walRecord struct {
+	Op         string          `json:"op"`
+	Generation uint64          `json:"gen"`
+	ID         string          `json:"id"`
+	Segment    json.RawMessage `json:"segment,omitempty"`
+	// Batch records applied together
+	Batch []*walRecord `json:"batch,omitempty"`
+}
+
+// walSnapshot ...
+type walSnapshot struct {
+	Generation uint64            `json:"gen"`
+	Segments   []json.RawMessage `json:"segments"`
+}
+
+// NewWALStorage ...
+func NewWALStorage(dir string) *WALStorage {
+	return &WALStorage{
+		dir:          dir,
+		compactEvery: DefaultCompactEvery,
+	}
+}
+
+// SetCompactEvery sets number of log records after which log is compacted
+// into snapshot, compaction is disabled when n < 1
+func (s *WALStorage) SetCompactEvery(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.compactEvery = n
+}
+
+// Save ...
+func (s *WALStorage) Save(segment *Segment) error {
+	segmentJSON, err := json.Marshal(segment)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	if err := s.append(&walRecord{Op: walOpSave, ID: segment.ID, Segment: segmentJSON}); err != nil {
+		return err
+	}
+
+	s.segments[segment.ID] = segmentJSON
+	s.maybeCompact()
+
+	return nil
+}
+
+// Delete ...
+func (s *WALStorage) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	if _, ok := s.segments[id]; ok == false {
+		return os.ErrNotExist
+	}
+
+	if err := s.append(&walRecord{Op: walOpDelete, ID: id}); err != nil {
+		return err
+	}
+
+	delete(s.segments, id)
+	s.maybeCompact()
+
+	return nil
+}
+
+// Apply saves and deletes segments writing a single log record
+func (s *WALStorage) Apply(upserts []*Segment, deletes []string) error {
+	record := &walRecord{Op: walOpBatch}
+
+	for _, segment := range upserts {
+		segmentJSON, err := json.Marshal(segment)
+		if err != nil {
+			return err
+		}
+		record.Batch = append(record.Batch, &walRecord{Op: walOpSave, ID: segment.ID, Segment: segmentJSON})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	for _, id := range deletes {
+		if _, ok := s.segments[id]; ok == false {
+			return os.ErrNotExist
+		}
+		record.Batch = append(record.Batch, &walRecord{Op: walOpDelete, ID: id})
+	}
+
+	if err := s.append(record); err != nil {
+		return err
+	}
+
+	applyRecord(s.segments, record)
+	s.maybeCompact()
+
+	return nil
+}
+
+// Clear ...
+func (s *WALStorage) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	if err := s.writeSnapshot(path.Join(s.dir, walStageFile), s.generation+1, nil); err != nil {
+		return err
+	}
+
+	return s.commit(map[string]json.RawMessage{})
+}
+
+// Load ...
+func (s *WALStorage) Load() (map[string]*Segment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.close()
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	segments := make(map[string]*Segment, len(s.segments))
+	for id, segmentJSON := range s.segments {
+		segment := &Segment{}
+		if err := json.Unmarshal(segmentJSON, segment); err != nil {
+			return nil, err
+		}
+		segments[id] = segment
+	}
+
+	return segments, nil
+}
+
+// Stage ...
+func (s *WALStorage) Stage(source SegmentSource) (Generation, error) {
+	// source may read metadata, so it is drained before locking
+	staged := map[string]json.RawMessage{}
+	for {
+		segment, err := source()
+		if err != nil {
+			return nil, err
+		}
+		if segment == nil {
+			break
+		}
+
+		segmentJSON, err := json.Marshal(segment)
+		if err != nil {
+			return nil, err
+		}
+		staged[segment.ID] = segmentJSON
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	if err := s.writeSnapshot(path.Join(s.dir, walStageFile), s.generation+1, staged); err != nil {
+		return nil, err
+	}
+
+	return &walGeneration{storage: s, segments: staged}, nil
+}
+
+// Compact folds log into a new snapshot
+func (s *WALStorage) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	return s.compact()
+}
+
+// Close ...
+func (s *WALStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.close()
+}
+
+func (s *WALStorage) close() error {
+	if s.log == nil {
+		return nil
+	}
+
+	err := s.log.Close()
+	s.log = nil
+	s.segments = nil
+
+	return err
+}
+
+// open recovers state from disk and opens log for appending
+func (s *WALStorage) open() error {
+	if s.log != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	os.Remove(path.Join(s.dir, walStageFile))
+
+	generation, segments, err := s.readSnapshot()
+	if err != nil {
+		return err
+	}
+
+	log, err := os.OpenFile(path.Join(s.dir, walLogFile), os.O_RDWR|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	records, err := s.replay(log, generation, segments)
+	if err != nil {
+		log.Close()
+		return err
+	}
+
+	s.log = log
+	s.generation = generation
+	s.segments = segments
+	s.records = records
+
+	return nil
+}
+
+// readSnapshot ...
+func (s *WALStorage) readSnapshot() (uint64, map[string]json.RawMessage, error) {
+	segments := map[string]json.RawMessage{}
+
+	data, err := ioutil.ReadFile(path.Join(s.dir, walSnapshotFile))
+	if os.IsNotExist(err) {
+		return 0, segments, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	snapshot := &walSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return 0, nil, ErrCorruptedSnapshot
+	}
+
+	for _, segmentJSON := range snapshot.Segments {
+		segment := &struct{ ID string }{}
+		if err := json.Unmarshal(segmentJSON, segment); err != nil {
+			return 0, nil, ErrCorruptedSnapshot
+		}
+		segments[segment.ID] = segmentJSON
+	}
+
+	return snapshot.Generation, segments, nil
+}
+
+// replay applies log records of the given generation to segments and
+// truncates log at the first torn or corrupted record
+func (s *WALStorage) replay(log *os.File, generation uint64, segments map[string]json.RawMessage) (int, error) {
+	info, err := log.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := log.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(log)
+	header := make([]byte, walHeaderSize)
+	offset := int64(0)
+	records := 0
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+
+		// corrupted length may exceed what is left of the log
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		if size > info.Size()-offset-walHeaderSize {
+			break
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+
+		record := &walRecord{}
+		if err := json.Unmarshal(payload, record); err != nil {
+			break
+		}
+
+		offset += int64(walHeaderSize + len(payload))
+
+		if record.Generation != generation {
+			continue
+		}
+
+		applyRecord(segments, record)
+		records++
+	}
+
+	if err := log.Truncate(offset); err != nil {
+		return 0, err
+	}
+
+	if _, err := log.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return records, nil
+}
+
+// applyRecord ...
+func applyRecord(segments map[string]json.RawMessage, record *walRecord) {
+	switch record.Op {
+	case walOpSave:
+		segments[record.ID] = record.Segment
+	case walOpDelete:
+		delete(segments, record.ID)
+	case walOpBatch:
+		for _, r := range record.Batch {
+			applyRecord(segments, r)
+		}
+	}
+}
+
+// append writes record to the log and flushes it to disk
+func (s *WALStorage) append(record *walRecord) error {
+	record.Generation = s.generation
+
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[walHeaderSize:], payload)
+
+	if _, err := s.log.Write(buf); err != nil {
+		return err
+	}
+
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+
+	s.records++
+
+	return nil
+}
+
+// maybeCompact compacts log grown over compactEvery records. Changes are
+// already in the log, so failed compaction does not fail them and is tried
+// again after the next record.
+func (s *WALStorage) maybeCompact() {
+	if s.compactEvery < 1 || s.records < s.compactEvery {
+		return
+	}
+
+	s.compact()
+}
+
+func (s *WALStorage) compact() error {
+	if err := s.writeSnapshot(path.Join(s.dir, walStageFile), s.generation+1, s.segments); err != nil {
+		return err
+	}
+
+	return s.commit(s.segments)
+}
+
+// writeSnapshot ...
+func (s *WALStorage) writeSnapshot(filename string, generation uint64, segments map[string]json.RawMessage) error {
+	snapshot := &walSnapshot{
+		Generation: generation,
+		Segments:   make([]json.RawMessage, 0, len(segments)),
+	}
+
+	for _, segmentJSON := range segments {
+		snapshot.Segments = append(snapshot.Segments, segmentJSON)
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	return writeFileSync(filename, data)
+}
+
+// commit makes staged snapshot current. Once it is renamed, records of the
+// previous generation are ignored and new records carry the new generation,
+// so nothing after the rename fails commit. Log is truncated only when the
+// rename has been flushed, otherwise the previous snapshot may come back
+// after a crash along with its records.
+func (s *WALStorage) commit(segments map[string]json.RawMessage) error {
+	if err := os.Rename(path.Join(s.dir, walStageFile), path.Join(s.dir, walSnapshotFile)); err != nil {
+		return err
+	}
+
+	s.generation++
+	s.segments = segments
+	s.records = 0
+
+	if err := syncDir(s.dir); err != nil {
+		return nil
+	}
+
+	if err := s.log.Truncate(0); err == nil {
+		s.log.Seek(0, io.SeekStart)
+	}
+
+	return nil
+}
+
+// walGeneration ...
+type walGeneration struct {
+	storage  *WALStorage
+	segments map[string]json.RawMessage
+}
+
+// Commit ...
+func (g *walGeneration) Commit() error {
+	g.storage.mu.Lock()
+	defer g.storage.mu.Unlock()
+
+	if err := g.storage.open(); err != nil {
+		return err
+	}
+
+	return g.storage.commit(g.segments)
+}
+
+// Discard ...
+func (g *walGeneration) Discard() error {
+	return os.Remove(path.Join(g.storage.dir, walStageFile))
+}
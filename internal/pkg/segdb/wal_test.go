@@ -0,0 +1,301 @@
+package segdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWALStorage_SaveDeleteLoad(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewWALStorage(storagePath)
+	segments := getSegments(3)
+
+	for _, segment := range segments {
+		assert.NoError(t, s.Save(segment))
+	}
+	assert.NoError(t, s.Delete("seg2"))
+	assert.Error(t, s.Delete("seg2"))
+	assert.NoError(t, s.Close())
+
+	loaded, err := NewWALStorage(storagePath).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Equal(t, segments[0].Filters, loaded["seg1"].Filters)
+	assert.Equal(t, segments[2].Data, loaded["seg3"].Data)
+}
+
+func TestWALStorage_Apply(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewWALStorage(storagePath)
+	segments := getSegments(3)
+
+	assert.NoError(t, s.Apply(segments[:2], nil))
+	segments[0].Data = "changed"
+	assert.Equal(t, os.ErrNotExist, s.Apply([]*Segment{segments[2]}, []string{"seg3"}))
+	assert.NoError(t, s.Apply([]*Segment{segments[0], segments[2]}, []string{"seg2"}))
+	assert.NoError(t, s.Close())
+
+	loaded, err := NewWALStorage(storagePath).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Equal(t, "changed", loaded["seg1"].Data)
+	assert.Equal(t, segments[2].Filters, loaded["seg3"].Filters)
+}
+
+func TestWALStorage_TornTail(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewWALStorage(storagePath)
+	for _, segment := range getSegments(2) {
+		assert.NoError(t, s.Save(segment))
+	}
+	assert.NoError(t, s.Close())
+
+	logPath := path.Join(storagePath, walLogFile)
+	info, err := os.Stat(logPath)
+	assert.NoError(t, err)
+	size := info.Size()
+
+	// half written record
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 1, 2})
+	assert.NoError(t, err)
+	f.Close()
+
+	s = NewWALStorage(storagePath)
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+
+	info, err = os.Stat(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, size, info.Size())
+
+	// log stays appendable after truncation
+	assert.NoError(t, s.Save(getSegments(3)[2]))
+	assert.NoError(t, s.Close())
+
+	loaded, err = NewWALStorage(storagePath).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 3)
+}
+
+func TestWALStorage_CorruptedLength(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewWALStorage(storagePath)
+	assert.NoError(t, s.Save(getSegments(1)[0]))
+	assert.NoError(t, s.Close())
+
+	// header of record claiming 4GB payload
+	logPath := path.Join(storagePath, walLogFile)
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, '{'})
+	assert.NoError(t, err)
+	f.Close()
+
+	loaded, err := NewWALStorage(storagePath).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Contains(t, loaded, "seg1")
+}
+
+func TestWALStorage_Checksum(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewWALStorage(storagePath)
+	for _, segment := range getSegments(2) {
+		assert.NoError(t, s.Save(segment))
+	}
+	assert.NoError(t, s.Close())
+
+	logPath := path.Join(storagePath, walLogFile)
+	info, err := os.Stat(logPath)
+	assert.NoError(t, err)
+
+	// flip last byte of the second record
+	f, err := os.OpenFile(logPath, os.O_RDWR, os.ModePerm)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{'x'}, info.Size()-1)
+	assert.NoError(t, err)
+	f.Close()
+
+	loaded, err := NewWALStorage(storagePath).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Contains(t, loaded, "seg1")
+}
+
+func TestWALStorage_Compact(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewWALStorage(storagePath)
+	s.SetCompactEvery(3)
+
+	for _, segment := range getSegments(4) {
+		assert.NoError(t, s.Save(segment))
+	}
+	assert.Equal(t, uint64(1), s.generation)
+	assert.Equal(t, 1, s.records)
+	assert.FileExists(t, path.Join(storagePath, walSnapshotFile))
+	assert.NoError(t, s.Close())
+
+	loaded, err := NewWALStorage(storagePath).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 4)
+}
+
+func TestWALStorage_CompactionFailure(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewWALStorage(storagePath)
+	s.SetCompactEvery(2)
+	segments := getSegments(3)
+	assert.NoError(t, s.Save(segments[0]))
+
+	// staged snapshot can not be written over a directory
+	stage := path.Join(storagePath, walStageFile)
+	assert.NoError(t, os.MkdirAll(path.Join(stage, "blocked"), os.ModePerm))
+
+	assert.NoError(t, s.Save(segments[1]))
+	assert.NoError(t, s.Delete("seg1"))
+	assert.Equal(t, uint64(0), s.generation)
+
+	// compaction succeeds with the next record
+	assert.NoError(t, os.RemoveAll(stage))
+	assert.NoError(t, s.Save(segments[2]))
+	assert.Equal(t, uint64(1), s.generation)
+	assert.NoError(t, s.Close())
+
+	loaded, err := NewWALStorage(storagePath).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Contains(t, loaded, "seg2")
+	assert.Contains(t, loaded, "seg3")
+}
+
+func TestWALStorage_CommitNotFlushed(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	storage := NewWALStorage(storagePath)
+	db := New(storage)
+	assert.NoError(t, db.Publish([]*Segment{{ID: "seg1", Data: "old", Filters: "true"}}))
+	assert.NoError(t, db.Add(&Segment{ID: "seg2", Filters: "true"}))
+
+	flush := syncDir
+	defer func() { syncDir = flush }()
+	syncDir = func(dir string) error { return errors.New("flush failed") }
+
+	// renamed snapshot is current, memory follows it
+	assert.NoError(t, db.Publish([]*Segment{{ID: "seg1", Data: "new", Filters: "true"}}))
+	segment, _ := db.Get("seg1")
+	assert.Equal(t, "new", segment.Data)
+	assert.Equal(t, 1, db.GetSegmentsCount())
+
+	// log is kept until the rename is flushed
+	info, err := os.Stat(path.Join(storagePath, walLogFile))
+	assert.NoError(t, err)
+	assert.NotZero(t, info.Size())
+
+	assert.NoError(t, db.Add(&Segment{ID: "seg3", Filters: "true"}))
+	assert.NoError(t, storage.Close())
+
+	loaded, err := NewWALStorage(storagePath).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Equal(t, "new", loaded["seg1"].Data)
+	assert.Contains(t, loaded, "seg3")
+}
+
+func TestWALStorage_StaleRecordsAfterCompaction(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewWALStorage(storagePath)
+	for _, segment := range getSegments(2) {
+		assert.NoError(t, s.Save(segment))
+	}
+	assert.NoError(t, s.Close())
+
+	logPath := path.Join(storagePath, walLogFile)
+	stale, err := ioutil.ReadFile(logPath)
+	assert.NoError(t, err)
+
+	s = NewWALStorage(storagePath)
+	_, err = s.Load()
+	assert.NoError(t, err)
+	assert.NoError(t, s.Delete("seg1"))
+	assert.NoError(t, s.Compact())
+	assert.NoError(t, s.Close())
+
+	// crash between snapshot rename and log truncation
+	assert.NoError(t, writeFileSync(logPath, stale))
+
+	loaded, err := NewWALStorage(storagePath).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Contains(t, loaded, "seg2")
+}
+
+func TestWALStorage_Stage(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	s := NewWALStorage(storagePath)
+	segments := getSegments(3)
+	assert.NoError(t, s.Save(segments[0]))
+
+	g, err := s.Stage(sliceSource(segments[1:]))
+	assert.NoError(t, err)
+	assert.NoError(t, g.Discard())
+
+	loaded, err := s.Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+
+	g, err = s.Stage(sliceSource(segments[1:]))
+	assert.NoError(t, err)
+	assert.NoError(t, g.Commit())
+	assert.NoError(t, s.Close())
+
+	loaded, err = NewWALStorage(storagePath).Load()
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 2)
+	assert.Contains(t, loaded, "seg2")
+	assert.Contains(t, loaded, "seg3")
+}
+
+func TestWALStorage_Segdb(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	db := New(NewWALStorage(storagePath))
+	assert.NoError(t, db.Publish(getSegments(3)))
+	assert.NoError(t, db.Add(&Segment{ID: "seg10", Filters: "level > 5"}))
+	assert.NoError(t, db.Delete("seg1"))
+
+	db = New(NewWALStorage(storagePath))
+	assert.NoError(t, db.Load())
+	assert.Equal(t, 3, db.GetSegmentsCount())
+	assert.Len(t, db.Query(map[string]interface{}{"level": 6, "uvs": 1}, 0), 3)
+}
+
+func TestWALStorage_SegdbRecoveryFailure(t *testing.T) {
+	defer os.RemoveAll(storagePath)
+
+	// empty storage loads nothing
+	db := New(NewWALStorage(storagePath))
+	assert.NoError(t, db.Load())
+	assert.Equal(t, 0, db.GetSegmentsCount())
+
+	assert.NoError(t, ioutil.WriteFile(path.Join(storagePath, walSnapshotFile), []byte("{"), os.ModePerm))
+
+	db = New(NewWALStorage(storagePath))
+	assert.Equal(t, ErrCorruptedSnapshot, db.Load())
+}